@@ -0,0 +1,39 @@
+// Command backfill-room-listing builds the room listing indexes of
+// migration 024 for rooms created before it: public_rooms for the directory
+// and room_activity_by_user for members without an activity row. Rooms and
+// members already indexed are left alone, so the tool can be re-run safely.
+package main
+
+import (
+	"log"
+
+	"gochat/internal/chat"
+	"gochat/internal/db"
+	"gochat/internal/utils"
+)
+
+func main() {
+	keyspace := utils.GetEnv("SCYLLA_KEYSPACE", "chat_app")
+	session := db.InitScylla(nil, keyspace)
+	defer session.Close()
+
+	repo := chat.NewRepository(session)
+	rooms, members := 0, 0
+	err := repo.EachRoom(func(rm *chat.Room) error {
+		n, err := repo.BackfillListing(rm)
+		if err != nil {
+			log.Printf("❌ room %s: %v", rm.RoomID, err)
+			return err
+		}
+		rooms++
+		members += n
+		if rooms%1000 == 0 {
+			log.Printf("… %d rooms", rooms)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("❌ scan rooms: %v", err)
+	}
+	log.Printf("✅ indexed %d rooms, %d memberships", rooms, members)
+}
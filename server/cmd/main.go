@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -14,6 +13,12 @@ import (
 
 	"gochat/internal/auth"
 	"gochat/internal/db"
+	"gochat/internal/leader"
+	"gochat/internal/mailer"
+	"gochat/internal/notify"
+	"gochat/internal/ratelimit"
+	"gochat/internal/reminder"
+	"gochat/internal/subscription"
 	"gochat/internal/utils"
 	"gochat/internal/ws"
 
@@ -30,6 +35,12 @@ func main() {
 	scyllaKeyspace := utils.GetEnv("SCYLLA_KEYSPACE", "chat_app")
 	// redisAddr := utils.GetEnv("REDIS_ADDR", "127.0.0.1:6379")
 
+	keys, err := utils.LoadKeySet()
+	if err != nil {
+		log.Fatalf("❌ Failed to load JWT keys: %v", err)
+	}
+	utils.Keys = keys
+
 	scyllaSession := db.InitScylla(nil, scyllaKeyspace)
 	defer scyllaSession.Close()
 
@@ -38,38 +49,34 @@ func main() {
 
 	chatRepo := chat.NewRepository(scyllaSession)
 	chatSvc := chat.NewService(chatRepo)
-
-	persist := func(roomID, userID gocql.UUID, text string, createdAt time.Time, parentID *gocql.UUID) (gocql.UUID, error) {
-		id := gocql.TimeUUID()
-		err := chatRepo.InsertMessage(&chat.Message{
-			RoomID:    roomID,
-			MsgID:     id,
-			UserID:    userID,
-			Content:   text,
-			CreatedAt: createdAt,
-			ParentID:  parentID,
-		})
-		return id, err
-	}
-
-	lookup := func(ctx context.Context, userID gocql.UUID) (string, error) {
-		var username string
-
-		err := scyllaSession.
-			Query(`SELECT username FROM users WHERE id = ? LIMIT 1`, userID).
-			Consistency(gocql.One).
-			Scan(&username)
-		if err == gocql.ErrNotFound {
-			return "", nil
-		}
-		return username, err
-	}
+	chatSvc.Retention = chat.RetentionConfigFromEnv()
+	chatSvc.Limiter = ratelimit.New(redisClient, "chat")
 
 	pres := presence.New(redisClient, 45*time.Second)
 
-	hub := ws.NewHub(persist, lookup)
+	hub := ws.NewHub()
 	hub.Presence = pres
+	chatSvc.Hub = hub
+	chatSvc.RegisterCommands(hub)
 	go hub.Run()
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	notifySvc := notify.NewService(scyllaSession, hub)
+	reminderSvc := reminder.NewService(reminder.NewRepository(scyllaSession), chatSvc, notifySvc)
+	reminderSvc.RegisterSlashCommands()
+
+	subSvc := subscription.NewService(subscription.NewRepository(scyllaSession), chatSvc)
+	chatSvc.OnEvent = subSvc.Enqueue
+
+	// One replica runs the time-based jobs.
+	workerLeader := leader.New(redisClient, "leader:workers", 15*time.Second)
+	go workerLeader.Run(workerCtx)
+	go chatSvc.RunRetention(workerCtx, workerLeader.IsLeader)
+	go chatSvc.RunScheduler(workerCtx, workerLeader.IsLeader)
+	go reminderSvc.RunWorker(workerCtx, workerLeader.IsLeader)
+	go subSvc.RunWorker(workerCtx, workerLeader.IsLeader)
 	chatH := chat.NewHandler(chatSvc, scyllaSession, hub)
 
 	logger, _ := zap.NewDevelopment()
@@ -77,7 +84,19 @@ func main() {
 
 	authRepo := auth.NewRepository(scyllaSession)
 	authService := auth.NewService(authRepo)
+	authService.Redis = redisClient
+	authService.OnSessionsRevoked = hub.CloseSessions
+	authService.Mailer, err = mailer.FromEnv()
+	if err != nil {
+		log.Fatalf("❌ Failed to configure mail: %v", err)
+	}
+	authService.Limiter = ratelimit.New(redisClient, "auth")
+	if authService.OIDC, err = auth.OIDCProvidersFromEnv(); err != nil {
+		log.Fatalf("oidc: %v", err)
+	}
 	authHandler := auth.NewHandler(authService)
+	// API tokens are accepted wherever a session JWT is.
+	auth.Authenticate = authService.Authenticate
 
 	r := mux.NewRouter()
 
@@ -88,27 +107,33 @@ func main() {
 			return false
 		}
 
-		// 1) if user is a participant → allow
-		if ok, err := chatRepo.IsParticipant(rid, uid); err == nil && ok {
-			return true
-		}
+		// participants, or anyone for public rooms
+		return chatSvc.EnsureMemberOrPublic(rid, uid) == nil
+	}
 
-		// 2) if the room has no participants at all → treat as public → allow
-		if has, err := chatRepo.RoomHasParticipants(rid); err == nil && !has {
-			return true
+	hub.ResolveRoom = func(ref string) (string, bool) {
+		id, err := chatSvc.ResolveRoom(ref)
+		if err != nil {
+			return "", false
 		}
-
-		// 3) otherwise deny
-		return false
+		return id.String(), true
 	}
 
 	api := r.PathPrefix("/api").Subrouter()
 	api.Use(auth.AuthMiddleware)
 
 	chatH.Register(api.PathPrefix("/chat").Subrouter())
+	reminder.NewHandler(reminderSvc).Register(api)
+	notify.NewHandler(notifySvc).Register(api)
+	subscription.NewHandler(subSvc).Register(api)
 
 	api.HandleFunc("/chat/rooms/{room_id}/presence", func(w http.ResponseWriter, r *http.Request) {
-		roomID := mux.Vars(r)["room_id"]
+		rid, err := chatSvc.ResolveRoom(mux.Vars(r)["room_id"])
+		if err != nil {
+			http.Error(w, "invalid room id", http.StatusBadRequest)
+			return
+		}
+		roomID := rid.String()
 		users, err := pres.List(r.Context(), roomID, 1000)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -140,20 +165,9 @@ func main() {
 	}).Methods("GET")
 
 	authHandler.RegisterRouter(r)
+	chatH.RegisterHooks(r)
 
-	jwtValidator := func(token string) (string, error) {
-		claims, err := utils.ValidateJWT(token)
-		if err != nil {
-			return "", err
-		}
-		uid, _ := claims["user_id"].(string)
-		if uid == "" {
-			return "", fmt.Errorf("user_id missing in token")
-		}
-		return uid, nil
-	}
-
-	r.HandleFunc("/ws", chat.WSHandler(hub, jwtValidator, logger, 256))
+	r.HandleFunc("/ws", chat.WSHandler(hub, authService.Authenticate, logger, 256))
 
 	handler := withCORS(r)
 
@@ -201,7 +215,7 @@ func withCORS(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Vary", "Origin")
 		}
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key")
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 
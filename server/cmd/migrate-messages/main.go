@@ -0,0 +1,96 @@
+// Command migrate-messages moves rows from the legacy room_messages table
+// into the month-bucketed room_messages_by_bucket layout (migration 008).
+// Each copy is conditional, so a message already in the new table keeps its
+// edits and deletion, and the legacy row is removed once copied, so a re-run
+// does not bring back messages purged since. An interrupted run can simply
+// be started again.
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"gochat/internal/chat"
+	"gochat/internal/db"
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "count rows without writing")
+	pageSize := flag.Int("page-size", 500, "rows fetched per page")
+	flag.Parse()
+
+	keyspace := utils.GetEnv("SCYLLA_KEYSPACE", "chat_app")
+	session := db.InitScylla(nil, keyspace)
+	defer session.Close()
+
+	iter := session.Query(`SELECT room_id, msg_id, user_id, content, created_at, edited_at,
+	                              deleted_at, deleted_by, deleted_reason, parent_id, edit_count
+	                       FROM room_messages`).PageSize(*pageSize).Iter()
+
+	var (
+		roomID, msgID, userID  gocql.UUID
+		deletedBy, parentID    *gocql.UUID
+		content, deletedReason string
+		createdAt              time.Time
+		editedAt, deletedAt    *time.Time
+		editCount              int
+		copied, skipped        int
+		seen                   = map[gocql.UUID]map[int]bool{}
+	)
+
+	for iter.Scan(&roomID, &msgID, &userID, &content, &createdAt, &editedAt,
+		&deletedAt, &deletedBy, &deletedReason, &parentID, &editCount) {
+		bucket := chat.BucketOf(msgID)
+
+		if !*dryRun {
+			if !seen[roomID][bucket] {
+				if err := session.Query(
+					`INSERT INTO room_message_buckets (room_id, bucket) VALUES (?, ?)`, roomID, bucket,
+				).Exec(); err != nil {
+					log.Fatalf("bucket %s/%d: %v", roomID, bucket, err)
+				}
+				if seen[roomID] == nil {
+					seen[roomID] = map[int]bool{}
+				}
+				seen[roomID][bucket] = true
+			}
+			applied, err := session.Query(`INSERT INTO room_messages_by_bucket
+			        (room_id, bucket, msg_id, user_id, content, created_at, edited_at,
+			         deleted_at, deleted_by, deleted_reason, parent_id, edit_count)
+			        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+				roomID, bucket, msgID, userID, content, createdAt, editedAt,
+				deletedAt, deletedBy, deletedReason, parentID, editCount,
+			).MapScanCAS(map[string]interface{}{})
+			if err != nil {
+				log.Fatalf("message %s/%s: %v", roomID, msgID, err)
+			}
+			if err := session.Query(`DELETE FROM room_messages WHERE room_id = ? AND msg_id = ?`,
+				roomID, msgID).Exec(); err != nil {
+				log.Fatalf("remove legacy message %s/%s: %v", roomID, msgID, err)
+			}
+			if !applied {
+				skipped++
+			}
+		}
+
+		copied++
+		if copied%10000 == 0 {
+			log.Printf("… %d messages", copied)
+		}
+		deletedBy, parentID, editedAt, deletedAt = nil, nil, nil, nil
+		deletedReason, editCount = "", 0
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatalf("❌ scan room_messages: %v", err)
+	}
+
+	if *dryRun {
+		log.Printf("✅ dry run: %d messages would be moved", copied)
+		return
+	}
+	log.Printf("✅ moved %d messages, %d of them already copied", copied, skipped)
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"gochat/internal/mailer"
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+)
+
+// Email verification and password reset both mail the user a link carrying
+// a single-use token. Only a hash of the token is stored, and redeeming it
+// deletes the row with a lightweight transaction, so a token works once even
+// when two requests race.
+
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+
+	// Reset mails per address per hour, so the endpoint cannot flood an inbox.
+	resetMailsPerHour = 3
+)
+
+var (
+	ErrInvalidEmailToken    = errors.New("invalid or expired token")
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+)
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type emailToken struct {
+	hash      string
+	Purpose   string
+	UserID    gocql.UUID
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (s *Service) sendMail(m mailer.Message) error {
+	if s.Mailer == nil {
+		return errors.New("mailer not configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.Mailer.Send(ctx, m)
+}
+
+// issueEmailToken stores a token for u and returns the link that redeems it.
+func (s *Service) issueEmailToken(u *User, purpose, path string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	raw := hex.EncodeToString(b)
+	now := time.Now().UTC()
+	t := &emailToken{
+		hash:      hashAPIToken(raw),
+		Purpose:   purpose,
+		UserID:    u.ID,
+		Email:     u.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := s.Repo.InsertEmailToken(t); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(s.AppURL, "/") + path + "?token=" + url.QueryEscape(raw), nil
+}
+
+// consumeEmailToken redeems raw for purpose and returns its user.
+func (s *Service) consumeEmailToken(raw, purpose string) (*User, error) {
+	if raw == "" {
+		return nil, ErrInvalidEmailToken
+	}
+	t, err := s.Repo.GetEmailToken(hashAPIToken(raw))
+	if err == gocql.ErrNotFound {
+		return nil, ErrInvalidEmailToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Purpose != purpose || time.Now().After(t.ExpiresAt) {
+		return nil, ErrInvalidEmailToken
+	}
+	if ok, err := s.Repo.DeleteEmailToken(t.hash); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrInvalidEmailToken
+	}
+	u, err := s.Repo.GetUserByID(t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// The token is for the address it was mailed to.
+	if u == nil || !strings.EqualFold(u.Email, t.Email) {
+		return nil, ErrInvalidEmailToken
+	}
+	return u, nil
+}
+
+func (s *Service) sendVerification(u *User) error {
+	link, err := s.issueEmailToken(u, purposeVerifyEmail, "/verify-email", verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	return s.sendMail(mailer.Message{
+		To:      u.Email,
+		Subject: "Verify your gochat email address",
+		Text: fmt.Sprintf("Hi %s,\n\nConfirm this is your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in 48 hours. If you did not sign up for gochat, ignore this email.\n",
+			u.Username, link),
+	})
+}
+
+// ResendVerification mails the user a new verification link.
+func (s *Service) ResendVerification(userID gocql.UUID) error {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if u == nil || u.Email == "" {
+		return errors.New("user not found")
+	}
+	if u.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	return s.sendVerification(u)
+}
+
+func (s *Service) VerifyEmail(req VerifyEmailRequest) error {
+	u, err := s.consumeEmailToken(req.Token, purposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	return s.Repo.SetEmailVerified(u.ID, time.Now().UTC())
+}
+
+// RequestPasswordReset mails a reset link when the address belongs to a
+// user. It succeeds either way so it does not reveal which addresses do.
+func (s *Service) RequestPasswordReset(req PasswordResetRequest) error {
+	email := strings.TrimSpace(req.Email)
+	if !strings.Contains(email, "@") {
+		return errors.New("invalid email")
+	}
+	if s.Limiter != nil {
+		ok, _, err := s.Limiter.Allow(context.Background(), "reset:"+strings.ToLower(email), resetMailsPerHour, time.Hour)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	u, err := s.Repo.GetUserByEmailOrUsername(email)
+	if err != nil {
+		return err
+	}
+	if u == nil || u.IsBot {
+		return nil
+	}
+	link, err := s.issueEmailToken(u, purposeResetPassword, "/reset-password", resetPasswordTTL)
+	if err != nil {
+		return err
+	}
+	err = s.sendMail(mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your gochat password",
+		Text: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your gochat account. "+
+			"To choose a new one, open the link below:\n\n%s\n\n"+
+			"The link expires in one hour and works once. If it was not you, ignore this email; "+
+			"your password stays as it is.\n", u.Username, link),
+	})
+	if err != nil {
+		log.Printf("❌ password reset mail to user %s: %v", u.ID, err)
+	}
+	return nil
+}
+
+// ConfirmPasswordReset sets a new password and ends every session, so
+// whoever knew the old password is signed out.
+func (s *Service) ConfirmPasswordReset(req PasswordResetConfirmRequest) error {
+	if len(req.Password) < 6 {
+		return errors.New("password must be at least 6 characters")
+	}
+	u, err := s.consumeEmailToken(req.Token, purposeResetPassword)
+	if err != nil {
+		return err
+	}
+	hash, err := utils.HashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if err := s.Repo.UpdatePassword(u.ID, hash, now); err != nil {
+		return err
+	}
+	// Following the link proved the address is theirs.
+	if !u.EmailVerified {
+		if err := s.Repo.SetEmailVerified(u.ID, now); err != nil {
+			return err
+		}
+	}
+	return s.RevokeAllSessions(u.ID)
+}
+
+const emailTokenColumns = `token_hash, purpose, user_id, email, created_at, expires_at`
+
+func (r *Repository) InsertEmailToken(t *emailToken) error {
+	return r.Session.Query(`INSERT INTO email_tokens (`+emailTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?) USING TTL ?`,
+		t.hash, t.Purpose, t.UserID, t.Email, t.CreatedAt, t.ExpiresAt, ttlSeconds(t.ExpiresAt)).Exec()
+}
+
+func (r *Repository) GetEmailToken(hash string) (*emailToken, error) {
+	var t emailToken
+	err := r.Session.Query(`SELECT `+emailTokenColumns+` FROM email_tokens WHERE token_hash = ?`, hash).
+		Consistency(gocql.Quorum).
+		Scan(&t.hash, &t.Purpose, &t.UserID, &t.Email, &t.CreatedAt, &t.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteEmailToken claims a token; it reports false when it was already gone.
+func (r *Repository) DeleteEmailToken(hash string) (bool, error) {
+	return r.Session.Query(`DELETE FROM email_tokens WHERE token_hash = ? IF EXISTS`, hash).
+		MapScanCAS(map[string]interface{}{})
+}
@@ -2,7 +2,12 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"gochat/internal/utils"
 
@@ -44,14 +49,26 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	resp, err := h.Service.Login(req)
+	resp, err := h.Service.Login(req, ClientFromRequest(r, req.Device))
 	if err != nil {
-		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		loginError(w, err)
 		return
 	}
 	utils.JSONResponse(w, http.StatusOK, resp)
 }
 
+// loginError answers a failed sign-in: 429 with Retry-After while
+// throttled, else 401.
+func loginError(w http.ResponseWriter, err error) {
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int((throttled.RetryAfter+time.Second-1)/time.Second)))
+		utils.JSONResponse(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+}
+
 func (h *Handler) Profile(w http.ResponseWriter, r *http.Request) {
 	userID := GetUserID(r)
 	utils.JSONResponse(w, http.StatusOK, map[string]string{
@@ -64,28 +81,52 @@ func (h *Handler) RegisterRouter(r *mux.Router) {
 
 	r.HandleFunc("/signup", h.Signup).Methods("POST")
 	r.HandleFunc("/login", h.Login).Methods("POST")
+	r.HandleFunc("/login/mfa", h.LoginMFA).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", h.JWKS).Methods("GET")
+	r.HandleFunc("/verify-email", h.VerifyEmail).Methods("POST")
+	r.HandleFunc("/password-reset", h.RequestPasswordReset).Methods("POST")
+	r.HandleFunc("/password-reset/confirm", h.ConfirmPasswordReset).Methods("POST")
+	r.HandleFunc("/auth/oidc/providers", h.OIDCProviders).Methods("GET")
+	r.HandleFunc("/auth/oidc/{provider}/login", h.OIDCLogin).Methods("GET")
+	r.HandleFunc("/auth/oidc/{provider}/callback", h.OIDCCallback).Methods("GET")
+	// Authenticated by the refresh token itself, so it works once the access
+	// token has expired.
+	r.HandleFunc("/api/refresh", h.Refresh).Methods("POST")
 
 	protected := r.PathPrefix("/api").Subrouter()
 	protected.Use(AuthMiddleware)
 
 	protected.HandleFunc("/profile", h.Profile).Methods("GET")
 	protected.HandleFunc("/me", h.Me).Methods("GET")
+	protected.HandleFunc("/me/verify-email", h.ResendVerification).Methods("POST")
 	protected.HandleFunc("/logout", h.Logout).Methods("POST")
-	protected.HandleFunc("/refresh", h.Refresh).Methods("POST")
+
+	protected.HandleFunc("/me/tokens", h.CreateToken).Methods("POST")
+	protected.HandleFunc("/me/tokens", h.ListTokens).Methods("GET")
+	protected.HandleFunc("/me/tokens/{token_id}", h.RevokeToken).Methods("DELETE")
+	protected.HandleFunc("/me/bots", h.CreateBot).Methods("POST")
+	protected.HandleFunc("/me/bots", h.ListBots).Methods("GET")
+	protected.HandleFunc("/me/sessions", h.ListSessions).Methods("GET")
+	protected.HandleFunc("/me/sessions", h.RevokeAllSessions).Methods("DELETE")
+	protected.HandleFunc("/me/sessions/{session_id}", h.RevokeSession).Methods("DELETE")
+	protected.HandleFunc("/me/2fa", h.TwoFactor).Methods("GET")
+	protected.HandleFunc("/me/2fa", h.DisableTOTP).Methods("DELETE")
+	protected.HandleFunc("/me/2fa/enroll", h.EnrollTOTP).Methods("POST")
+	protected.HandleFunc("/me/2fa/confirm", h.ConfirmTOTP).Methods("POST")
+	protected.HandleFunc("/me/2fa/recovery-codes", h.RegenerateRecoveryCodes).Methods("POST")
+	protected.HandleFunc("/admin/auth-settings", h.Settings).Methods("GET")
+	protected.HandleFunc("/admin/auth-settings", h.UpdateSettings).Methods("PUT")
+	protected.HandleFunc("/admin/users/{user_id}/lockout", h.LockoutStatus).Methods("GET")
+	protected.HandleFunc("/admin/users/{user_id}/unlock", h.UnlockUser).Methods("POST")
 }
 
 func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
-	userID := GetUserID(r)
-	if userID == "" {
-		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
-		return
-	}
 	var req RefreshRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
 		return
 	}
-	resp, err := h.Service.Refresh(userID, req)
+	resp, err := h.Service.Refresh(req, ClientFromRequest(r, ""))
 	if err != nil {
 		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
 		return
@@ -129,4 +170,489 @@ func (h *Handler) Me(w http.ResponseWriter, r *http.Request) {
 	utils.JSONResponse(w, http.StatusOK, resp)
 }
 
+// sessionUser returns the caller when they signed in with a password; API
+// tokens cannot manage tokens or bots.
+func sessionUser(w http.ResponseWriter, r *http.Request) (gocql.UUID, bool) {
+	p := GetPrincipal(r)
+	if p == nil {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return gocql.UUID{}, false
+	}
+	if p.Scopes != nil {
+		utils.JSONResponse(w, http.StatusForbidden, map[string]string{"error": "forbidden: sign in to manage tokens"})
+		return gocql.UUID{}, false
+	}
+	uid, err := gocql.ParseUUID(p.UserID)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return gocql.UUID{}, false
+	}
+	return uid, true
+}
+
+func (h *Handler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	var req CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	t, err := h.Service.CreateToken(uid, req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.HasSuffix(err.Error(), "not found") {
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusCreated, t)
+}
+
+func (h *Handler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Service.ListTokens(uid)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+func (h *Handler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := gocql.ParseUUID(mux.Vars(r)["token_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid token id"})
+		return
+	}
+	if err := h.Service.RevokeToken(uid, id); err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrTokenNotFound {
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+func (h *Handler) CreateBot(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	var req CreateBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	bot, err := h.Service.CreateBot(uid, req)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusCreated, bot)
+}
+
+func (h *Handler) ListBots(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Service.ListBots(uid)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+// JWKS publishes the public keys session tokens can be verified with.
+func (h *Handler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.JSONResponse(w, http.StatusOK, utils.Keys.JWKS())
+}
+
+func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Service.ListSessions(uid, GetPrincipal(r).SessionID)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := gocql.ParseUUID(mux.Vars(r)["session_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid session id"})
+		return
+	}
+	if err := h.Service.RevokeSession(uid, id); err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrSessionNotFound {
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+// RevokeAllSessions logs the caller out everywhere, this session included.
+func (h *Handler) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Service.RevokeAllSessions(uid); err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "logged out everywhere"})
+}
+
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	if err := h.Service.VerifyEmail(req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "email verified"})
+}
+
+func (h *Handler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Service.ResendVerification(uid); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case err == ErrEmailAlreadyVerified:
+			status = http.StatusConflict
+		case strings.HasSuffix(err.Error(), "not found"):
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "verification email sent"})
+}
+
+func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	if err := h.Service.RequestPasswordReset(req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusAccepted, map[string]string{
+		"status": "if the address belongs to an account, a reset link is on its way",
+	})
+}
+
+func (h *Handler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	if err := h.Service.ConfirmPasswordReset(req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "password updated"})
+}
+
+func (h *Handler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	resp, err := h.Service.LoginMFA(req, ClientFromRequest(r, ""))
+	if err != nil {
+		loginError(w, err)
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, resp)
+}
+
+// mfaErrorStatus maps two-factor errors: a wrong code is 401, the rest as
+// usual.
+func mfaErrorStatus(err error) int {
+	switch {
+	case err == ErrInvalidMFACode:
+		return http.StatusUnauthorized
+	case strings.HasSuffix(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.HasPrefix(err.Error(), "forbidden"):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func (h *Handler) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	st, err := h.Service.TwoFactor(uid)
+	if err != nil {
+		utils.JSONResponse(w, mfaErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, st)
+}
+
+func (h *Handler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	enr, err := h.Service.EnrollTOTP(uid)
+	if err != nil {
+		utils.JSONResponse(w, mfaErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, enr)
+}
+
+// ConfirmTOTP enables 2FA. A client signed in with a setup-only token must
+// refresh afterwards to get a full one.
+func (h *Handler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	codes, err := h.Service.ConfirmTOTP(uid, req)
+	if err != nil {
+		utils.JSONResponse(w, mfaErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, codes)
+}
+
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	codes, err := h.Service.RegenerateRecoveryCodes(uid, req)
+	if err != nil {
+		utils.JSONResponse(w, mfaErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, codes)
+}
+
+func (h *Handler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	if err := h.Service.DisableTOTP(uid, req); err != nil {
+		utils.JSONResponse(w, mfaErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "two-factor authentication disabled"})
+}
+
+// adminUser returns the caller when they are a site admin signed in with
+// a password.
+func (h *Handler) adminUser(w http.ResponseWriter, r *http.Request) (gocql.UUID, bool) {
+	uid, ok := sessionUser(w, r)
+	if !ok {
+		return uid, false
+	}
+	admin, err := h.Service.IsAdmin(uid)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return uid, false
+	}
+	if !admin {
+		utils.JSONResponse(w, http.StatusForbidden, map[string]string{"error": "forbidden: admins only"})
+		return uid, false
+	}
+	return uid, true
+}
+
+func (h *Handler) Settings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.adminUser(w, r); !ok {
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, h.Service.Settings())
+}
+
+func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	uid, ok := h.adminUser(w, r)
+	if !ok {
+		return
+	}
+	var req AuthSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	settings, err := h.Service.UpdateSettings(uid, req)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, settings)
+}
+
+func (h *Handler) OIDCProviders(w http.ResponseWriter, r *http.Request) {
+	utils.JSONResponse(w, http.StatusOK, h.Service.OIDCProviders())
+}
+
+// OIDCLogin sends the browser to the provider. With ?response=json the
+// callback answers with JSON rather than redirecting to the web client,
+// which suits scripts and tests; they must keep the state cookie set here.
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, cookie, err := h.Service.StartOIDC(r.Context(), mux.Vars(r)["provider"], r.URL.Query().Get("response") == "json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrOIDCProviderNotFound {
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback finishes sign-in and hands the tokens to the web client in
+// the fragment of APP_URL/oidc/callback, so they stay out of server logs.
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	asJSON := h.Service.OIDCStateWantsJSON(r.Context(), state)
+
+	binding := ""
+	if c, err := r.Cookie(OIDCStateCookie); err == nil {
+		binding = c.Value
+	}
+	http.SetCookie(w, ClearOIDCCookie())
 
+	var resp *LoginResponse
+	var err error
+	if e := q.Get("error"); e != "" {
+		err = errors.New(strings.TrimSpace(e + " " + q.Get("error_description")))
+	} else {
+		resp, err = h.Service.FinishOIDC(r.Context(), mux.Vars(r)["provider"], state, binding, q.Get("code"), ClientFromRequest(r, ""))
+	}
+
+	if asJSON {
+		switch {
+		case err == ErrOIDCProviderNotFound:
+			utils.JSONResponse(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		case err == ErrOIDCLinkUnverified:
+			utils.JSONResponse(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		case err != nil:
+			utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		default:
+			utils.JSONResponse(w, http.StatusOK, resp)
+		}
+		return
+	}
+
+	frag := url.Values{}
+	if err != nil {
+		frag.Set("error", err.Error())
+	} else {
+		if resp.MFARequired {
+			frag.Set("mfa_required", "true")
+			frag.Set("mfa_token", resp.MFAToken)
+		} else {
+			frag.Set("token", resp.Token)
+			frag.Set("refresh_token", resp.RefreshToken)
+			frag.Set("expires_at", strconv.FormatInt(resp.ExpiresAt, 10))
+		}
+	}
+	http.Redirect(w, r, strings.TrimRight(h.Service.AppURL, "/")+"/oidc/callback#"+frag.Encode(), http.StatusFound)
+}
+
+func (h *Handler) LockoutStatus(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.adminUser(w, r); !ok {
+		return
+	}
+	uid, err := gocql.ParseUUID(mux.Vars(r)["user_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user_id"})
+		return
+	}
+	st, err := h.Service.LockoutStatus(uid)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if strings.HasSuffix(err.Error(), "not found") {
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, st)
+}
+
+func (h *Handler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.adminUser(w, r)
+	if !ok {
+		return
+	}
+	uid, err := gocql.ParseUUID(mux.Vars(r)["user_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user_id"})
+		return
+	}
+	if err := h.Service.UnlockUser(adminID, uid); err != nil {
+		status := http.StatusInternalServerError
+		if strings.HasSuffix(err.Error(), "not found") {
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "unlocked"})
+}
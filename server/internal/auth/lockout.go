@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+)
+
+// Failed sign-ins are counted in Redis per account and per client IP. After
+// a few failures each further attempt must wait, twice as long every time,
+// and enough failures lock the account or IP out for a while. Attempts are
+// counted before the password is checked, so parallel guesses cannot slip
+// past the limits. Unknown accounts are counted by the name tried, so they
+// throttle exactly like real ones and the responses reveal nothing about
+// which accounts exist. Failures against real accounts are also kept in
+// login_failures for audit.
+
+const (
+	loginFailPrefix  = "auth:login_fail:"
+	loginBlockPrefix = "auth:login_block:"
+
+	// Failures are forgotten this long after the last one.
+	loginFailureWindow = 15 * time.Minute
+	// Failures before each attempt is delayed, and the longest delay.
+	loginDelayAfter = 3
+	loginMaxDelay   = 30 * time.Second
+	// Failures that lock an account, or an IP trying many accounts, out.
+	accountLockoutAfter = 10
+	ipLockoutAfter      = 50
+	loginLockout        = 15 * time.Minute
+
+	loginFailureRetention = 90 * 24 * time.Hour
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// LoginThrottledError refuses an attempt made too soon after failures.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return "too many failed sign-in attempts; try again later"
+}
+
+type LoginFailure struct {
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Reason    string    `json:"reason"`
+}
+
+type LockoutStatus struct {
+	UserID      string         `json:"userId"`
+	Locked      bool           `json:"locked"`
+	RetryAfter  int64          `json:"retryAfterSeconds,omitempty"`
+	Failures    int64          `json:"failures"`
+	RecentFails []LoginFailure `json:"recentFailures"`
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// burnPasswordCheck spends as long as a real password check, so unknown
+// accounts are not told apart by response time.
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = utils.HashPassword("gochat-dummy-password")
+	})
+	utils.CheckPasswordHash(password, dummyHash)
+}
+
+// loginSubject is the account key counters use: the user id when the
+// account exists, else the name that was tried.
+func loginSubject(u *User, identifier string) string {
+	if u != nil {
+		return "user:" + u.ID.String()
+	}
+	return "name:" + strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// reserveLoginScript refuses an attempt while the account or IP is delayed
+// or locked out, and otherwise counts it as a failure up front, setting the
+// delay or lockout the count earns. Doing both in one step means a burst of
+// parallel attempts cannot all pass the check before any is counted; a
+// successful attempt takes its count back (loginSucceeded).
+//
+// KEYS: account failures, account block, then IP failures and IP block if
+// the IP is known. ARGV: failure window, failures before delays, longest
+// delay, account lockout, IP lockout and lockout length, times in ms.
+// Returns {wait ms, account failures, IP failures}.
+var reserveLoginScript = redis.NewScript(`
+local wait = redis.call('PTTL', KEYS[2])
+if KEYS[4] then
+	local t = redis.call('PTTL', KEYS[4])
+	if t > wait then wait = t end
+end
+if wait > 0 then
+	return {wait, 0, 0}
+end
+local n = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+local block = 0
+if n >= tonumber(ARGV[4]) then
+	block = tonumber(ARGV[6])
+elseif n >= tonumber(ARGV[2]) then
+	block = math.min(1000 * 2 ^ (n - tonumber(ARGV[2])), tonumber(ARGV[3]))
+end
+if block > 0 then
+	redis.call('SET', KEYS[2], n, 'PX', block)
+end
+local m = 0
+if KEYS[3] then
+	m = redis.call('INCR', KEYS[3])
+	redis.call('PEXPIRE', KEYS[3], ARGV[1])
+	if m >= tonumber(ARGV[5]) then
+		redis.call('SET', KEYS[4], m, 'PX', ARGV[6])
+	end
+end
+return {wait, n, m}
+`)
+
+// loginAttempt is a reserved attempt: the failure counts it brought the
+// account and IP to.
+type loginAttempt struct {
+	subject  string
+	ip       string
+	failures int64
+	ipFails  int64
+}
+
+// reserveLoginAttempt takes an attempt for the account and IP before the
+// credentials are checked, or refuses it while they are throttled.
+func (s *Service) reserveLoginAttempt(ctx context.Context, subject, ip string) (*loginAttempt, error) {
+	a := &loginAttempt{subject: subject, ip: ip}
+	if s.Redis == nil {
+		return a, nil
+	}
+	keys := []string{loginFailPrefix + subject, loginBlockPrefix + subject}
+	if ip != "" {
+		keys = append(keys, loginFailPrefix+"ip:"+ip, loginBlockPrefix+"ip:"+ip)
+	}
+	res, err := reserveLoginScript.Run(ctx, s.Redis, keys,
+		loginFailureWindow.Milliseconds(), loginDelayAfter, loginMaxDelay.Milliseconds(),
+		accountLockoutAfter, ipLockoutAfter, loginLockout.Milliseconds(),
+	).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if wait := time.Duration(res[0]) * time.Millisecond; wait > 0 {
+		return nil, &LoginThrottledError{RetryAfter: wait}
+	}
+	a.failures, a.ipFails = res[1], res[2]
+	return a, nil
+}
+
+// recordLoginFailure logs a failed attempt, and any lockout it started, and
+// writes the audit trail. The attempt was already counted when reserved.
+func (s *Service) recordLoginFailure(u *User, a *loginAttempt, client ClientInfo, reason string) {
+	who := a.subject
+	if u != nil {
+		who = fmt.Sprintf("user %s (%s)", u.ID, u.Username)
+	}
+	log.Printf("🔐 failed sign-in for %s from %s: %s", who, client.IP, reason)
+	if u != nil {
+		if err := s.Repo.InsertLoginFailure(u.ID, client, reason); err != nil {
+			log.Printf("❌ record login failure of user %s: %v", u.ID, err)
+		}
+	}
+	if a.failures == accountLockoutAfter {
+		log.Printf("🔒 %s locked out for %s after %d failed sign-ins", who, loginLockout, a.failures)
+	}
+	if a.ipFails == ipLockoutAfter {
+		log.Printf("🔒 IP %s locked out for %s after %d failed sign-ins", a.ip, loginLockout, a.ipFails)
+	}
+}
+
+// loginSucceeded forgets the account's failures after a sign-in and takes
+// back the IP's count for this attempt. The IP's earlier failures stay, so
+// one good account does not reset a spray from that address.
+func (s *Service) loginSucceeded(ctx context.Context, a *loginAttempt) {
+	if s.Redis == nil {
+		return
+	}
+	s.Redis.Del(ctx, loginFailPrefix+a.subject, loginBlockPrefix+a.subject)
+	s.releaseLoginIP(ctx, a)
+}
+
+// releaseLoginIP takes back the IP's count for the attempt.
+func (s *Service) releaseLoginIP(ctx context.Context, a *loginAttempt) {
+	if s.Redis == nil || a.ipFails == 0 {
+		return
+	}
+	s.Redis.Decr(ctx, loginFailPrefix+"ip:"+a.ip)
+}
+
+// LockoutStatus reports the user's failed sign-ins and whether they are
+// locked out.
+func (s *Service) LockoutStatus(userID gocql.UUID) (*LockoutStatus, error) {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errors.New("user not found")
+	}
+	st := &LockoutStatus{UserID: u.ID.String()}
+	if s.Redis != nil {
+		ctx := context.Background()
+		subject := loginSubject(u, "")
+		st.Failures, err = s.Redis.Get(ctx, loginFailPrefix+subject).Int64()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		ttl, err := s.Redis.PTTL(ctx, loginBlockPrefix+subject).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			st.Locked = true
+			st.RetryAfter = int64((ttl + time.Second - 1) / time.Second)
+		}
+	}
+	if st.RecentFails, err = s.Repo.ListLoginFailures(u.ID, 20); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// UnlockUser lifts the user's delay or lockout and forgets their failures.
+func (s *Service) UnlockUser(adminID, userID gocql.UUID) error {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return errors.New("user not found")
+	}
+	if s.Redis == nil {
+		return errors.New("lockout unavailable")
+	}
+	if err := s.Redis.Del(context.Background(), loginFailPrefix+loginSubject(u, ""), loginBlockPrefix+loginSubject(u, "")).Err(); err != nil {
+		return err
+	}
+	log.Printf("🔓 user %s (%s) unlocked by admin %s", u.ID, u.Username, adminID)
+	return nil
+}
+
+func (r *Repository) InsertLoginFailure(userID gocql.UUID, client ClientInfo, reason string) error {
+	return r.Session.Query(`INSERT INTO login_failures (user_id, failed_at, ip, user_agent, reason)
+	                        VALUES (?, ?, ?, ?, ?) USING TTL ?`,
+		userID, gocql.TimeUUID(), client.IP, client.UserAgent, reason, int(loginFailureRetention.Seconds())).Exec()
+}
+
+// ListLoginFailures returns the user's latest failed sign-ins, newest first.
+func (r *Repository) ListLoginFailures(userID gocql.UUID, limit int) ([]LoginFailure, error) {
+	iter := r.Session.Query(`SELECT failed_at, ip, user_agent, reason FROM login_failures WHERE user_id = ? LIMIT ?`,
+		userID, limit).Iter()
+	out := []LoginFailure{}
+	var (
+		at gocql.UUID
+		f  LoginFailure
+	)
+	for iter.Scan(&at, &f.IP, &f.UserAgent, &f.Reason) {
+		f.At = at.Time().UTC()
+		out = append(out, f)
+	}
+	return out, iter.Close()
+}
@@ -0,0 +1,508 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// Two-factor authentication uses TOTP (RFC 6238: SHA-1, 6 digits, 30 second
+// steps) with single-use recovery codes as the fallback. With it enabled,
+// Login checks the password and answers with a short-lived MFA challenge
+// token; /login/mfa trades that token and a code for the session.
+//
+// Admins can require 2FA for everyone. Users without it then still sign in,
+// but their access tokens carry the mfa_setup claim, which AuthMiddleware
+// only lets through to enrollment until they have confirmed a code.
+
+const (
+	RoleAdmin = "admin"
+
+	SettingRequire2FA = "require_2fa"
+
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes from one step before or after now are accepted for clock drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	mfaChallengeTTL      = 5 * time.Minute
+	mfaChallengeAttempts = 5
+	mfaChallengePrefix   = "auth:mfa_challenge:"
+	totpUsedPrefix       = "auth:totp_used:"
+
+	claimMFASetup = "mfa_setup"
+
+	// settingsTTL bounds how long a replica serves a stale setting.
+	settingsTTL = 30 * time.Second
+)
+
+var (
+	ErrInvalidMFACode = errors.New("invalid code")
+	ErrMFAChallenge   = errors.New("invalid or expired mfa_token")
+)
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is a current TOTP code or an unused recovery code.
+	Code string `json:"code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+type AuthSettings struct {
+	Require2FA bool `json:"require_2fa"`
+}
+
+type mfaChallenge struct {
+	UserID gocql.UUID `json:"user_id"`
+	Device string     `json:"device,omitempty"`
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000), nil
+}
+
+// matchTOTP returns the time step code is valid for around now.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	for c := step - totpSkew; c <= step+totpSkew; c++ {
+		want, err := totpCode(secret, c)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+// checkTOTP accepts a code for u's secret once; a replayed code fails.
+func (s *Service) checkTOTP(u *User, code string) error {
+	step, ok := matchTOTP(u.TOTPSecret, normalizeCode(code), time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	if s.Redis == nil {
+		return nil
+	}
+	key := fmt.Sprintf("%s%s:%d", totpUsedPrefix, u.ID, step)
+	fresh, err := s.Redis.SetNX(context.Background(), key, 1, (2*totpSkew+1)*totpPeriod*time.Second).Result()
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// checkSecondFactor accepts a TOTP code or, failing that, a recovery code.
+func (s *Service) checkSecondFactor(u *User, code string) error {
+	if len(normalizeCode(code)) == totpDigits {
+		return s.checkTOTP(u, code)
+	}
+	ok, err := s.Repo.ConsumeRecoveryCode(u.ID, hashAPIToken(normalizeCode(code)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// startMFAChallenge answers a correct password of a user with 2FA.
+func (s *Service) startMFAChallenge(u *User, client ClientInfo) (*LoginResponse, error) {
+	if s.Redis == nil {
+		return nil, errors.New("two-factor sign-in unavailable")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	data, err := json.Marshal(mfaChallenge{UserID: u.ID, Device: client.Device})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Redis.Set(context.Background(), mfaChallengePrefix+hashAPIToken(token), data, mfaChallengeTTL).Err(); err != nil {
+		return nil, err
+	}
+	return &LoginResponse{MFARequired: true, MFAToken: token}, nil
+}
+
+// LoginMFA completes a sign-in that Login answered with an MFA challenge.
+func (s *Service) LoginMFA(req MFALoginRequest, client ClientInfo) (*LoginResponse, error) {
+	if s.Redis == nil || req.MFAToken == "" {
+		return nil, ErrMFAChallenge
+	}
+	ctx := context.Background()
+	key := mfaChallengePrefix + hashAPIToken(req.MFAToken)
+	data, err := s.Redis.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ch mfaChallenge
+	if err := json.Unmarshal(data, &ch); err != nil {
+		return nil, ErrMFAChallenge
+	}
+	u, err := s.Repo.GetUserByID(ch.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || !u.TOTPEnabled {
+		return nil, ErrMFAChallenge
+	}
+	attempt, err := s.reserveLoginAttempt(ctx, loginSubject(u, ""), client.IP)
+	if err != nil {
+		return nil, err
+	}
+	// A challenge only takes a few guesses, counted before checking so
+	// parallel ones cannot exceed them.
+	n, err := s.Redis.Incr(ctx, key+":attempts").Result()
+	if err != nil {
+		return nil, err
+	}
+	if n == 1 {
+		s.Redis.Expire(ctx, key+":attempts", mfaChallengeTTL)
+	}
+	if n > mfaChallengeAttempts {
+		s.Redis.Del(ctx, key)
+		return nil, ErrMFAChallenge
+	}
+
+	if err := s.checkSecondFactor(u, req.Code); err != nil {
+		if err != ErrInvalidMFACode {
+			return nil, err
+		}
+		s.recordLoginFailure(u, attempt, client, "wrong 2fa code")
+		if n >= mfaChallengeAttempts {
+			s.Redis.Del(ctx, key)
+		}
+		return nil, err
+	}
+	if n, err := s.Redis.Del(ctx, key).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		// Redeemed by a concurrent request.
+		return nil, ErrMFAChallenge
+	}
+	s.loginSucceeded(ctx, attempt)
+	if client.Device == "" {
+		client.Device = ch.Device
+	}
+	return s.issueTokens(u.ID, client)
+}
+
+// TwoFactor reports the user's 2FA state.
+func (s *Service) TwoFactor(userID gocql.UUID) (*TwoFactorStatus, error) {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errors.New("user not found")
+	}
+	st := &TwoFactorStatus{Enabled: u.TOTPEnabled, Required: s.require2FA()}
+	if u.TOTPEnabled {
+		if st.RecoveryCodesLeft, err = s.Repo.CountRecoveryCodes(userID); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// EnrollTOTP starts enrollment with a new secret. It takes effect once
+// ConfirmTOTP sees a code for it.
+func (s *Service) EnrollTOTP(userID gocql.UUID) (*TOTPEnrollment, error) {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errors.New("user not found")
+	}
+	if u.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.SetTOTP(userID, secret, false); err != nil {
+		return nil, err
+	}
+	issuer := utils.GetEnv("TOTP_ISSUER", "gochat")
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	uri := "otpauth://totp/" + url.PathEscape(issuer+":"+u.Username) + "?" + q.Encode()
+	return &TOTPEnrollment{Secret: secret, URI: uri}, nil
+}
+
+// ConfirmTOTP enables 2FA when code matches the enrolled secret and returns
+// the recovery codes, which are shown only this once.
+func (s *Service) ConfirmTOTP(userID gocql.UUID, req TOTPCodeRequest) (*RecoveryCodes, error) {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errors.New("user not found")
+	}
+	if u.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	if u.TOTPSecret == "" {
+		return nil, errors.New("enroll first")
+	}
+	if err := s.checkTOTP(u, req.Code); err != nil {
+		return nil, err
+	}
+	codes, err := s.newRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.SetTOTP(userID, u.TOTPSecret, true); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes.
+func (s *Service) RegenerateRecoveryCodes(userID gocql.UUID, req TOTPCodeRequest) (*RecoveryCodes, error) {
+	u, err := s.enabledUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkTOTP(u, req.Code); err != nil {
+		return nil, err
+	}
+	return s.newRecoveryCodes(userID)
+}
+
+// DisableTOTP turns 2FA off after one more code. It is refused while an
+// admin requires 2FA.
+func (s *Service) DisableTOTP(userID gocql.UUID, req TOTPCodeRequest) error {
+	if s.require2FA() {
+		return errors.New("forbidden: two-factor authentication is required")
+	}
+	u, err := s.enabledUser(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkSecondFactor(u, req.Code); err != nil {
+		return err
+	}
+	if err := s.Repo.SetTOTP(userID, "", false); err != nil {
+		return err
+	}
+	return s.Repo.ReplaceRecoveryCodes(userID, nil, time.Now().UTC())
+}
+
+func (s *Service) enabledUser(userID gocql.UUID) (*User, error) {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errors.New("user not found")
+	}
+	if !u.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+	return u, nil
+}
+
+func (s *Service) newRecoveryCodes(userID gocql.UUID) (*RecoveryCodes, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+		hashes[i] = hashAPIToken(h)
+	}
+	if err := s.Repo.ReplaceRecoveryCodes(userID, hashes, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return &RecoveryCodes{Codes: codes}, nil
+}
+
+// accessClaims are the extra claims of an access token for userID.
+func (s *Service) accessClaims(userID, sessionID gocql.UUID) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{"sid": sessionID.String()}
+	if !s.require2FA() {
+		return claims, nil
+	}
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil && !u.TOTPEnabled && !u.IsBot {
+		claims[claimMFASetup] = true
+	}
+	return claims, nil
+}
+
+// mfaSetupAllowed lists what a user who must still enroll in 2FA may call.
+func mfaSetupAllowed(path string) bool {
+	switch path {
+	case "/api/me", "/api/logout":
+		return true
+	}
+	return strings.HasPrefix(path, "/api/me/2fa")
+}
+
+// require2FA reports the require_2fa setting, cached for settingsTTL.
+func (s *Service) require2FA() bool {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	if time.Since(s.settingsAt) < settingsTTL {
+		return s.settings.Require2FA
+	}
+	v, err := s.Repo.GetSetting(SettingRequire2FA)
+	if err != nil {
+		// Keep the last known value until Scylla answers again.
+		return s.settings.Require2FA
+	}
+	s.settings.Require2FA = v == "true"
+	s.settingsAt = time.Now()
+	return s.settings.Require2FA
+}
+
+func (s *Service) Settings() *AuthSettings {
+	return &AuthSettings{Require2FA: s.require2FA()}
+}
+
+func (s *Service) UpdateSettings(adminID gocql.UUID, req AuthSettings) (*AuthSettings, error) {
+	if err := s.Repo.PutSetting(SettingRequire2FA, fmt.Sprint(req.Require2FA), adminID, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	s.settingsMu.Lock()
+	s.settings, s.settingsAt = req, time.Now()
+	s.settingsMu.Unlock()
+	return &req, nil
+}
+
+// IsAdmin reports whether the user has the site-wide admin role.
+func (s *Service) IsAdmin(userID gocql.UUID) (bool, error) {
+	u, err := s.Repo.GetUserByID(userID)
+	if err != nil {
+		return false, err
+	}
+	return u != nil && u.Role == RoleAdmin, nil
+}
+
+func (r *Repository) SetTOTP(userID gocql.UUID, secret string, enabled bool) error {
+	return r.Session.Query(`UPDATE users SET totp_secret = ?, totp_enabled = ?, updated_at = ? WHERE id = ?`,
+		secret, enabled, time.Now().UTC(), userID).Exec()
+}
+
+// ReplaceRecoveryCodes drops the user's recovery codes for hashes.
+func (r *Repository) ReplaceRecoveryCodes(userID gocql.UUID, hashes []string, at time.Time) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`DELETE FROM mfa_recovery_codes WHERE user_id = ?`, userID)
+	for _, h := range hashes {
+		b.Query(`INSERT INTO mfa_recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)`, userID, h, at)
+	}
+	return r.Session.ExecuteBatch(b)
+}
+
+// ConsumeRecoveryCode deletes a code; it reports false when there was none.
+func (r *Repository) ConsumeRecoveryCode(userID gocql.UUID, hash string) (bool, error) {
+	return r.Session.Query(`DELETE FROM mfa_recovery_codes WHERE user_id = ? AND code_hash = ? IF EXISTS`,
+		userID, hash).MapScanCAS(map[string]interface{}{})
+}
+
+func (r *Repository) CountRecoveryCodes(userID gocql.UUID) (int, error) {
+	var n int
+	err := r.Session.Query(`SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = ?`, userID).Scan(&n)
+	return n, err
+}
+
+func (r *Repository) GetSetting(name string) (string, error) {
+	var v string
+	err := r.Session.Query(`SELECT value FROM auth_settings WHERE name = ?`, name).Scan(&v)
+	if err == gocql.ErrNotFound {
+		return "", nil
+	}
+	return v, err
+}
+
+func (r *Repository) PutSetting(name, value string, by gocql.UUID, at time.Time) error {
+	return r.Session.Query(`INSERT INTO auth_settings (name, value, updated_by, updated_at) VALUES (?, ?, ?, ?)`,
+		name, value, by, at).Exec()
+}
@@ -2,18 +2,107 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"gochat/internal/utils"
 	"net/http"
 	"strings"
+
+	"github.com/gorilla/mux"
 )
 
 type contextKey string
 
 const (
-	UserIDKey contextKey = "userID"
-	RoleKey   contextKey = "role"
+	UserIDKey    contextKey = "userID"
+	RoleKey      contextKey = "role"
+	PrincipalKey contextKey = "principal"
 )
 
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID string
+	Role   string
+	Bot    bool
+	// TokenID and Scopes are set for API tokens; a nil Scopes is a user
+	// session with full access.
+	TokenID string
+	Scopes  []string
+	// SessionID is the session a JWT was issued to.
+	SessionID string
+	// MFASetupRequired limits the principal to enrolling in two-factor
+	// authentication, which an admin requires.
+	MFASetupRequired bool
+}
+
+// Can reports whether the principal may act within scope.
+func (p *Principal) Can(scope string) bool {
+	return ScopesAllow(p.Scopes, scope)
+}
+
+// ScopesAllow reports whether a caller with scopes may act within scope; nil
+// scopes are a user session with full access.
+func ScopesAllow(scopes []string, scope string) bool {
+	if scopes == nil {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate turns a bearer token into a principal. It accepts session
+// JWTs until main installs the auth service's, which also knows API tokens.
+var Authenticate = func(token string) (*Principal, error) {
+	return principalFromJWT(token)
+}
+
+func principalFromJWT(tokenStr string) (*Principal, error) {
+	claims, err := utils.ValidateJWT(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	userID, _ := claims["user_id"].(string)
+	if userID == "" {
+		return nil, errors.New("user_id missing in token")
+	}
+	role, _ := claims["role"].(string)
+	sid, _ := claims["sid"].(string)
+	setup, _ := claims[claimMFASetup].(bool)
+	return &Principal{UserID: userID, Role: role, SessionID: sid, MFASetupRequired: setup}, nil
+}
+
+// scopedHandler is a route handler registered with the API token scope it
+// needs.
+type scopedHandler struct {
+	scope string
+	http.Handler
+}
+
+// Scoped declares, where a route is registered, that API tokens need scope
+// to call it.
+func Scoped(scope string, h http.HandlerFunc) http.Handler {
+	return scopedHandler{scope: scope, Handler: h}
+}
+
+// requiredScope is the API token scope a request needs: the one its route
+// was registered with, else read:messages for reads and manage:rooms for
+// every write.
+func requiredScope(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if h, ok := route.GetHandler().(scopedHandler); ok {
+			return h.scope
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ScopeReadMessages
+	}
+	return ScopeManageRooms
+}
+
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -30,17 +119,23 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 		tokenStr := parts[1]
 
-		claims, err := utils.ValidateJWT(tokenStr)
+		p, err := Authenticate(tokenStr)
 		if err != nil {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
+		if scope := requiredScope(r); !p.Can(scope) {
+			http.Error(w, "Token lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+		if p.MFASetupRequired && !mfaSetupAllowed(r.URL.Path) {
+			http.Error(w, "Two-factor authentication required; enroll at /api/me/2fa", http.StatusForbidden)
+			return
+		}
 
-		userID, _ := claims["user_id"].(string)
-		role, _ := claims["role"].(string)
-
-		ctx := context.WithValue(r.Context(), UserIDKey, userID)
-		ctx = context.WithValue(ctx, RoleKey, role)
+		ctx := context.WithValue(r.Context(), UserIDKey, p.UserID)
+		ctx = context.WithValue(ctx, RoleKey, p.Role)
+		ctx = context.WithValue(ctx, PrincipalKey, p)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -52,3 +147,9 @@ func GetUserID(r *http.Request) string {
 	}
 	return ""
 }
+
+// GetPrincipal returns the caller, or nil outside AuthMiddleware.
+func GetPrincipal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(PrincipalKey).(*Principal)
+	return p
+}
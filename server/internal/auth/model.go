@@ -7,12 +7,19 @@ import (
 )
 
 type User struct {
-	ID        gocql.UUID `json:"id" db:"id"`
-	Username  string     `json:"username" db:"username"`
-	Email     string     `json:"email" db:"email"`
-	Password  string     `json:"-" db:"password"`
-	CreatedAt time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+	ID        gocql.UUID  `json:"id" db:"id"`
+	Username  string      `json:"username" db:"username"`
+	Email     string      `json:"email" db:"email"`
+	Password  string      `json:"-" db:"password"`
+	CreatedAt time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at" db:"updated_at"`
+	IsBot     bool        `json:"is_bot" db:"is_bot"`
+	BotOwner  *gocql.UUID `json:"bot_owner,omitempty" db:"bot_owner"`
+	// EmailVerified is set once the user followed the link mailed to them.
+	EmailVerified bool   `json:"email_verified" db:"email_verified"`
+	Role          string `json:"role,omitempty" db:"role"`
+	TOTPSecret    string `json:"-" db:"totp_secret"`
+	TOTPEnabled   bool   `json:"totp_enabled" db:"totp_enabled"`
 }
 
 type SignupRequest struct {
@@ -30,18 +37,16 @@ type SignupResponse struct {
 type LoginRequest struct {
 	EmailOrUsername string `json:"email_or_username" validate:"required"`
 	Password        string `json:"password" validate:"required"`
+	// Device optionally names the client in the session list.
+	Device string `json:"device,omitempty"`
 }
 
+// LoginResponse carries a session, or for users with two-factor
+// authentication only MFAToken, to be completed at /login/mfa.
 type LoginResponse struct {
-	Token        string `json:"token"`
-	RefreshToken string `json:"refresh_token"`
-	ExpiresAt    int64  `json:"expires_at"`
-}
-
-type RefreshToken struct {
-	RefreshID gocql.UUID `db:"refresh_id"`
-	UserID    gocql.UUID `db:"user_id"`
-	Token     string     `db:"refresh_token"`
-	ExpiresAt time.Time  `db:"expires_at"`
-	CreatedAt time.Time  `db:"created_at"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresAt    int64  `json:"expires_at,omitempty"`
+	MFARequired  bool   `json:"mfa_required,omitempty"`
+	MFAToken     string `json:"mfa_token,omitempty"`
 }
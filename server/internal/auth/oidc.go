@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+)
+
+// Single sign-on with OpenID Connect providers, using the authorization code
+// flow with PKCE. The browser starts at /auth/oidc/{provider}/login; state,
+// nonce and the PKCE verifier wait in Redis until the provider redirects it
+// back to the callback, which ends in an ordinary gochat session. The
+// browser that started also gets a cookie holding a hash of state, and the
+// callback only proceeds with it, so an attacker cannot complete their own
+// sign-in in a victim's browser (login CSRF).
+//
+// The provider's user is found by (provider, sub). Failing that, a verified
+// email links it to the gochat user with that address, provided that user
+// verified it too; otherwise a user is provisioned on the spot.
+
+const (
+	oidcStatePrefix = "auth:oidc_state:"
+	oidcStateTTL    = 10 * time.Minute
+
+	OIDCStateCookie = "gochat_oidc"
+	oidcCookiePath  = "/auth/oidc/"
+)
+
+var (
+	ErrOIDCProviderNotFound = errors.New("provider not found")
+	ErrOIDCState            = errors.New("sign-in expired or was already completed; start again")
+	ErrOIDCBrowser          = errors.New("sign-in was started in another browser; start again")
+	ErrOIDCLinkUnverified   = errors.New("an account with this email exists but its address is not verified; " +
+		"sign in with your password and verify it first")
+
+	oidcUsernameStrip = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+type OIDCProviderInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type oidcState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// JSON asks the callback to answer with JSON instead of redirecting to
+	// the web client.
+	JSON bool `json:"json,omitempty"`
+}
+
+type Identity struct {
+	Provider  string
+	Subject   string
+	UserID    gocql.UUID
+	Email     string
+	CreatedAt time.Time
+}
+
+func randomURLToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OIDCProviders lists the providers users can sign in with.
+func (s *Service) OIDCProviders() []OIDCProviderInfo {
+	out := []OIDCProviderInfo{}
+	for _, p := range s.OIDC {
+		out = append(out, OIDCProviderInfo{ID: p.ID, Name: p.Name})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// StartOIDC returns the provider URL that begins sign-in and the cookie
+// binding it to the browser.
+func (s *Service) StartOIDC(ctx context.Context, providerID string, jsonResponse bool) (string, *http.Cookie, error) {
+	p, ok := s.OIDC[providerID]
+	if !ok {
+		return "", nil, ErrOIDCProviderNotFound
+	}
+	if s.Redis == nil {
+		return "", nil, errors.New("single sign-on unavailable")
+	}
+	state, err := randomURLToken(24)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomURLToken(24)
+	if err != nil {
+		return "", nil, err
+	}
+	verifier, err := randomURLToken(48)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	authURL, err := p.AuthURL(ctx, state, nonce, base64.RawURLEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(oidcState{Provider: p.ID, Nonce: nonce, Verifier: verifier, JSON: jsonResponse})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.Redis.Set(ctx, oidcStatePrefix+state, data, oidcStateTTL).Err(); err != nil {
+		return "", nil, err
+	}
+	cookie := &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    oidcBinding(state),
+		Path:     oidcCookiePath,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		// Lax still sends it on the provider's top-level redirect back.
+		SameSite: http.SameSiteLaxMode,
+		Secure:   strings.HasPrefix(p.RedirectURL, "https://"),
+	}
+	return authURL, cookie, nil
+}
+
+// ClearOIDCCookie expires the state cookie once the callback has run.
+func ClearOIDCCookie() *http.Cookie {
+	return &http.Cookie{Name: OIDCStateCookie, Path: oidcCookiePath, MaxAge: -1, HttpOnly: true,
+		SameSite: http.SameSiteLaxMode}
+}
+
+// oidcBinding is the cookie value tying state to the browser.
+func oidcBinding(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// OIDCStateWantsJSON reports whether the sign-in behind state asked for a
+// JSON answer. It does not consume the state.
+func (s *Service) OIDCStateWantsJSON(ctx context.Context, state string) bool {
+	if s.Redis == nil || state == "" {
+		return false
+	}
+	data, err := s.Redis.Get(ctx, oidcStatePrefix+state).Bytes()
+	if err != nil {
+		return false
+	}
+	var st oidcState
+	return json.Unmarshal(data, &st) == nil && st.JSON
+}
+
+// FinishOIDC completes sign-in when the provider redirects back with code.
+// binding is the state cookie the browser sent.
+func (s *Service) FinishOIDC(ctx context.Context, providerID, state, binding, code string, client ClientInfo) (*LoginResponse, error) {
+	p, ok := s.OIDC[providerID]
+	if !ok {
+		return nil, ErrOIDCProviderNotFound
+	}
+	if s.Redis == nil || state == "" || code == "" {
+		return nil, ErrOIDCState
+	}
+	// Checked before the state is consumed, so a forged callback cannot
+	// spend the victim's own sign-in either.
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(oidcBinding(state))) != 1 {
+		return nil, ErrOIDCBrowser
+	}
+	// GETDEL makes the state single use.
+	data, err := s.Redis.GetDel(ctx, oidcStatePrefix+state).Bytes()
+	if err == redis.Nil {
+		return nil, ErrOIDCState
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st oidcState
+	if err := json.Unmarshal(data, &st); err != nil || st.Provider != p.ID {
+		return nil, ErrOIDCState
+	}
+	claims, err := p.Exchange(ctx, code, st.Verifier, st.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.oidcUser(p, claims)
+	if err != nil {
+		return nil, err
+	}
+	if client.Device == "" {
+		client.Device = deviceFromUserAgent(client.UserAgent) + " via " + p.Name
+	}
+	if u.TOTPEnabled {
+		return s.startMFAChallenge(u, client)
+	}
+	return s.issueTokens(u.ID, client)
+}
+
+// oidcUser finds, links or provisions the gochat user for the claims.
+func (s *Service) oidcUser(p *OIDCProvider, c *oidcClaims) (*User, error) {
+	id, err := s.Repo.GetIdentity(p.ID, c.Subject)
+	if err != nil && err != gocql.ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		u, err := s.Repo.GetUserByID(id.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return u, nil
+		}
+		// The user is gone; link or provision afresh.
+	}
+
+	email := ""
+	if c.emailVerified() {
+		email = strings.TrimSpace(c.Email)
+	}
+	if email != "" {
+		u, err := s.Repo.GetUserByEmailOrUsername(email)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			if u.IsBot {
+				return nil, ErrInvalidCredentials
+			}
+			if !u.EmailVerified {
+				return nil, ErrOIDCLinkUnverified
+			}
+			if err := s.Repo.InsertIdentity(&Identity{
+				Provider: p.ID, Subject: c.Subject, UserID: u.ID, Email: email, CreatedAt: time.Now().UTC(),
+			}); err != nil {
+				return nil, err
+			}
+			return u, nil
+		}
+	}
+	return s.provisionOIDCUser(p, c, email)
+}
+
+// provisionOIDCUser creates a password-less user for a first sign-in. The
+// username comes from the provider's profile, made unique when taken.
+func (s *Service) provisionOIDCUser(p *OIDCProvider, c *oidcClaims, email string) (*User, error) {
+	now := time.Now().UTC()
+	u := &User{
+		ID:            gocql.TimeUUID(),
+		Email:         email,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		EmailVerified: email != "",
+	}
+	for _, name := range oidcUsernames(c) {
+		ok, err := s.Repo.ReserveUsername(name, u.ID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			u.Username = name
+			break
+		}
+	}
+	if u.Username == "" {
+		return nil, errors.New("could not pick a username")
+	}
+	if email != "" {
+		if ok, err := s.Repo.ReserveEmail(email, u.ID); err != nil || !ok {
+			_ = s.Repo.ReleaseUsername(u.Username)
+			if err == nil {
+				err = errors.New("email already registered")
+			}
+			return nil, err
+		}
+	}
+	if err := s.Repo.InsertUser(u); err != nil {
+		_ = s.Repo.ReleaseUsername(u.Username)
+		if email != "" {
+			_ = s.Repo.ReleaseEmail(email)
+		}
+		return nil, err
+	}
+	if err := s.Repo.InsertIdentity(&Identity{
+		Provider: p.ID, Subject: c.Subject, UserID: u.ID, Email: email, CreatedAt: now,
+	}); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// oidcUsernames proposes usernames for new users, best first: the profile's
+// names, then the first of them with random suffixes.
+func oidcUsernames(c *oidcClaims) []string {
+	var out []string
+	seen := map[string]bool{}
+	local, _, _ := strings.Cut(c.Email, "@")
+	for _, cand := range []string{c.PreferredUsername, local, strings.ReplaceAll(c.Name, " ", ".")} {
+		cand, _, _ = strings.Cut(cand, "@")
+		cand = strings.Trim(oidcUsernameStrip.ReplaceAllString(cand, ""), ".-")
+		if len(cand) > 24 {
+			cand = cand[:24]
+		}
+		if len(cand) >= 3 && !seen[strings.ToLower(cand)] {
+			seen[strings.ToLower(cand)] = true
+			out = append(out, cand)
+		}
+	}
+	if len(out) == 0 {
+		out = []string{"user"}
+	}
+	base := out[0]
+	for i := 0; i < 5; i++ {
+		b := make([]byte, 2)
+		if _, err := rand.Read(b); err != nil {
+			break
+		}
+		out = append(out, base+"_"+hex.EncodeToString(b))
+	}
+	return out
+}
+
+func (r *Repository) GetIdentity(provider, subject string) (*Identity, error) {
+	id := Identity{Provider: provider, Subject: subject}
+	err := r.Session.Query(`SELECT user_id, email, created_at FROM user_identities WHERE provider = ? AND subject = ?`,
+		provider, subject).Consistency(gocql.Quorum).Scan(&id.UserID, &id.Email, &id.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func (r *Repository) InsertIdentity(id *Identity) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)`,
+		id.Provider, id.Subject, id.UserID, id.Email, id.CreatedAt)
+	b.Query(`INSERT INTO user_identities_by_user (user_id, provider, subject) VALUES (?, ?, ?)`,
+		id.UserID, id.Provider, id.Subject)
+	return r.Session.ExecuteBatch(b)
+}
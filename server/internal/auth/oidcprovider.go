@@ -0,0 +1,339 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gochat/internal/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDC providers are configured with:
+//
+//	OIDC_PROVIDERS                comma-separated provider ids, e.g. "corp"
+//	OIDC_<ID>_ISSUER              issuer URL; endpoints come from its discovery document
+//	OIDC_<ID>_CLIENT_ID           client registered at the provider
+//	OIDC_<ID>_CLIENT_SECRET       its secret; empty for public clients
+//	OIDC_<ID>_NAME                label for login buttons (default the id)
+//	OIDC_<ID>_SCOPES              default "openid email profile"
+//	OIDC_<ID>_REDIRECT_URL        default PUBLIC_URL + /auth/oidc/<id>/callback
+//	PUBLIC_URL                    this server's base URL (default http://localhost:8080)
+
+const (
+	discoveryTTL = time.Hour
+	// An unknown kid refetches the provider's keys at most this often.
+	jwksRefetchInterval = time.Minute
+)
+
+type OIDCProvider struct {
+	ID           string
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+
+	http *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	metaAt      time.Time
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the ID token claims sign-in uses.
+type oidcClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     any    `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+// emailVerified reads email_verified, which some providers send as a string.
+func (c *oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// OIDCProvidersFromEnv reads the configured providers.
+func OIDCProvidersFromEnv() (map[string]*OIDCProvider, error) {
+	out := map[string]*OIDCProvider{}
+	publicURL := strings.TrimRight(utils.GetEnv("PUBLIC_URL", "http://localhost:8080"), "/")
+	for _, id := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id == "" {
+			continue
+		}
+		env := func(key, fallback string) string {
+			return utils.GetEnv("OIDC_"+strings.ToUpper(id)+"_"+key, fallback)
+		}
+		p := &OIDCProvider{
+			ID:           id,
+			Name:         env("NAME", id),
+			Issuer:       strings.TrimRight(env("ISSUER", ""), "/"),
+			ClientID:     env("CLIENT_ID", ""),
+			ClientSecret: env("CLIENT_SECRET", ""),
+			Scopes:       strings.Fields(env("SCOPES", "openid email profile")),
+			RedirectURL:  env("REDIRECT_URL", publicURL+"/auth/oidc/"+id+"/callback"),
+			http:         &http.Client{Timeout: 10 * time.Second},
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			return nil, fmt.Errorf("oidc provider %s: ISSUER and CLIENT_ID are required", id)
+		}
+		out[id] = p
+	}
+	return out, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// metadata returns the provider's discovery document, cached for discoveryTTL.
+func (p *OIDCProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && time.Since(p.metaAt) < discoveryTTL {
+		return p.meta, nil
+	}
+	var m oidcMetadata
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(m.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc provider %s: discovery issuer %q does not match", p.ID, m.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc provider %s: incomplete discovery document", p.ID)
+	}
+	p.meta, p.metaAt = &m, time.Now()
+	return p.meta, nil
+}
+
+// AuthURL is where the browser is sent to sign in.
+func (p *OIDCProvider) AuthURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token
+// claims.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (*oidcClaims, error) {
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		if body.Error != "" {
+			return nil, fmt.Errorf("token endpoint: %s %s", body.Error, body.ErrorDescription)
+		}
+		return nil, fmt.Errorf("token endpoint: %s without id_token", resp.Status)
+	}
+	return p.verifyIDToken(ctx, body.IDToken, nonce)
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*oidcClaims, error) {
+	var claims oidcClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "PS256"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("id token: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token: missing sub")
+	}
+	return &claims, nil
+}
+
+// key returns the provider's signing key kid, refetching its JWKS when the
+// kid is new, since providers rotate keys.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (any, error) {
+	p.mu.Lock()
+	k, ok := p.keys[kid]
+	stale := time.Since(p.keysFetched) > jwksRefetchInterval
+	p.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale && p.keys != nil {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, m.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]any{}
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		if pub, err := j.publicKey(); err == nil {
+			keys[j.Kid] = pub
+		}
+	}
+	p.mu.Lock()
+	p.keys, p.keysFetched = keys, time.Now()
+	p.mu.Unlock()
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	// Providers with a single key may leave kid out.
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j *jwk) publicKey() (any, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch j.Kty {
+	case "RSA":
+		n, err := dec(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+		x, err := dec(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", j.Kty)
+}
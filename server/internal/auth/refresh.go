@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Refresh tokens are opaque and single use. Each one belongs to a family,
+// started by a sign-in; redeeming it issues the family's next token. Only the
+// family's current token is redeemable, so a token presented twice means it
+// leaked and the whole family is revoked. The token embeds its id like API
+// tokens do: "gcr_" + hex(refresh id) + hex(secret).
+
+const (
+	RefreshTokenPrefix = "gcr_"
+
+	// A refresh token not redeemed within refreshTokenTTL lapses; a family
+	// ends refreshFamilyTTL after sign-in however often it is refreshed.
+	refreshTokenTTL  = 7 * 24 * time.Hour
+	refreshFamilyTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused; session revoked")
+)
+
+type RefreshToken struct {
+	RefreshID gocql.UUID
+	FamilyID  gocql.UUID
+	UserID    gocql.UUID
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	// Token is only set when the token is issued.
+	Token string
+
+	tokenHash string
+}
+
+type RefreshFamily struct {
+	FamilyID   gocql.UUID
+	UserID     gocql.UUID
+	CurrentID  *gocql.UUID
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+	Device     string
+	IP         string
+	UserAgent  string
+}
+
+func newRefreshToken(familyID, userID gocql.UUID, now time.Time) (*RefreshToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	rt := &RefreshToken{
+		RefreshID: gocql.TimeUUID(),
+		FamilyID:  familyID,
+		UserID:    userID,
+		ExpiresAt: now.Add(refreshTokenTTL),
+		CreatedAt: now,
+	}
+	rt.Token = RefreshTokenPrefix + hex.EncodeToString(rt.RefreshID.Bytes()) + hex.EncodeToString(secret)
+	rt.tokenHash = hashAPIToken(rt.Token)
+	return rt, nil
+}
+
+func parseRefreshToken(raw string) (gocql.UUID, bool) {
+	if !strings.HasPrefix(raw, RefreshTokenPrefix) {
+		return gocql.UUID{}, false
+	}
+	rest := strings.TrimPrefix(raw, RefreshTokenPrefix)
+	if len(rest) < 32 {
+		return gocql.UUID{}, false
+	}
+	b, err := hex.DecodeString(rest[:32])
+	if err != nil {
+		return gocql.UUID{}, false
+	}
+	id, err := gocql.UUIDFromBytes(b)
+	return id, err == nil
+}
+
+// startFamily signs userID in from client: it opens a family and returns its
+// first token.
+func (s *Service) startFamily(userID gocql.UUID, client ClientInfo) (*RefreshToken, error) {
+	now := time.Now().UTC()
+	f := &RefreshFamily{
+		FamilyID:   gocql.TimeUUID(),
+		UserID:     userID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(refreshFamilyTTL),
+		Device:     client.device(),
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+	}
+	rt, err := newRefreshToken(f.FamilyID, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	f.CurrentID = &rt.RefreshID
+	if err := s.Repo.InsertRefreshFamily(f, rt); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// lookupRefreshToken returns the stored token raw stands for and its family,
+// whether or not it may still be redeemed.
+func (s *Service) lookupRefreshToken(raw string) (*RefreshToken, *RefreshFamily, error) {
+	id, ok := parseRefreshToken(raw)
+	if !ok {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	rt, err := s.Repo.GetRefreshToken(id)
+	if err == gocql.ErrNotFound {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIToken(raw)), []byte(rt.tokenHash)) != 1 {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	f, err := s.Repo.GetRefreshFamily(rt.FamilyID)
+	if err == gocql.ErrNotFound {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return rt, f, nil
+}
+
+// redeemRefreshToken checks raw and returns it with its live family.
+func (s *Service) redeemRefreshToken(raw string) (*RefreshToken, *RefreshFamily, error) {
+	rt, f, err := s.lookupRefreshToken(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().UTC()
+	if now.After(rt.ExpiresAt) {
+		return nil, nil, errors.New("refresh token expired")
+	}
+	if f.RevokedAt != nil {
+		return nil, nil, errors.New("session revoked")
+	}
+	if now.After(f.ExpiresAt) {
+		return nil, nil, errors.New("session expired")
+	}
+	if f.CurrentID == nil || *f.CurrentID != rt.RefreshID {
+		s.revokeReusedFamily(f)
+		return nil, nil, ErrRefreshTokenReused
+	}
+	return rt, f, nil
+}
+
+// rotateRefreshToken redeems raw, presented by client, for the next token of
+// its family.
+func (s *Service) rotateRefreshToken(raw string, client ClientInfo) (*RefreshToken, error) {
+	rt, f, err := s.redeemRefreshToken(raw)
+	if err != nil {
+		return nil, err
+	}
+	next, err := newRefreshToken(f.FamilyID, f.UserID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	if next.ExpiresAt.After(f.ExpiresAt) {
+		next.ExpiresAt = f.ExpiresAt
+	}
+	applied, err := s.Repo.RotateRefreshToken(f, rt.RefreshID, next, client.IP)
+	if err != nil {
+		return nil, err
+	}
+	if !applied {
+		// Another request redeemed the same token first.
+		s.revokeReusedFamily(f)
+		return nil, ErrRefreshTokenReused
+	}
+	return next, nil
+}
+
+func (s *Service) revokeReusedFamily(f *RefreshFamily) {
+	log.Printf("⚠️  refresh token reuse in family %s of user %s; revoking it", f.FamilyID, f.UserID)
+	if err := s.revokeSessions(f.UserID, []*RefreshFamily{f}); err != nil {
+		log.Printf("❌ revoke refresh family %s: %v", f.FamilyID, err)
+	}
+}
+
+const refreshTokenColumns = `refresh_id, family_id, user_id, token_hash, expires_at, created_at`
+
+const refreshFamilyColumns = `family_id, user_id, current_id, created_at, last_used_at, expires_at, revoked_at,
+                              device, ip, user_agent`
+
+func refreshFamilyDest(f *RefreshFamily) []interface{} {
+	return []interface{}{&f.FamilyID, &f.UserID, &f.CurrentID, &f.CreatedAt, &f.LastUsedAt, &f.ExpiresAt,
+		&f.RevokedAt, &f.Device, &f.IP, &f.UserAgent}
+}
+
+func ttlSeconds(until time.Time) int {
+	if s := int(time.Until(until).Seconds()); s > 0 {
+		return s
+	}
+	return 1
+}
+
+const insertRefreshToken = `INSERT INTO refresh_tokens_v2 (` + refreshTokenColumns + `) VALUES (?, ?, ?, ?, ?, ?) USING TTL ?`
+
+func refreshTokenValues(rt *RefreshToken) []interface{} {
+	return []interface{}{rt.RefreshID, rt.FamilyID, rt.UserID, rt.tokenHash, rt.ExpiresAt, rt.CreatedAt,
+		ttlSeconds(rt.ExpiresAt)}
+}
+
+func (r *Repository) InsertRefreshFamily(f *RefreshFamily, rt *RefreshToken) error {
+	ttl := ttlSeconds(f.ExpiresAt)
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO refresh_families (`+refreshFamilyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		f.FamilyID, f.UserID, f.CurrentID, f.CreatedAt, f.LastUsedAt, f.ExpiresAt, f.RevokedAt,
+		f.Device, f.IP, f.UserAgent, ttl)
+	b.Query(`INSERT INTO refresh_families_by_user (user_id, family_id) VALUES (?, ?) USING TTL ?`,
+		f.UserID, f.FamilyID, ttl)
+	b.Query(insertRefreshToken, refreshTokenValues(rt)...)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) GetRefreshToken(id gocql.UUID) (*RefreshToken, error) {
+	var rt RefreshToken
+	err := r.Session.Query(`SELECT `+refreshTokenColumns+` FROM refresh_tokens_v2 WHERE refresh_id = ?`, id).
+		Consistency(gocql.Quorum).
+		Scan(&rt.RefreshID, &rt.FamilyID, &rt.UserID, &rt.tokenHash, &rt.ExpiresAt, &rt.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+func (r *Repository) GetRefreshFamily(id gocql.UUID) (*RefreshFamily, error) {
+	var f RefreshFamily
+	err := r.Session.Query(`SELECT `+refreshFamilyColumns+` FROM refresh_families WHERE family_id = ?`, id).
+		Consistency(gocql.Quorum).
+		Scan(refreshFamilyDest(&f)...)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// RotateRefreshToken makes next the family's current token, provided prevID
+// still is. It reports false when another rotation or a revocation won.
+func (r *Repository) RotateRefreshToken(f *RefreshFamily, prevID gocql.UUID, next *RefreshToken, ip string) (bool, error) {
+	if err := r.Session.Query(insertRefreshToken, refreshTokenValues(next)...).Exec(); err != nil {
+		return false, err
+	}
+	var current *gocql.UUID
+	applied, err := r.Session.Query(
+		`UPDATE refresh_families USING TTL ? SET current_id = ?, last_used_at = ?, ip = ?
+		 WHERE family_id = ? IF current_id = ?`,
+		ttlSeconds(f.ExpiresAt), next.RefreshID, next.CreatedAt, ip, f.FamilyID, prevID,
+	).ScanCAS(&current)
+	if err != nil || !applied {
+		_ = r.Session.Query(`DELETE FROM refresh_tokens_v2 WHERE refresh_id = ?`, next.RefreshID).Exec()
+	}
+	return applied, err
+}
+
+// RevokeRefreshFamily ends a family: none of its tokens can be redeemed.
+func (r *Repository) RevokeRefreshFamily(f *RefreshFamily, at time.Time) error {
+	return r.Session.Query(
+		`UPDATE refresh_families USING TTL ? SET revoked_at = ?, current_id = null WHERE family_id = ?`,
+		ttlSeconds(f.ExpiresAt), at, f.FamilyID,
+	).Exec()
+}
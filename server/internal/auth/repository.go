@@ -36,9 +36,9 @@ func (r *Repository) UserExists(username, email string) (bool, error) {
 }
 
 func (r *Repository) InsertUser(u *User) error {
-	q := `INSERT INTO users (id, username, email, password, created_at, updated_at)
-	      VALUES (?, ?, ?, ?, ?, ?)`
-	return r.Session.Query(q, u.ID, u.Username, u.Email, u.Password, u.CreatedAt, u.UpdatedAt).Exec()
+	q := `INSERT INTO users (id, username, email, password, created_at, updated_at, email_verified)
+	      VALUES (?, ?, ?, ?, ?, ?, ?)`
+	return r.Session.Query(q, u.ID, u.Username, u.Email, u.Password, u.CreatedAt, u.UpdatedAt, u.EmailVerified).Exec()
 }
 
 func (r *Repository) CreateUser(username, email, hashedPassword string) (*User, error) {
@@ -100,68 +100,7 @@ func (r *Repository) GetUserByEmailOrUsername(emailOrUsername string) (*User, er
 		return nil, err
 	}
 
-	u := &User{}
-	err = r.Session.Query(
-		`SELECT id, username, email, password, created_at, updated_at FROM users WHERE id = ?`,
-		userID,
-	).Consistency(gocql.Quorum).Scan(
-		&u.ID, &u.Username, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt,
-	)
-	if err == gocql.ErrNotFound {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	return u, nil
-}
-
-func (r *Repository) SaveRefreshToken(rt *RefreshToken) error {
-	query := `
-		INSERT INTO refresh_tokens (user_id, refresh_id, refresh_token, expires_at, created_at)
-		VALUES (?, ?, ?, ?, ?)`
-
-	return r.Session.Query(query,
-		rt.UserID,
-		gocql.TimeUUID(),
-		rt.Token,
-		rt.ExpiresAt,
-		rt.CreatedAt,
-	).Exec()
-}
-
-func (r *Repository) GetRefreshTokenByToken(userID gocql.UUID, token string) (*RefreshToken, error) {
-	rt := &RefreshToken{}
-	q := `
-		SELECT refresh_id, user_id, refresh_token, expires_at, created_at
-		FROM refresh_tokens
-		WHERE user_id = ? AND refresh_token = ?
-		ALLOW FILTERING
-	`
-	if err := r.Session.Query(q, userID, token).Consistency(gocql.Quorum).
-		Scan(&rt.RefreshID, &rt.UserID, &rt.Token, &rt.ExpiresAt, &rt.CreatedAt); err != nil {
-		if err == gocql.ErrNotFound {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return rt, nil
-}
-
-func (r *Repository) DeleteRefreshToken(userID, refreshID gocql.UUID) error {
-	q := `DELETE FROM refresh_tokens WHERE user_id = ? AND refresh_id = ?`
-	return r.Session.Query(q, userID, refreshID).Exec()
-}
-
-func (r *Repository) DeleteRefreshByToken(userID gocql.UUID, token string) error {
-	rt, err := r.GetRefreshTokenByToken(userID, token)
-	if err != nil {
-		return err
-	}
-	if rt == nil {
-		return gocql.ErrNotFound
-	}
-	return r.DeleteRefreshToken(userID, rt.RefreshID)
+	return r.GetUserByID(userID)
 }
 
 func (r *Repository) ReserveEmail(email string, id gocql.UUID) (bool, error) {
@@ -192,15 +131,18 @@ func (r *Repository) ReleaseUsername(username string) error {
 	return r.Session.Query(`DELETE FROM users_by_username WHERE username = ?`, username).Exec()
 }
 
+const userColumns = `id, username, email, password, created_at, updated_at, is_bot, bot_owner, email_verified,
+                     role, totp_secret, totp_enabled`
+
+func userDest(u *User) []interface{} {
+	return []interface{}{&u.ID, &u.Username, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt,
+		&u.IsBot, &u.BotOwner, &u.EmailVerified, &u.Role, &u.TOTPSecret, &u.TOTPEnabled}
+}
+
 func (r *Repository) GetUserByID(id gocql.UUID) (*User, error) {
 	u := &User{}
-	err := r.Session.Query(
-		`SELECT id, username, email, password, created_at, updated_at
-         FROM users WHERE id = ?`,
-		id,
-	).Consistency(gocql.Quorum).Scan(
-		&u.ID, &u.Username, &u.Email, &u.Password, &u.CreatedAt, &u.UpdatedAt,
-	)
+	err := r.Session.Query(`SELECT `+userColumns+` FROM users WHERE id = ?`, id).
+		Consistency(gocql.Quorum).Scan(userDest(u)...)
 	if err == gocql.ErrNotFound {
 		return nil, nil
 	}
@@ -209,3 +151,11 @@ func (r *Repository) GetUserByID(id gocql.UUID) (*User, error) {
 	}
 	return u, nil
 }
+
+func (r *Repository) SetEmailVerified(id gocql.UUID, at time.Time) error {
+	return r.Session.Query(`UPDATE users SET email_verified = true, updated_at = ? WHERE id = ?`, at, id).Exec()
+}
+
+func (r *Repository) UpdatePassword(id gocql.UUID, hash string, at time.Time) error {
+	return r.Session.Query(`UPDATE users SET password = ?, updated_at = ? WHERE id = ?`, hash, at, id).Exec()
+}
@@ -1,24 +1,50 @@
 package auth
 
 import (
+	"context"
 	"errors"
+	"gochat/internal/mailer"
+	"gochat/internal/ratelimit"
 	"gochat/internal/utils"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
 )
 
 type Service struct {
-	Repo      *Repository
+	Repo *Repository
+	// JWTExpiry is the lifetime of access tokens; clients renew them with
+	// their refresh token.
 	JWTExpiry time.Duration
+	// Redis holds the denylist of revoked sessions.
+	Redis *redis.Client
+	// OnSessionsRevoked is told which sessions of a user were revoked, so
+	// connections opened with them can be closed.
+	OnSessionsRevoked func(userID string, sessionIDs []string)
+
+	Mailer  mailer.Mailer
+	Limiter *ratelimit.Limiter
+	// AppURL is the web client's base URL; mailed links point into it.
+	AppURL string
+	// OIDC holds the single sign-on providers by id.
+	OIDC map[string]*OIDCProvider
+
+	settingsMu sync.Mutex
+	settings   AuthSettings
+	settingsAt time.Time
 }
 
 type MeResponse struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            string    `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	IsBot         bool      `json:"is_bot"`
+	EmailVerified bool      `json:"email_verified"`
 }
 
 type RefreshRequest struct {
@@ -28,7 +54,8 @@ type RefreshRequest struct {
 func NewService(repo *Repository) *Service {
 	return &Service{
 		Repo:      repo,
-		JWTExpiry: time.Hour * 24,
+		JWTExpiry: 15 * time.Minute,
+		AppURL:    utils.GetEnv("APP_URL", "http://localhost:3000"),
 	}
 }
 
@@ -68,6 +95,10 @@ func (s *Service) Signup(req SignupRequest) (*SignupResponse, error) {
 		return nil, err
 	}
 
+	if err := s.sendVerification(u); err != nil {
+		log.Printf("❌ verification mail to user %s: %v", u.ID, err)
+	}
+
 	return &SignupResponse{
 		ID:       u.ID.String(),
 		Username: u.Username,
@@ -75,7 +106,9 @@ func (s *Service) Signup(req SignupRequest) (*SignupResponse, error) {
 	}, nil
 }
 
-func (s *Service) Login(req LoginRequest) (*LoginResponse, error) {
+// Login checks a password. Every failure looks the same to the caller, and
+// repeated failures are throttled; see lockout.go.
+func (s *Service) Login(req LoginRequest, client ClientInfo) (*LoginResponse, error) {
 	if req.EmailOrUsername == "" || len(req.Password) < 6 {
 		return nil, errors.New("invalid login request")
 	}
@@ -84,85 +117,82 @@ func (s *Service) Login(req LoginRequest) (*LoginResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
-		return nil, errors.New("User not found")
+	ctx := context.Background()
+	attempt, err := s.reserveLoginAttempt(ctx, loginSubject(user, req.EmailOrUsername), client.IP)
+	if err != nil {
+		return nil, err
 	}
 
-	if !utils.CheckPasswordHash(req.Password, user.Password) {
-		return nil, errors.New("invalid credentials")
+	var reason string
+	switch {
+	case user == nil:
+		burnPasswordCheck(req.Password)
+		reason = "unknown account"
+	case user.IsBot:
+		burnPasswordCheck(req.Password)
+		reason = "bot account"
+	case !utils.CheckPasswordHash(req.Password, user.Password):
+		reason = "wrong password"
+	}
+	if reason != "" {
+		s.recordLoginFailure(user, attempt, client, reason)
+		return nil, ErrInvalidCredentials
+	}
+	if user.TOTPEnabled {
+		// Failures are forgotten once the second factor passes too. The
+		// code is counted against the IP again when it is tried, so this
+		// attempt gives its IP count back now.
+		s.releaseLoginIP(ctx, attempt)
+		return s.startMFAChallenge(user, client)
 	}
+	s.loginSucceeded(ctx, attempt)
 
-	token, err := utils.GenerateJWT(user.ID.String(), s.JWTExpiry)
+	return s.issueTokens(user.ID, client)
+}
+
+// issueTokens signs userID in with a new session.
+func (s *Service) issueTokens(userID gocql.UUID, client ClientInfo) (*LoginResponse, error) {
+	rt, err := s.startFamily(userID, client)
 	if err != nil {
 		return nil, err
 	}
+	return s.loginResponse(rt)
+}
 
-	refreshToken, err := GenerateRefreshToken(user.ID)
+func (s *Service) loginResponse(rt *RefreshToken) (*LoginResponse, error) {
+	claims, err := s.accessClaims(rt.UserID, rt.FamilyID)
 	if err != nil {
 		return nil, err
 	}
-
-	if err := s.Repo.SaveRefreshToken(refreshToken); err != nil {
+	token, err := utils.GenerateJWT(rt.UserID.String(), s.JWTExpiry, claims)
+	if err != nil {
 		return nil, err
 	}
-
 	return &LoginResponse{
 		Token:        token,
-		RefreshToken: refreshToken.Token,
+		RefreshToken: rt.Token,
 		ExpiresAt:    time.Now().Add(s.JWTExpiry).Unix(),
 	}, nil
 }
 
-func (s *Service) Refresh(userIDStr string, req RefreshRequest) (*LoginResponse, error) {
+// Refresh trades a refresh token for a new access token and the next refresh
+// token of its family. It needs no access token, so expired sessions renew.
+func (s *Service) Refresh(req RefreshRequest, client ClientInfo) (*LoginResponse, error) {
 	if req.RefreshToken == "" {
 		return nil, errors.New("missing refresh_token")
 	}
-
-	userID, err := gocql.ParseUUID(userIDStr)
-	if err != nil {
-		return nil, errors.New("invalid user id")
-	}
-
-	row, err := s.Repo.GetRefreshTokenByToken(userID, req.RefreshToken)
+	rt, err := s.rotateRefreshToken(req.RefreshToken, client)
 	if err != nil {
 		return nil, err
 	}
-	if row == nil {
-		return nil, errors.New("refresh token not found")
-	}
-
-	if time.Now().After(row.ExpiresAt) {
-		_ = s.Repo.DeleteRefreshToken(userID, row.RefreshID)
-		return nil, errors.New("refresh token expired")
-	}
-
-	accessToken, err := utils.GenerateJWT(userID.String(), s.JWTExpiry)
-	if err != nil {
-		return nil, err
-	}
-
-	newRT, err := GenerateRefreshToken(userID)
-	if err != nil {
-		return nil, err
-	}
-	if err := s.Repo.SaveRefreshToken(newRT); err != nil {
-		return nil, err
-	}
-	if err := s.Repo.DeleteRefreshToken(userID, row.RefreshID); err != nil {
-		return nil, err
-	}
-
-	return &LoginResponse{
-		Token:        accessToken,
-		RefreshToken: newRT.Token,
-		ExpiresAt:    time.Now().Add(s.JWTExpiry).Unix(),
-	}, nil
+	return s.loginResponse(rt)
 }
 
 type LogoutRequest struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+// Logout ends the session the refresh token belongs to.
 func (s *Service) Logout(userIDStr string, req LogoutRequest) error {
 	if req.RefreshToken == "" {
 		return errors.New("missing refresh_token")
@@ -171,7 +201,17 @@ func (s *Service) Logout(userIDStr string, req LogoutRequest) error {
 	if err != nil {
 		return errors.New("invalid user id")
 	}
-	return s.Repo.DeleteRefreshByToken(userID, req.RefreshToken)
+	_, f, err := s.lookupRefreshToken(req.RefreshToken)
+	if err == ErrInvalidRefreshToken || (err == nil && f.UserID != userID) {
+		return gocql.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if f.RevokedAt != nil {
+		return nil
+	}
+	return s.revokeSessions(userID, []*RefreshFamily{f})
 }
 
 func (s *Service) Me(userIDStr string) (*MeResponse, error) {
@@ -187,10 +227,12 @@ func (s *Service) Me(userIDStr string) (*MeResponse, error) {
 		return nil, errors.New("user not found")
 	}
 	return &MeResponse{
-		ID:        u.ID.String(),
-		Username:  u.Username,
-		Email:     u.Email,
-		CreatedAt: u.CreatedAt,
-		UpdatedAt: u.UpdatedAt,
+		ID:            u.ID.String(),
+		Username:      u.Username,
+		Email:         u.Email,
+		CreatedAt:     u.CreatedAt,
+		UpdatedAt:     u.UpdatedAt,
+		IsBot:         u.IsBot,
+		EmailVerified: u.EmailVerified,
 	}, nil
 }
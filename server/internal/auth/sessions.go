@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+)
+
+// A session is a refresh token family seen from the user's side. Revoking
+// one ends its refresh token, puts its id on a Redis denylist so access
+// tokens carrying it as their sid claim stop working before they expire, and
+// closes the WebSocket connections opened with them.
+
+const sessionDenylistPrefix = "auth:revoked_session:"
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// ClientInfo describes where a sign-in or refresh came from.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+	// Device is the client's own name for itself, if it sent one.
+	Device string
+}
+
+func ClientFromRequest(r *http.Request, device string) ClientInfo {
+	return ClientInfo{
+		IP:        utils.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Device:    strings.TrimSpace(device),
+	}
+}
+
+func (c ClientInfo) device() string {
+	if c.Device != "" {
+		if len(c.Device) > 80 {
+			return c.Device[:80]
+		}
+		return c.Device
+	}
+	return deviceFromUserAgent(c.UserAgent)
+}
+
+// deviceFromUserAgent names a browser and OS well enough to tell sessions
+// apart, e.g. "Firefox on Windows".
+func deviceFromUserAgent(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	platform := ""
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iOS"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			platform = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	if len(ua) > 40 {
+		return ua[:40]
+	}
+	return ua
+}
+
+type Session struct {
+	ID         gocql.UUID `json:"id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"userAgent"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	// Current marks the session the request was made with.
+	Current bool `json:"current"`
+}
+
+// liveSessions returns the user's families that can still be refreshed.
+func (s *Service) liveSessions(userID gocql.UUID) ([]*RefreshFamily, error) {
+	all, err := s.Repo.ListRefreshFamilies(userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	var out []*RefreshFamily
+	for _, f := range all {
+		if f.RevokedAt == nil && now.Before(f.ExpiresAt) {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// ListSessions returns the user's active sessions, most recently used first.
+// currentID is the session of the caller's access token.
+func (s *Service) ListSessions(userID gocql.UUID, currentID string) ([]Session, error) {
+	families, err := s.liveSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	out := []Session{}
+	for _, f := range families {
+		out = append(out, Session{
+			ID:         f.FamilyID,
+			Device:     f.Device,
+			IP:         f.IP,
+			UserAgent:  f.UserAgent,
+			CreatedAt:  f.CreatedAt,
+			LastUsedAt: f.LastUsedAt,
+			ExpiresAt:  f.ExpiresAt,
+			Current:    f.FamilyID.String() == currentID,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastUsedAt.After(out[j].LastUsedAt) })
+	return out, nil
+}
+
+func (s *Service) RevokeSession(userID, id gocql.UUID) error {
+	f, err := s.Repo.GetRefreshFamily(id)
+	if err == gocql.ErrNotFound || (err == nil && f.UserID != userID) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if f.RevokedAt != nil {
+		return nil
+	}
+	return s.revokeSessions(userID, []*RefreshFamily{f})
+}
+
+// RevokeAllSessions logs the user out everywhere.
+func (s *Service) RevokeAllSessions(userID gocql.UUID) error {
+	families, err := s.liveSessions(userID)
+	if err != nil {
+		return err
+	}
+	return s.revokeSessions(userID, families)
+}
+
+func (s *Service) revokeSessions(userID gocql.UUID, families []*RefreshFamily) error {
+	if len(families) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	ids := make([]string, 0, len(families))
+	for _, f := range families {
+		if err := s.Repo.RevokeRefreshFamily(f, now); err != nil {
+			return err
+		}
+		if err := s.denySession(f.FamilyID.String()); err != nil {
+			return err
+		}
+		ids = append(ids, f.FamilyID.String())
+	}
+	if s.OnSessionsRevoked != nil {
+		s.OnSessionsRevoked(userID.String(), ids)
+	}
+	return nil
+}
+
+// denySession rejects the session's access tokens until the last of them
+// has expired on its own.
+func (s *Service) denySession(id string) error {
+	if s.Redis == nil {
+		return nil
+	}
+	return s.Redis.Set(context.Background(), sessionDenylistPrefix+id, 1, s.JWTExpiry+time.Minute).Err()
+}
+
+func (s *Service) sessionDenied(id string) (bool, error) {
+	if s.Redis == nil || id == "" {
+		return false, nil
+	}
+	n, err := s.Redis.Exists(context.Background(), sessionDenylistPrefix+id).Result()
+	return n > 0, err
+}
+
+func (r *Repository) ListRefreshFamilies(userID gocql.UUID) ([]*RefreshFamily, error) {
+	iter := r.Session.Query(`SELECT family_id FROM refresh_families_by_user WHERE user_id = ?`, userID).Iter()
+	var ids []gocql.UUID
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	var out []*RefreshFamily
+	for _, id := range ids {
+		f, err := r.GetRefreshFamily(id)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
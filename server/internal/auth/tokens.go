@@ -0,0 +1,358 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// API tokens let integrations call the API and /ws without a user's
+// password. They belong to a user (personal access tokens) or to one of the
+// user's bots, carry scopes, and are shown once: only a hash is stored.
+// The token embeds its id so it can be looked up by primary key:
+// "gct_" + hex(token id) + hex(secret).
+
+const (
+	ScopeReadMessages  = "read:messages"
+	ScopeWriteMessages = "write:messages"
+	ScopeManageRooms   = "manage:rooms"
+
+	APITokenPrefix = "gct_"
+
+	maxTokenName    = 80
+	maxTokenTTLDays = 365
+	// last_used_at is written at most this often per token.
+	lastUsedGranularity = time.Hour
+)
+
+var (
+	knownScopes = map[string]bool{
+		ScopeReadMessages:  true,
+		ScopeWriteMessages: true,
+		ScopeManageRooms:   true,
+	}
+	botUsernameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,30}$`)
+
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+type APIToken struct {
+	ID         gocql.UUID `json:"id"`
+	UserID     gocql.UUID `json:"userId"`
+	CreatedBy  gocql.UUID `json:"createdBy"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Bot        bool       `json:"bot"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	// Token is only returned when the token is created.
+	Token string `json:"token,omitempty"`
+
+	tokenHash string
+}
+
+type Bot struct {
+	ID        gocql.UUID `json:"id"`
+	Username  string     `json:"username"`
+	OwnerID   gocql.UUID `json:"ownerId"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// CreateTokenRequest issues a personal token, or a token for BotID when set.
+type CreateTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	BotID         string   `json:"botId,omitempty"`
+	ExpiresInDays int      `json:"expiresInDays,omitempty"` // 0 never expires
+}
+
+type CreateBotRequest struct {
+	Username string `json:"username"`
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAPIToken extracts the token id from a raw token.
+func parseAPIToken(raw string) (gocql.UUID, bool) {
+	rest := strings.TrimPrefix(raw, APITokenPrefix)
+	if len(rest) < 32 {
+		return gocql.UUID{}, false
+	}
+	b, err := hex.DecodeString(rest[:32])
+	if err != nil {
+		return gocql.UUID{}, false
+	}
+	id, err := gocql.UUIDFromBytes(b)
+	return id, err == nil
+}
+
+// Authenticate accepts a session JWT or an API token. Install it as the
+// package's Authenticate so AuthMiddleware and /ws both know API tokens and
+// revoked sessions.
+func (s *Service) Authenticate(raw string) (*Principal, error) {
+	if !strings.HasPrefix(raw, APITokenPrefix) {
+		p, err := principalFromJWT(raw)
+		if err != nil {
+			return nil, err
+		}
+		if denied, err := s.sessionDenied(p.SessionID); err != nil {
+			return nil, err
+		} else if denied {
+			return nil, errors.New("session revoked")
+		}
+		return p, nil
+	}
+	id, ok := parseAPIToken(raw)
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	t, err := s.Repo.GetAPIToken(id)
+	if err == gocql.ErrNotFound {
+		return nil, errors.New("invalid token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIToken(raw)), []byte(t.tokenHash)) != 1 {
+		return nil, errors.New("invalid token")
+	}
+	now := time.Now().UTC()
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return nil, errors.New("token expired")
+	}
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > lastUsedGranularity {
+		_ = s.Repo.TouchAPIToken(id, now)
+	}
+	scopes := t.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return &Principal{UserID: t.UserID.String(), Bot: t.Bot, TokenID: id.String(), Scopes: scopes}, nil
+}
+
+func (s *Service) CreateToken(callerID gocql.UUID, req CreateTokenRequest) (*APIToken, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxTokenName {
+		return nil, errors.New("invalid name")
+	}
+	seen := map[string]bool{}
+	var scopes []string
+	for _, sc := range req.Scopes {
+		if !knownScopes[sc] {
+			return nil, errors.New("unknown scope " + sc)
+		}
+		if !seen[sc] {
+			seen[sc] = true
+			scopes = append(scopes, sc)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("scopes are required")
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxTokenTTLDays {
+		return nil, errors.New("invalid expiresInDays")
+	}
+
+	now := time.Now().UTC()
+	t := &APIToken{
+		ID:        gocql.TimeUUID(),
+		UserID:    callerID,
+		CreatedBy: callerID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if req.BotID != "" {
+		botID, err := gocql.ParseUUID(req.BotID)
+		if err != nil {
+			return nil, errors.New("invalid bot id")
+		}
+		bot, err := s.Repo.GetUserByID(botID)
+		if err != nil {
+			return nil, err
+		}
+		if bot == nil || !bot.IsBot || bot.BotOwner == nil || *bot.BotOwner != callerID {
+			return nil, errors.New("bot not found")
+		}
+		t.UserID, t.Bot = botID, true
+	}
+	if req.ExpiresInDays > 0 {
+		exp := now.AddDate(0, 0, req.ExpiresInDays)
+		t.ExpiresAt = &exp
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	t.Token = APITokenPrefix + hex.EncodeToString(t.ID.Bytes()) + hex.EncodeToString(secret)
+	t.tokenHash = hashAPIToken(t.Token)
+	if err := s.Repo.InsertAPIToken(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTokens returns the tokens the caller created, for themselves and
+// their bots.
+func (s *Service) ListTokens(callerID gocql.UUID) ([]APIToken, error) {
+	list, err := s.Repo.ListAPITokens(callerID)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []APIToken{}
+	}
+	return list, nil
+}
+
+func (s *Service) RevokeToken(callerID, id gocql.UUID) error {
+	t, err := s.Repo.GetAPIToken(id)
+	if err == gocql.ErrNotFound || (err == nil && t.CreatedBy != callerID) {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.Repo.DeleteAPIToken(t)
+}
+
+// CreateBot adds a bot user owned by the caller. Bots cannot log in; they
+// authenticate with bot tokens.
+func (s *Service) CreateBot(ownerID gocql.UUID, req CreateBotRequest) (*Bot, error) {
+	username := strings.TrimSpace(req.Username)
+	if !botUsernameRe.MatchString(username) {
+		return nil, errors.New("invalid username")
+	}
+	now := time.Now().UTC()
+	u := &User{
+		ID:        gocql.TimeUUID(),
+		Username:  username,
+		CreatedAt: now,
+		UpdatedAt: now,
+		IsBot:     true,
+		BotOwner:  &ownerID,
+	}
+	if ok, err := s.Repo.ReserveUsername(u.Username, u.ID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.New("username already taken")
+	}
+	if err := s.Repo.InsertBot(u); err != nil {
+		_ = s.Repo.ReleaseUsername(u.Username)
+		return nil, err
+	}
+	return &Bot{ID: u.ID, Username: u.Username, OwnerID: ownerID, CreatedAt: now}, nil
+}
+
+func (s *Service) ListBots(ownerID gocql.UUID) ([]Bot, error) {
+	ids, err := s.Repo.ListBotIDs(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	out := []Bot{}
+	for _, id := range ids {
+		u, err := s.Repo.GetUserByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			continue
+		}
+		out = append(out, Bot{ID: u.ID, Username: u.Username, OwnerID: ownerID, CreatedAt: u.CreatedAt})
+	}
+	return out, nil
+}
+
+const apiTokenColumns = `token_id, user_id, created_by, name, token_hash, scopes, is_bot, created_at, expires_at, last_used_at`
+
+func apiTokenDest(t *APIToken) []interface{} {
+	return []interface{}{&t.ID, &t.UserID, &t.CreatedBy, &t.Name, &t.tokenHash, &t.Scopes, &t.Bot,
+		&t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt}
+}
+
+func (r *Repository) InsertAPIToken(t *APIToken) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO api_tokens (`+apiTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.UserID, t.CreatedBy, t.Name, t.tokenHash, t.Scopes, t.Bot, t.CreatedAt, t.ExpiresAt, t.LastUsedAt)
+	b.Query(`INSERT INTO api_tokens_by_creator (created_by, token_id) VALUES (?, ?)`, t.CreatedBy, t.ID)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) GetAPIToken(id gocql.UUID) (*APIToken, error) {
+	var t APIToken
+	err := r.Session.Query(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_id = ?`, id).
+		Consistency(gocql.Quorum).Scan(apiTokenDest(&t)...)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *Repository) ListAPITokens(createdBy gocql.UUID) ([]APIToken, error) {
+	iter := r.Session.Query(`SELECT token_id FROM api_tokens_by_creator WHERE created_by = ?`, createdBy).Iter()
+	var ids []gocql.UUID
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	var out []APIToken
+	for _, id := range ids {
+		t, err := r.GetAPIToken(id)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *t)
+	}
+	return out, nil
+}
+
+func (r *Repository) TouchAPIToken(id gocql.UUID, at time.Time) error {
+	return r.Session.Query(`UPDATE api_tokens SET last_used_at = ? WHERE token_id = ?`, at, id).Exec()
+}
+
+func (r *Repository) DeleteAPIToken(t *APIToken) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`DELETE FROM api_tokens WHERE token_id = ?`, t.ID)
+	b.Query(`DELETE FROM api_tokens_by_creator WHERE created_by = ? AND token_id = ?`, t.CreatedBy, t.ID)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) InsertBot(u *User) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO users (id, username, email, password, created_at, updated_at, is_bot, bot_owner)
+	         VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.ID, u.Username, u.Email, u.Password, u.CreatedAt, u.UpdatedAt, u.IsBot, u.BotOwner)
+	b.Query(`INSERT INTO bots_by_owner (owner_id, bot_id) VALUES (?, ?)`, *u.BotOwner, u.ID)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) ListBotIDs(ownerID gocql.UUID) ([]gocql.UUID, error) {
+	iter := r.Session.Query(`SELECT bot_id FROM bots_by_owner WHERE owner_id = ?`, ownerID).Iter()
+	var ids []gocql.UUID
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
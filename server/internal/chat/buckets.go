@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Messages are partitioned by (room_id, bucket) where bucket is the yyyymm
+// month of the message's TimeUUID. room_message_buckets lists the non-empty
+// buckets of a room so reads can skip months without traffic.
+
+// BucketOf returns the partition bucket for a message id.
+func BucketOf(msgID gocql.UUID) int {
+	return bucketOfTime(msgID.Time())
+}
+
+func bucketOfTime(t time.Time) int {
+	t = t.UTC()
+	return t.Year()*100 + int(t.Month())
+}
+
+func (r *Repository) addBucket(roomID gocql.UUID, bucket int) error {
+	return r.Session.Query(
+		`INSERT INTO room_message_buckets (room_id, bucket) VALUES (?, ?)`, roomID, bucket,
+	).Exec()
+}
+
+// bucketsFrom returns the room's non-empty buckets, newest first, starting at
+// (and including) from. A zero from starts at the newest bucket.
+func (r *Repository) bucketsFrom(roomID gocql.UUID, from int) ([]int, error) {
+	var iter *gocql.Iter
+	if from > 0 {
+		iter = r.Session.Query(
+			`SELECT bucket FROM room_message_buckets WHERE room_id = ? AND bucket <= ?`, roomID, from,
+		).Iter()
+	} else {
+		iter = r.Session.Query(
+			`SELECT bucket FROM room_message_buckets WHERE room_id = ?`, roomID,
+		).Iter()
+	}
+	var out []int
+	var b int
+	for iter.Scan(&b) {
+		out = append(out, b)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// bucketsSince returns the room's non-empty buckets from (and including) from
+// onwards, oldest first.
+func (r *Repository) bucketsSince(roomID gocql.UUID, from int) ([]int, error) {
+	iter := r.Session.Query(
+		`SELECT bucket FROM room_message_buckets WHERE room_id = ? AND bucket >= ? ORDER BY bucket ASC`,
+		roomID, from,
+	).Iter()
+	var out []int
+	var b int
+	for iter.Scan(&b) {
+		out = append(out, b)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
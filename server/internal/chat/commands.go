@@ -0,0 +1,353 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gochat/internal/auth"
+	"gochat/internal/utils"
+	"gochat/internal/ws"
+
+	"github.com/gocql/gocql"
+)
+
+// Messages starting with "/" are intercepted by PostMessage and dispatched
+// to a slash command instead of being stored; "//" escapes a literal slash.
+// Built-ins are registered at startup, other packages may add their own
+// with RegisterSlashCommand, and room admins can register external commands
+// that are answered by an HTTP callback.
+
+const (
+	CommandEphemeral = "ephemeral"  // shown only to the caller
+	CommandInChannel = "in_channel" // posted to the room
+
+	CommandSourceBuiltin  = "builtin"
+	CommandSourceExternal = "external"
+
+	externalCommandTimeout = 3 * time.Second
+)
+
+var commandNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// CommandInvocation is one use of a slash command.
+type CommandInvocation struct {
+	RoomID gocql.UUID
+	UserID gocql.UUID
+	Name   string
+	Args   string
+	TempID string
+}
+
+// CommandResponse is what a handler produces. Text in an in-channel
+// response is posted as a message of kind Kind from the caller; a handler
+// that posted its own message sets Posted instead.
+type CommandResponse struct {
+	ResponseType string
+	Text         string
+	Kind         string
+	Posted       *PostedMessage
+}
+
+// CommandHandler runs a slash command.
+type CommandHandler func(ctx context.Context, inv *CommandInvocation) (*CommandResponse, error)
+
+// SlashCommand describes a command for dispatch and autocomplete.
+type SlashCommand struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Usage       string `json:"usage,omitempty"`
+	Source      string `json:"source"`
+
+	run CommandHandler
+	// scope is the API token scope the command needs beyond the
+	// write:messages that sending it takes.
+	scope string
+}
+
+// CommandResult reports a command's outcome to the caller.
+type CommandResult struct {
+	Command      string `json:"command"`
+	ResponseType string `json:"responseType"`
+	Text         string `json:"text,omitempty"`
+}
+
+// RegisterSlashCommand adds a built-in command. It must be called before the
+// server starts handling requests.
+func (s *Service) RegisterSlashCommand(name, description, usage string, run CommandHandler) {
+	if s.commands == nil {
+		s.commands = map[string]*SlashCommand{}
+	}
+	s.commands[name] = &SlashCommand{
+		Name: name, Description: description, Usage: usage, Source: CommandSourceBuiltin, run: run,
+	}
+}
+
+// ListCommands returns the commands available in a room whose names start
+// with prefix, for autocomplete.
+func (s *Service) ListCommands(roomID, userID gocql.UUID, prefix string) ([]SlashCommand, error) {
+	if err := s.EnsureMemberOrPublic(roomID, userID); err != nil {
+		return nil, err
+	}
+	prefix = strings.ToLower(strings.TrimPrefix(prefix, "/"))
+
+	out := []SlashCommand{}
+	for _, c := range s.commands {
+		if strings.HasPrefix(c.Name, prefix) {
+			out = append(out, *c)
+		}
+	}
+	ext, err := s.Repo.ListRoomCommands(roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range ext {
+		if _, shadowed := s.commands[c.Name]; !shadowed && strings.HasPrefix(c.Name, prefix) {
+			out = append(out, SlashCommand{Name: c.Name, Description: c.Description, Usage: c.Usage, Source: CommandSourceExternal})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// ensureCommandScope refuses content that runs a built-in command the
+// scopes do not allow.
+func (s *Service) ensureCommandScope(content string, scopes []string) error {
+	if !strings.HasPrefix(content, "/") || strings.HasPrefix(content, "//") {
+		return nil
+	}
+	name, _, _ := strings.Cut(content[1:], " ")
+	c, ok := s.commands[strings.ToLower(name)]
+	if !ok || c.scope == "" || auth.ScopesAllow(scopes, c.scope) {
+		return nil
+	}
+	return fmt.Errorf("forbidden: /%s needs a token with %s", c.Name, c.scope)
+}
+
+// runSlashCommand dispatches content, which starts with "/", for a caller
+// PostMessage has already authorized to post.
+func (s *Service) runSlashCommand(ctx context.Context, in PostMessageInput, content string) (*PostedMessage, error) {
+	if err := s.ensureCommandScope(content, in.Scopes); err != nil {
+		return nil, err
+	}
+	name, args, _ := strings.Cut(content[1:], " ")
+	name = strings.ToLower(name)
+	inv := &CommandInvocation{
+		RoomID: in.RoomID, UserID: in.UserID, Name: name, Args: strings.TrimSpace(args), TempID: in.TempID,
+	}
+
+	var (
+		resp *CommandResponse
+		err  error
+	)
+	if c, ok := s.commands[name]; ok {
+		resp, err = c.run(ctx, inv)
+	} else if ext, e := s.Repo.GetRoomCommand(in.RoomID, name); e == nil {
+		resp, err = s.callExternalCommand(ctx, ext, inv)
+	} else if e == gocql.ErrNotFound {
+		resp = &CommandResponse{ResponseType: CommandEphemeral, Text: "Unknown command /" + name}
+	} else {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.ResponseType == "" {
+		resp.ResponseType = CommandEphemeral
+	}
+
+	result := &CommandResult{Command: name, ResponseType: resp.ResponseType, Text: resp.Text}
+	if resp.Posted != nil {
+		resp.Posted.Command = result
+		return resp.Posted, nil
+	}
+	if resp.ResponseType == CommandInChannel && resp.Text != "" {
+		posted, err := s.PostMessage(ctx, PostMessageInput{
+			RoomID: in.RoomID, UserID: in.UserID, Content: resp.Text, TempID: in.TempID,
+			Kind: resp.Kind, skipCommands: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		posted.Command = result
+		return posted, nil
+	}
+
+	result.ResponseType = CommandEphemeral
+	if s.Hub != nil && resp.Text != "" {
+		s.Hub.SendToUser(in.UserID.String(), ws.NewServerEvent("command.response", "server", in.UserID.String(), map[string]any{
+			"roomId":  in.RoomID.String(),
+			"command": name,
+			"text":    resp.Text,
+			"tempId":  in.TempID,
+		}))
+	}
+	return &PostedMessage{Message: Message{RoomID: in.RoomID}, TempID: in.TempID, Command: result}, nil
+}
+
+// RoomCommand is an external command registered in a room.
+type RoomCommand struct {
+	RoomID      gocql.UUID `json:"roomId"`
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	Description string     `json:"description,omitempty"`
+	Usage       string     `json:"usage,omitempty"`
+	Secret      string     `json:"secret,omitempty"` // only returned on registration
+	CreatedBy   gocql.UUID `json:"createdBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+// RegisterRoomCommand adds or replaces an external command in a room. The
+// returned secret signs every callback request. It is stored in plaintext
+// in room_commands, since the server needs it to sign; it grants nothing
+// beyond forging callbacks to the command's own URL.
+func (s *Service) RegisterRoomCommand(roomID, userID gocql.UUID, req RegisterCommandRequest) (*RoomCommand, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.Name), "/"))
+	if !commandNameRe.MatchString(name) {
+		return nil, errors.New("invalid command name")
+	}
+	if _, ok := s.commands[name]; ok {
+		return nil, errors.New("command name is reserved")
+	}
+	url := strings.TrimSpace(req.URL)
+	if err := utils.ValidateOutboundURL(url); err != nil {
+		return nil, errors.New("invalid url: " + err.Error())
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	c := &RoomCommand{
+		RoomID:      roomID,
+		Name:        name,
+		URL:         url,
+		Description: strings.TrimSpace(req.Description),
+		Usage:       strings.TrimSpace(req.Usage),
+		Secret:      hex.EncodeToString(buf),
+		CreatedBy:   userID,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.Repo.InsertRoomCommand(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Service) DeleteRoomCommand(roomID, userID gocql.UUID, name string) error {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return err
+	}
+	return s.Repo.DeleteRoomCommand(roomID, strings.ToLower(name))
+}
+
+// commandHTTPClient only reaches public addresses and does not follow
+// redirects, so a command URL cannot reach the internal network.
+var commandHTTPClient = utils.OutboundClient(externalCommandTimeout)
+
+// callExternalCommand posts the invocation to the command's URL, signed
+// with HMAC-SHA256 over "timestamp.body", and reads a Slack-style reply:
+// {"response_type": "ephemeral"|"in_channel", "text": "..."}.
+func (s *Service) callExternalCommand(ctx context.Context, c *RoomCommand, inv *CommandInvocation) (*CommandResponse, error) {
+	body, err := json.Marshal(map[string]any{
+		"command":  "/" + inv.Name,
+		"text":     inv.Args,
+		"roomId":   inv.RoomID.String(),
+		"userId":   inv.UserID.String(),
+		"username": s.username(inv.UserID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gochat-Timestamp", ts)
+	req.Header.Set("X-Gochat-Signature", "v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	res, err := commandHTTPClient.Do(req)
+	if err != nil {
+		return &CommandResponse{Text: fmt.Sprintf("/%s did not respond", inv.Name)}, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return &CommandResponse{Text: fmt.Sprintf("/%s failed (%d)", inv.Name, res.StatusCode)}, nil
+	}
+
+	var out struct {
+		ResponseType string `json:"response_type"`
+		Text         string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&out); err != nil {
+		return &CommandResponse{Text: fmt.Sprintf("/%s sent an invalid response", inv.Name)}, nil
+	}
+	if len(out.Text) > maxContentLen {
+		out.Text = out.Text[:maxContentLen]
+	}
+	if out.ResponseType != CommandInChannel {
+		out.ResponseType = CommandEphemeral
+	}
+	return &CommandResponse{ResponseType: out.ResponseType, Text: out.Text}, nil
+}
+
+const roomCommandColumns = `room_id, name, url, description, usage, secret, created_by, created_at`
+
+func roomCommandDest(c *RoomCommand) []interface{} {
+	return []interface{}{&c.RoomID, &c.Name, &c.URL, &c.Description, &c.Usage, &c.Secret, &c.CreatedBy, &c.CreatedAt}
+}
+
+func (r *Repository) InsertRoomCommand(c *RoomCommand) error {
+	return r.Session.Query(`INSERT INTO room_commands (`+roomCommandColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.RoomID, c.Name, c.URL, c.Description, c.Usage, c.Secret, c.CreatedBy, c.CreatedAt,
+	).Exec()
+}
+
+func (r *Repository) GetRoomCommand(roomID gocql.UUID, name string) (*RoomCommand, error) {
+	var c RoomCommand
+	if err := r.Session.Query(`SELECT `+roomCommandColumns+` FROM room_commands WHERE room_id = ? AND name = ?`,
+		roomID, name).Scan(roomCommandDest(&c)...); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *Repository) ListRoomCommands(roomID gocql.UUID) ([]RoomCommand, error) {
+	iter := r.Session.Query(`SELECT `+roomCommandColumns+` FROM room_commands WHERE room_id = ?`, roomID).Iter()
+	var out []RoomCommand
+	var c RoomCommand
+	for iter.Scan(roomCommandDest(&c)...) {
+		out = append(out, c)
+		c = RoomCommand{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repository) DeleteRoomCommand(roomID gocql.UUID, name string) error {
+	return r.Session.Query(`DELETE FROM room_commands WHERE room_id = ? AND name = ?`, roomID, name).Exec()
+}
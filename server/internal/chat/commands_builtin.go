@@ -0,0 +1,212 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"gochat/internal/auth"
+)
+
+const (
+	MessageKindAction = "action" // "/me waves", rendered as "* alice waves"
+
+	shrug = `¯\_(ツ)_/¯`
+)
+
+func (s *Service) registerBuiltinCommands() {
+	s.RegisterSlashCommand("topic", "Show or set the room topic", "[new topic]", s.cmdTopic)
+	s.RegisterSlashCommand("invite", "Add people to this room", "@user [@user...]", s.cmdInvite)
+	s.RegisterSlashCommand("me", "Describe an action", "<action>", s.cmdMe)
+	s.RegisterSlashCommand("shrug", `Append `+shrug+` to your message`, "[message]", s.cmdShrug)
+	s.RegisterSlashCommand("poll", "Create a poll", `"question" "option" "option" [--multi] [--anonymous]`, s.cmdPoll)
+
+	// Changing a room's topic or members is room management, which an API
+	// token able to send messages may not be allowed.
+	s.commands["topic"].scope = auth.ScopeManageRooms
+	s.commands["invite"].scope = auth.ScopeManageRooms
+}
+
+func ephemeral(text string) *CommandResponse {
+	return &CommandResponse{ResponseType: CommandEphemeral, Text: text}
+}
+
+func (s *Service) cmdTopic(ctx context.Context, inv *CommandInvocation) (*CommandResponse, error) {
+	if inv.Args == "" {
+		room, err := s.loadRoom(inv.RoomID)
+		if err != nil {
+			return nil, err
+		}
+		if room.Topic == "" {
+			return ephemeral("This room has no topic."), nil
+		}
+		return ephemeral("Topic: " + room.Topic), nil
+	}
+	room, err := s.UpdateRoom(inv.RoomID, inv.UserID, UpdateRoomRequest{Topic: &inv.Args})
+	if err != nil {
+		return nil, err
+	}
+	s.publish(roomUpdatedEvent(room))
+	if err := s.postSystemMessage(room, inv.UserID, "set the topic to: "+room.Topic); err != nil {
+		return nil, err
+	}
+	return ephemeral(""), nil
+}
+
+// cmdInvite adds users to a channel. Any participant may invite to a public
+// room; private rooms need an admin.
+func (s *Service) cmdInvite(ctx context.Context, inv *CommandInvocation) (*CommandResponse, error) {
+	room, err := s.writableRoom(inv.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Kind == RoomKindDM || room.Kind == RoomKindGroupDM {
+		return ephemeral("People are added to a DM from its members list."), nil
+	}
+	ok, err := s.Repo.IsParticipant(inv.RoomID, inv.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("forbidden: join the room first")
+	}
+	public, err := s.Repo.IsRoomPublic(room)
+	if err != nil {
+		return nil, err
+	}
+	if !public {
+		if err := s.ensureRoomAdmin(inv.RoomID, inv.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	var added, unknown []string
+	for _, f := range strings.Fields(inv.Args) {
+		name := strings.TrimPrefix(f, "@")
+		id, found, err := s.Repo.GetUserIDByUsername(name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			unknown = append(unknown, "@"+name)
+			continue
+		}
+		if in, err := s.Repo.IsParticipant(inv.RoomID, id); err != nil {
+			return nil, err
+		} else if in {
+			continue
+		}
+		if room.Visibility == "" {
+			// pin legacy rooms as public before they gain participants
+			if err := s.Repo.SetRoomVisibility(inv.RoomID, VisibilityPublic); err != nil {
+				return nil, err
+			}
+			room.Visibility = VisibilityPublic
+		}
+		if err := s.Repo.AddParticipant(inv.RoomID, id, "member", time.Now().UTC()); err != nil {
+			return nil, err
+		}
+		s.publish(memberJoinedEvent(inv.RoomID, id, name))
+		added = append(added, "@"+name)
+	}
+
+	if len(added) > 0 {
+		if err := s.postSystemMessage(room, inv.UserID, "invited "+strings.Join(added, ", ")); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case len(unknown) > 0:
+		return ephemeral("No such user: " + strings.Join(unknown, ", ")), nil
+	case len(added) == 0:
+		return ephemeral("Usage: /invite @user [@user...]"), nil
+	}
+	return ephemeral(""), nil
+}
+
+func (s *Service) cmdMe(ctx context.Context, inv *CommandInvocation) (*CommandResponse, error) {
+	if inv.Args == "" {
+		return ephemeral("Usage: /me <action>"), nil
+	}
+	return &CommandResponse{ResponseType: CommandInChannel, Text: inv.Args, Kind: MessageKindAction}, nil
+}
+
+func (s *Service) cmdShrug(ctx context.Context, inv *CommandInvocation) (*CommandResponse, error) {
+	return &CommandResponse{ResponseType: CommandInChannel, Text: strings.TrimSpace(inv.Args + " " + shrug)}, nil
+}
+
+func (s *Service) cmdPoll(ctx context.Context, inv *CommandInvocation) (*CommandResponse, error) {
+	var req CreatePollRequest
+	var texts []string
+	for _, a := range splitCommandArgs(inv.Args) {
+		switch a {
+		case "--multi":
+			req.MultiChoice = true
+		case "--anonymous":
+			req.Anonymous = true
+		default:
+			texts = append(texts, a)
+		}
+	}
+	if len(texts) < 1+minPollOptions {
+		return ephemeral(`Usage: /poll "question" "option" "option" [--multi] [--anonymous]`), nil
+	}
+	req.Question, req.Options = texts[0], texts[1:]
+	posted, err := s.CreatePoll(ctx, inv.RoomID, inv.UserID, req)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandResponse{ResponseType: CommandInChannel, Posted: posted}, nil
+}
+
+// splitCommandArgs splits on whitespace, keeping "double quoted" runs together.
+func splitCommandArgs(s string) []string {
+	var (
+		out   []string
+		cur   strings.Builder
+		quote bool
+		open  bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quote = !quote
+			open = true
+		case !quote && (r == ' ' || r == '\t' || r == '\n'):
+			if open {
+				out = append(out, cur.String())
+				cur.Reset()
+				open = false
+			}
+		default:
+			cur.WriteRune(r)
+			open = true
+		}
+	}
+	if open {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// ParseCommandDuration reads a leading duration such as "30m", "2h" or
+// "in 1h30m" from args and returns it with the remaining text.
+func ParseCommandDuration(args string) (time.Duration, string, error) {
+	fields := strings.Fields(args)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "in") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return 0, "", errors.New("missing duration")
+	}
+	d, err := time.ParseDuration(fields[0])
+	if err != nil || d <= 0 {
+		return 0, "", errors.New("invalid duration")
+	}
+	rest := strings.Join(fields[1:], " ")
+	if strings.HasPrefix(strings.ToLower(rest), "to ") {
+		rest = rest[3:]
+	}
+	return d, strings.TrimSpace(rest), nil
+}
@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gochat/internal/ws"
+
+	"github.com/gocql/gocql"
+)
+
+// Disappearing messages are written with a TTL of the room's timer, so Scylla
+// drops them on its own; the service only tells open clients when to remove
+// them, through a due queue the leader's scheduler works off like scheduled
+// messages.
+
+const (
+	minDisappearing = 5 * time.Second
+	maxDisappearing = 7 * 24 * time.Hour
+)
+
+func disappearingAfter(room *Room) time.Duration {
+	if room.DisappearingSeconds == nil || *room.DisappearingSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(*room.DisappearingSeconds) * time.Second
+}
+
+// messageTTL is the TTL to write a new message in room with: the shorter of
+// the retention policy and the disappearing timer, zero for none, and
+// whether the timer set it. A legal hold suspends retention only; senders
+// in a room with a timer expect their messages to disappear.
+func (s *Service) messageTTL(room *Room) (ttl time.Duration, disappearing bool) {
+	ttl = s.retentionTTL(room)
+	if d := disappearingAfter(room); d > 0 && (ttl == 0 || d < ttl) {
+		return d, true
+	}
+	return ttl, false
+}
+
+// SetDisappearing sets the room's disappearing-message timer; 0 turns it off.
+// Any participant may change it in a DM, room admins elsewhere. The change is
+// announced with a system message.
+func (s *Service) SetDisappearing(roomID, userID gocql.UUID, seconds int) (*Room, error) {
+	room, err := s.writableRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Kind == RoomKindDM || room.Kind == RoomKindGroupDM {
+		ok, err := s.Repo.IsParticipant(roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("forbidden")
+		}
+	} else if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+
+	d := time.Duration(seconds) * time.Second
+	if seconds < 0 || (d > 0 && (d < minDisappearing || d > maxDisappearing)) {
+		return nil, errors.New("invalid disappearing timer")
+	}
+	if disappearingAfter(room) == d {
+		return room, nil
+	}
+
+	if err := s.Repo.UpdateRoomSettings(roomID, RoomSettings{DisappearingSeconds: &seconds}, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	room.DisappearingSeconds = &seconds
+
+	text := "turned off disappearing messages"
+	if d > 0 {
+		text = "set disappearing messages to " + formatTimer(d)
+	}
+	if err := s.postSystemMessage(room, userID, text); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// postSystemMessage stores and broadcasts a notice of actor's action,
+// authored by SystemUserID. It is kept for the room's retention period
+// rather than its disappearing timer.
+func (s *Service) postSystemMessage(room *Room, actor gocql.UUID, text string) error {
+	msgID := gocql.TimeUUID()
+	msg := Message{
+		RoomID:    room.RoomID,
+		MsgID:     msgID,
+		UserID:    SystemUserID,
+		ActorID:   &actor,
+		Content:   text,
+		CreatedAt: msgID.Time().UTC(),
+		Kind:      MessageKindSystem,
+	}
+	if err := s.Repo.InsertMessage(&msg, s.retentionTTL(room)); err != nil {
+		return err
+	}
+	posted := &PostedMessage{Message: msg, Username: systemUsername}
+	s.publish(ws.NewServerEvent("message.created", "server", msg.RoomID.String(), posted.EventPayload()))
+	return nil
+}
+
+// scheduleExpiry queues message.expired for a disappearing message. The
+// scheduler on the leader announces it once Scylla has dropped the message
+// (expireDue); clients should still honour expiresAt, since the notice can
+// trail it by a tick.
+func (s *Service) scheduleExpiry(m *Message) {
+	if m.ExpiresAt == nil || !m.Disappearing {
+		return
+	}
+	if err := s.Repo.InsertExpiryDue(m); err != nil {
+		log.Printf("⚠️ queue expiry of message %s: %v", m.MsgID, err)
+	}
+}
+
+// expireDue announces the disappearing messages due by now in hours
+// from..now, reporting whether every hour was scanned.
+func (s *Service) expireDue(ctx context.Context, from int64, now time.Time) bool {
+	for h := from; h <= dueHour(now); h++ {
+		entries, err := s.Repo.DueExpiries(h, now)
+		if err != nil {
+			log.Printf("scheduler: expiries of hour %d: %v", h, err)
+			return false
+		}
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return false
+			}
+			m, err := s.Repo.GetMessage(e.RoomID, e.MsgID)
+			switch {
+			case err == gocql.ErrNotFound:
+				s.publish(ws.NewServerEvent("message.expired", "server", e.RoomID.String(), map[string]any{
+					"id":     e.MsgID.String(),
+					"roomId": e.RoomID.String(),
+				}))
+			case err != nil:
+				log.Printf("scheduler: load expiring message %s: %v", e.MsgID, err)
+				continue
+			case m.ExpiresAt != nil:
+				continue // not dropped yet; clocks differ a little
+			}
+			// Gone and announced, or its TTL was cleared and it stays.
+			if err := s.Repo.deleteExpiryDue(e); err != nil {
+				log.Printf("scheduler: clear expiry of %s: %v", e.MsgID, err)
+			}
+		}
+	}
+	return true
+}
+
+type expiryEntry struct {
+	ExpiresAt time.Time
+	MsgID     gocql.UUID
+	RoomID    gocql.UUID
+}
+
+func (r *Repository) InsertExpiryDue(m *Message) error {
+	// Outlive the expiry by the scheduler's lookback so a new leader still
+	// finds it.
+	ttl := time.Until(*m.ExpiresAt) + scheduleLookback*time.Hour
+	return r.Session.Query(
+		`INSERT INTO message_expiry_due (due_hour, expires_at, msg_id, room_id) VALUES (?, ?, ?, ?) USING TTL ?`,
+		dueHour(*m.ExpiresAt), *m.ExpiresAt, m.MsgID, m.RoomID, ttlSeconds(ttl),
+	).Exec()
+}
+
+func (r *Repository) DueExpiries(hour int64, now time.Time) ([]expiryEntry, error) {
+	iter := r.Session.Query(
+		`SELECT expires_at, msg_id, room_id FROM message_expiry_due WHERE due_hour = ? AND expires_at <= ?`,
+		hour, now,
+	).Iter()
+	var out []expiryEntry
+	var e expiryEntry
+	for iter.Scan(&e.ExpiresAt, &e.MsgID, &e.RoomID) {
+		out = append(out, e)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repository) deleteExpiryDue(e expiryEntry) error {
+	return r.Session.Query(
+		`DELETE FROM message_expiry_due WHERE due_hour = ? AND expires_at = ? AND msg_id = ?`,
+		dueHour(e.ExpiresAt), e.ExpiresAt, e.MsgID,
+	).Exec()
+}
+
+func formatTimer(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return plural(int(d/(24*time.Hour)), "day")
+	case d%time.Hour == 0:
+		return plural(int(d/time.Hour), "hour")
+	case d%time.Minute == 0:
+		return plural(int(d/time.Minute), "minute")
+	}
+	return plural(int(d/time.Second), "second")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
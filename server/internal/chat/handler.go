@@ -2,6 +2,9 @@ package chat
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
@@ -18,7 +21,8 @@ import (
 	"gochat/internal/ws"
 )
 
-type AuthValidator func(token string) (userID string, err error)
+// AuthValidator authenticates the token a /ws client connects with.
+type AuthValidator func(token string) (*auth.Principal, error)
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -40,16 +44,53 @@ func NewHandler(s *Service, scylla *gocql.Session, hub *ws.Hub) *Handler {
 	return &Handler{Svc: s, Scylla: scylla, Hub: hub}
 }
 
+// Register mounts the chat routes. Writes API tokens may make with
+// write:messages are marked auth.Scoped; every other write needs
+// manage:rooms.
 func (h *Handler) Register(r *mux.Router) {
 	r.HandleFunc("/rooms", h.CreateRoom).Methods("POST")
 	r.HandleFunc("/rooms", h.ListRooms).Methods("GET")
-	r.HandleFunc("/rooms/{room_id}/messages", h.SendMessage).Methods("POST")
+	r.HandleFunc("/rooms/directory", h.RoomDirectory).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}", h.GetRoom).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}", h.UpdateRoom).Methods("PATCH")
+	r.HandleFunc("/rooms/{room_id}", h.DeleteRoom).Methods("DELETE")
+	r.HandleFunc("/rooms/{room_id}/archive", h.ArchiveRoom).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/unarchive", h.UnarchiveRoom).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/restore", h.RestoreRoom).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/rename", h.RenameRoom).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/join", h.JoinRoom).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/leave", h.LeaveRoom).Methods("POST")
+	r.Handle("/rooms/{room_id}/read", auth.Scoped(auth.ScopeWriteMessages, h.MarkRead)).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/retention", h.PreviewRetention).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}/retention", h.UpdateRetention).Methods("PUT")
+	r.HandleFunc("/rooms/{room_id}/retention/job", h.RetentionJob).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}/disappearing", h.SetDisappearing).Methods("PUT")
+	r.Handle("/rooms/{room_id}/messages", auth.Scoped(auth.ScopeWriteMessages, h.SendMessage)).Methods("POST")
 	r.HandleFunc("/rooms/{room_id}/messages", h.ListMessages).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}/commands", h.ListCommands).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}/commands", h.RegisterCommand).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/commands/{name}", h.DeleteCommand).Methods("DELETE")
+	r.HandleFunc("/rooms/{room_id}/webhooks", h.ListWebhooks).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}/webhooks", h.CreateWebhook).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/webhooks/{hook_id}/rotate", h.RotateWebhook).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/webhooks/{hook_id}", h.RevokeWebhook).Methods("DELETE")
+	r.Handle("/rooms/{room_id}/polls", auth.Scoped(auth.ScopeWriteMessages, h.CreatePoll)).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/polls/{poll_id}", h.GetPoll).Methods("GET")
+	r.Handle("/rooms/{room_id}/polls/{poll_id}/votes", auth.Scoped(auth.ScopeWriteMessages, h.VotePoll)).Methods("POST")
+	r.Handle("/rooms/{room_id}/polls/{poll_id}/close", auth.Scoped(auth.ScopeWriteMessages, h.ClosePoll)).Methods("POST")
+	r.Handle("/rooms/{room_id}/scheduled", auth.Scoped(auth.ScopeWriteMessages, h.CreateScheduled)).Methods("POST")
+	r.HandleFunc("/rooms/{room_id}/scheduled", h.ListScheduled).Methods("GET")
+	r.HandleFunc("/rooms/{room_id}/scheduled/{sched_id}", h.GetScheduled).Methods("GET")
+	r.Handle("/rooms/{room_id}/scheduled/{sched_id}", auth.Scoped(auth.ScopeWriteMessages, h.UpdateScheduled)).Methods("PATCH")
+	r.Handle("/rooms/{room_id}/scheduled/{sched_id}", auth.Scoped(auth.ScopeWriteMessages, h.CancelScheduled)).Methods("DELETE")
+	r.HandleFunc("/dm", h.ListDMs).Methods("GET")
 	r.HandleFunc("/dm/start", h.StartDM).Methods("POST")
+	r.HandleFunc("/dm/{room_id}/members", h.AddDMMembers).Methods("POST")
 	r.HandleFunc("/users", h.ListUsers).Methods("GET")
 
-	r.HandleFunc("/rooms/{room_id}/messages/{msg_id}", h.EditMessage).Methods("PATCH")
-	r.HandleFunc("/rooms/{room_id}/messages/{msg_id}", h.DeleteMessage).Methods("DELETE")
+	r.Handle("/rooms/{room_id}/messages/{msg_id}", auth.Scoped(auth.ScopeWriteMessages, h.EditMessage)).Methods("PATCH")
+	r.HandleFunc("/rooms/{room_id}/messages/{msg_id}/revisions", h.ListRevisions).Methods("GET")
+	r.Handle("/rooms/{room_id}/messages/{msg_id}", auth.Scoped(auth.ScopeWriteMessages, h.DeleteMessage)).Methods("DELETE")
 }
 
 func WSHandler(hub *ws.Hub, validator AuthValidator, logger *zap.Logger, sendQueueSize int) http.HandlerFunc {
@@ -73,11 +114,20 @@ func WSHandler(hub *ws.Hub, validator AuthValidator, logger *zap.Logger, sendQue
 			http.Error(w, "missing token", http.StatusUnauthorized)
 			return
 		}
-		userID, err := validator(token)
-		if err != nil || userID == "" {
+		principal, err := validator(token)
+		if err != nil || principal.UserID == "" {
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
+		if principal.MFASetupRequired {
+			http.Error(w, "two-factor authentication required", http.StatusForbidden)
+			return
+		}
+		if !principal.Can(auth.ScopeReadMessages) {
+			http.Error(w, "token lacks scope "+auth.ScopeReadMessages, http.StatusForbidden)
+			return
+		}
+		userID := principal.UserID
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -91,11 +141,19 @@ func WSHandler(hub *ws.Hub, validator AuthValidator, logger *zap.Logger, sendQue
 		}
 
 		client := ws.NewClient(conn, userID, hub, sendQueueSize)
+		client.ReadOnly = !principal.Can(auth.ScopeWriteMessages)
+		client.Scopes = principal.Scopes
+		client.SessionID = principal.SessionID
 		hub.RegisterClient(client)
 		go client.WritePump()
 		go client.ReadPump()
 
 		if roomID := r.URL.Query().Get("room_id"); roomID != "" {
+			if hub.ResolveRoom != nil {
+				if id, ok := hub.ResolveRoom(roomID); ok {
+					roomID = id
+				}
+			}
 			if hub.CanJoin == nil || hub.CanJoin(roomID, userID) {
 				hub.Subscribe(client, roomID)
 			} else {
@@ -141,14 +199,51 @@ func (h *Handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	utils.JSONResponse(w, http.StatusCreated, resp)
 }
 
+// ListRooms returns the caller's rooms sorted by last activity. The cursor for
+// the next page is returned in the X-Next-Cursor header.
 func (h *Handler) ListRooms(w http.ResponseWriter, r *http.Request) {
+	uidStr := auth.GetUserID(r)
+	if uidStr == "" {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	uid, err := gocql.ParseUUID(uidStr)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	limit := 50
+	if q := r.URL.Query().Get("limit"); q != "" {
+		if v, err := strconv.Atoi(q); err == nil {
+			limit = v
+		}
+	}
+	includeArchived := r.URL.Query().Get("include_archived") == "1"
+	rooms, next, err := h.Svc.ListRooms(uid, limit, r.URL.Query().Get("cursor"), includeArchived)
+	if err != nil {
+		if strings.Contains(err.Error(), "cursor") {
+			utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	utils.JSONResponse(w, http.StatusOK, rooms)
+}
+
+// RoomDirectory lists public rooms anyone can join, optionally those whose
+// name starts with ?q=.
+func (h *Handler) RoomDirectory(w http.ResponseWriter, r *http.Request) {
 	limit := 50
 	if q := r.URL.Query().Get("limit"); q != "" {
 		if v, err := strconv.Atoi(q); err == nil {
 			limit = v
 		}
 	}
-	rooms, err := h.Svc.ListRooms(limit)
+	rooms, err := h.Svc.DirectoryRooms(r.URL.Query().Get("q"), limit)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
@@ -156,6 +251,292 @@ func (h *Handler) ListRooms(w http.ResponseWriter, r *http.Request) {
 	utils.JSONResponse(w, http.StatusOK, rooms)
 }
 
+func (h *Handler) JoinRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Svc.JoinRoom(roomID, uid); err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "joined"})
+}
+
+func (h *Handler) LeaveRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Svc.LeaveRoom(roomID, uid); err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "left"})
+}
+
+func (h *Handler) MarkRead(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req MarkReadRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	var msgID *gocql.UUID
+	if req.MsgID != "" {
+		id, err := gocql.ParseUUID(req.MsgID)
+		if err != nil {
+			utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+			return
+		}
+		msgID = &id
+	}
+	if err := h.Svc.MarkRead(roomID, uid, msgID); err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GetRoom returns a room by id or slug. When addressed by a former slug the
+// response carries the current slug so clients can redirect.
+func (h *Handler) GetRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Svc.EnsureMemberOrPublic(roomID, uid); err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	room, err := h.Svc.Repo.GetRoom(roomID)
+	if err == gocql.ErrNotFound {
+		utils.JSONResponse(w, http.StatusNotFound, map[string]string{"error": "room not found"})
+		return
+	}
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	ref := mux.Vars(r)["room_id"]
+	if _, err := gocql.ParseUUID(ref); err != nil && room.Slug != "" && !strings.EqualFold(ref, room.Slug) {
+		w.Header().Set("Content-Location", "/api/chat/rooms/"+room.Slug)
+		utils.JSONResponse(w, http.StatusOK, map[string]any{"room": room, "redirectFrom": ref})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]any{"room": room})
+}
+
+func (h *Handler) RenameRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req RenameRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	room, err := h.Svc.RenameRoom(roomID, uid, req)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	h.emitRoomUpdated(room)
+	utils.JSONResponse(w, http.StatusOK, room)
+}
+
+func (h *Handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req UpdateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	room, err := h.Svc.UpdateRoom(roomID, uid, req)
+	h.writeRoomLifecycle(w, room, err)
+}
+
+func (h *Handler) ArchiveRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	room, err := h.Svc.SetArchived(roomID, uid, true)
+	h.writeRoomLifecycle(w, room, err)
+}
+
+func (h *Handler) UnarchiveRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	room, err := h.Svc.SetArchived(roomID, uid, false)
+	h.writeRoomLifecycle(w, room, err)
+}
+
+func (h *Handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	room, err := h.Svc.DeleteRoom(roomID, uid)
+	h.writeRoomLifecycle(w, room, err)
+}
+
+func (h *Handler) RestoreRoom(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	room, err := h.Svc.RestoreRoom(roomID, uid)
+	h.writeRoomLifecycle(w, room, err)
+}
+
+func (h *Handler) UpdateRetention(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req UpdateRetentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	room, job, err := h.Svc.UpdateRetention(roomID, uid, req)
+	if err != nil || job == nil {
+		h.writeRoomLifecycle(w, room, err)
+		return
+	}
+	// Existing messages keep expiring until the job has cleared their TTLs.
+	h.emitRoomUpdated(room)
+	utils.JSONResponse(w, http.StatusAccepted, map[string]any{"room": room, "ttlJob": job})
+}
+
+// RetentionJob reports the room's latest TTL-clearing job.
+func (h *Handler) RetentionJob(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	job, err := h.Svc.RetentionJob(roomID, uid)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, job)
+}
+
+func (h *Handler) SetDisappearing(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req SetDisappearingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	room, err := h.Svc.SetDisappearing(roomID, uid, req.Seconds)
+	h.writeRoomLifecycle(w, room, err)
+}
+
+// PreviewRetention is a dry run of the retention worker for one room.
+func (h *Handler) PreviewRetention(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	rep, err := h.Svc.PreviewRetention(roomID, uid)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, rep)
+}
+
+func (h *Handler) writeRoomLifecycle(w http.ResponseWriter, room *Room, err error) {
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	h.emitRoomUpdated(room)
+	utils.JSONResponse(w, http.StatusOK, room)
+}
+
+func (h *Handler) emitRoomUpdated(room *Room) {
+	if room == nil {
+		return
+	}
+	h.Svc.publish(roomUpdatedEvent(room))
+}
+
+func roomUpdatedEvent(room *Room) ws.Event {
+	payload := map[string]any{
+		"roomId":      room.RoomID.String(),
+		"name":        room.Name,
+		"slug":        room.Slug,
+		"topic":       room.Topic,
+		"description": room.Description,
+		"avatarUrl":   room.AvatarURL,
+		"archived":    room.ArchivedAt != nil,
+		"deleted":     room.DeletedAt != nil,
+	}
+	if room.DisappearingSeconds != nil {
+		payload["disappearingSeconds"] = *room.DisappearingSeconds
+	}
+	return ws.NewServerEvent("room.updated", "server", room.RoomID.String(), payload)
+}
+
+func roomErrorStatus(err error) int {
+	switch {
+	case err == ErrRoomNotFound || err == gocql.ErrNotFound || strings.HasSuffix(err.Error(), "not found"):
+		return http.StatusNotFound
+	case err == ErrRoomArchived || err == ErrSlugTaken || err == ErrPollClosed:
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "forbidden"):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// roomFromPath resolves the {room_id} path variable, which may be a UUID or a slug.
+func (h *Handler) roomFromPath(r *http.Request) (gocql.UUID, error) {
+	return h.Svc.ResolveRoom(mux.Vars(r)["room_id"])
+}
+
+// tokenScopes returns the caller's API token scopes, nil for a user session.
+func tokenScopes(r *http.Request) []string {
+	if p := auth.GetPrincipal(r); p != nil {
+		return p.Scopes
+	}
+	return nil
+}
+
+// userAndRoom parses the caller and the {room_id} path variable, writing an
+// error response and returning ok=false if either is missing or malformed.
+func (h *Handler) userAndRoom(w http.ResponseWriter, r *http.Request) (gocql.UUID, gocql.UUID, bool) {
+	uidStr := auth.GetUserID(r)
+	if uidStr == "" {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return gocql.UUID{}, gocql.UUID{}, false
+	}
+	uid, err := gocql.ParseUUID(uidStr)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return gocql.UUID{}, gocql.UUID{}, false
+	}
+	roomID, err := h.roomFromPath(r)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
+		return gocql.UUID{}, gocql.UUID{}, false
+	}
+	return uid, roomID, true
+}
+
 func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 	uidStr := auth.GetUserID(r)
 	if uidStr == "" {
@@ -169,39 +550,41 @@ func (h *Handler) SendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vars := mux.Vars(r)
-	roomIDStr := vars["room_id"]
-	roomID, err := gocql.ParseUUID(roomIDStr)
-
+	roomID, err := h.roomFromPath(r)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
 		return
 	}
 
-	if err := h.Svc.EnsureMemberOrPublic(roomID, uid); err != nil {
-		utils.JSONResponse(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
-		return
-	}
 	var req SendMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
 		return
 	}
 
-	resp, err := h.Svc.SendMessage(roomID, uid, req)
+	if req.TempID == "" {
+		req.TempID = r.Header.Get("Idempotency-Key")
+	}
+
+	resp, err := h.Svc.SendMessage(r.Context(), roomID, uid, tokenScopes(r), req)
 	if err != nil {
-		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	if resp.Replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+		utils.JSONResponse(w, http.StatusOK, resp)
+		return
+	}
+	if resp.MsgID == "" {
+		// an ephemeral slash command response; nothing was stored
+		utils.JSONResponse(w, http.StatusOK, resp)
 		return
 	}
 	utils.JSONResponse(w, http.StatusCreated, resp)
 }
 
 func (h *Handler) ListMessages(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	roomIDStr := vars["room_id"]
-
-	roomID, err := gocql.ParseUUID(roomIDStr)
-
 	uidStr := auth.GetUserID(r)
 	if strings.TrimSpace(uidStr) == "" {
 		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
@@ -212,41 +595,54 @@ func (h *Handler) ListMessages(w http.ResponseWriter, r *http.Request) {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
 		return
 	}
-	// allow if participant OR room has no participants (public)
+	roomID, err := h.roomFromPath(r)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
+		return
+	}
+	// allow if participant OR room is public
 	if err := h.Svc.EnsureMemberOrPublic(roomID, uid); err != nil {
 		utils.JSONResponse(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
 		return
 	}
 
-	if err != nil {
-
-		if h.Scylla == nil {
-			utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
-			return
-		}
-		var resolved gocql.UUID
-		const q = `SELECT id FROM rooms WHERE slug = ? LIMIT 1`
-		if err2 := h.Scylla.Query(q, roomIDStr).WithContext(r.Context()).Scan(&resolved); err2 != nil {
-			utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
-			return
-		}
-		roomID = resolved
-	}
-
 	limit := 50
 	if q := r.URL.Query().Get("limit"); q != "" {
 		if v, err := strconv.Atoi(q); err == nil {
 			limit = v
 		}
 	}
-	before := r.URL.Query().Get("before")
+	qs := r.URL.Query()
+	before := qs.Get("before")
 
-	msgs, err := h.Svc.GetMessages(roomID, limit, before)
+	// Plain ?before=<msgId> keeps returning a bare array for existing
+	// clients; the other modes and opaque cursors return a MessagePage.
+	if qs.Get("after") == "" && qs.Get("around") == "" && qs.Get("at") == "" && !IsMessageCursor(before) {
+		msgs, err := h.Svc.GetMessages(roomID, limit, before)
+		if err != nil {
+			utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		utils.JSONResponse(w, http.StatusOK, msgs)
+		return
+	}
+
+	page, err := h.Svc.PageMessages(roomID, MessageQuery{
+		Limit:  limit,
+		Before: before,
+		After:  qs.Get("after"),
+		Around: qs.Get("around"),
+		At:     qs.Get("at"),
+	})
 	if err != nil {
-		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
 		return
 	}
-	utils.JSONResponse(w, http.StatusOK, msgs)
+	utils.JSONResponse(w, http.StatusOK, page)
 }
 
 func (h *Handler) EditMessage(w http.ResponseWriter, r *http.Request) {
@@ -261,7 +657,7 @@ func (h *Handler) EditMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	vars := mux.Vars(r)
-	roomID, err := gocql.ParseUUID(vars["room_id"])
+	roomID, err := h.roomFromPath(r)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
 		return
@@ -272,11 +668,6 @@ func (h *Handler) EditMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.Svc.EnsureMemberOrPublic(roomID, uid); err != nil {
-		utils.JSONResponse(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
-		return
-	}
-
 	var req EditMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
@@ -288,23 +679,13 @@ func (h *Handler) EditMessage(w http.ResponseWriter, r *http.Request) {
 		status := http.StatusBadRequest
 		if strings.Contains(err.Error(), "forbidden") {
 			status = http.StatusForbidden
-		} else if strings.Contains(err.Error(), "expired") {
+		} else if strings.Contains(err.Error(), "expired") || err == ErrRoomArchived {
 			status = http.StatusConflict
 		}
 		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
 		return
 	}
 
-	if h.Hub != nil {
-		ev := ws.NewServerEvent("message.updated", "server", res.RoomID, map[string]any{
-			"id":       res.MsgID,
-			"roomId":   res.RoomID,
-			"content":  res.Content,
-			"editedAt": res.EditedAt.Format(time.RFC3339Nano),
-		})
-		h.Hub.EmitSystem(ev)
-	}
-
 	utils.JSONResponse(w, http.StatusOK, res)
 }
 
@@ -320,7 +701,7 @@ func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	vars := mux.Vars(r)
-	roomID, err := gocql.ParseUUID(vars["room_id"])
+	roomID, err := h.roomFromPath(r)
 	if err != nil {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
 		return
@@ -330,11 +711,6 @@ func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
 		return
 	}
-	if err := h.Svc.EnsureMemberOrPublic(roomID, uid); err != nil {
-		utils.JSONResponse(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
-		return
-	}
-
 	var req DeleteMessageRequest
 	_ = json.NewDecoder(r.Body).Decode(&req)
 	if req.Reason == "" {
@@ -346,37 +722,378 @@ func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		status := http.StatusBadRequest
 		if strings.Contains(err.Error(), "forbidden") {
 			status = http.StatusForbidden
+		} else if err == ErrRoomArchived {
+			status = http.StatusConflict
 		}
 		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
 		return
 	}
 
-	if h.Hub != nil {
-		payload := map[string]any{
-			"id":        res.MsgID,
-			"roomId":    res.RoomID,
-			"deletedAt": res.DeletedAt.Format(time.RFC3339Nano),
-			"deletedBy": res.DeletedBy,
+	utils.JSONResponse(w, http.StatusOK, res)
+}
+
+// ListRevisions returns a message's edit history (?diff=1 adds word diffs).
+// Only the author and room moderators may see it.
+func (h *Handler) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	msgID, err := gocql.ParseUUID(mux.Vars(r)["msg_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+		return
+	}
+	res, err := h.Svc.GetRevisions(roomID, msgID, uid, r.URL.Query().Get("diff") == "1")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "forbidden") {
+			status = http.StatusForbidden
+		} else if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
 		}
-		if res.DeletedReason != nil {
-			payload["deletedReason"] = *res.DeletedReason
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, res)
+}
+
+// ListCommands serves slash command autocomplete: ?prefix=to matches /topic.
+func (h *Handler) ListCommands(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Svc.ListCommands(roomID, uid, r.URL.Query().Get("prefix"))
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+func (h *Handler) RegisterCommand(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req RegisterCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	cmd, err := h.Svc.RegisterRoomCommand(roomID, uid, req)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusCreated, cmd)
+}
+
+func (h *Handler) DeleteCommand(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Svc.DeleteRoomCommand(roomID, uid, mux.Vars(r)["name"]); err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// RegisterHooks mounts the unauthenticated incoming webhook endpoint; the
+// token in the path is the credential.
+func (h *Handler) RegisterHooks(r *mux.Router) {
+	r.HandleFunc("/hooks/{hook_id}/{token}", h.IncomingWebhook).Methods("POST")
+}
+
+// webhookURL is the absolute URL a webhook is called at.
+func webhookURL(r *http.Request, hook *Webhook) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/hooks/%s/%s", scheme, r.Host, hook.HookID, hook.Token)
+}
+
+func (h *Handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	hooks, err := h.Svc.ListWebhooks(roomID, uid)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, hooks)
+}
+
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	hook, err := h.Svc.CreateWebhook(roomID, uid, req)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	hook.URL = webhookURL(r, hook)
+	utils.JSONResponse(w, http.StatusCreated, hook)
+}
+
+func (h *Handler) RotateWebhook(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	hookID, err := gocql.ParseUUID(mux.Vars(r)["hook_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid webhook id"})
+		return
+	}
+	hook, err := h.Svc.RotateWebhook(roomID, hookID, uid)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	hook.URL = webhookURL(r, hook)
+	utils.JSONResponse(w, http.StatusOK, hook)
+}
+
+func (h *Handler) RevokeWebhook(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	hookID, err := gocql.ParseUUID(mux.Vars(r)["hook_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid webhook id"})
+		return
+	}
+	if err := h.Svc.RevokeWebhook(roomID, hookID, uid); err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+// IncomingWebhook accepts a JSON body, or Slack's form-encoded payload=...
+func (h *Handler) IncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	hookID, err := gocql.ParseUUID(mux.Vars(r)["hook_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusNotFound, map[string]string{"error": "webhook not found"})
+		return
+	}
+	body := io.LimitReader(r.Body, 64<<10)
+	var req IncomingWebhookRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		r.Body = io.NopCloser(body)
+		if err = r.ParseForm(); err == nil {
+			err = json.Unmarshal([]byte(r.PostForm.Get("payload")), &req)
 		}
-		ev := ws.NewServerEvent("message.deleted", "server", res.RoomID, payload)
-		h.Hub.EmitSystem(ev)
+	} else {
+		err = json.NewDecoder(body).Decode(&req)
+	}
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+
+	posted, err := h.Svc.PostWebhookMessage(r.Context(), hookID, mux.Vars(r)["token"], req)
+	var limited *RateLimitError
+	switch {
+	case errors.As(err, &limited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(limited.RetryAfter.Seconds())+1))
+		utils.JSONResponse(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
 	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "ok", "msgId": posted.MsgID.String()})
+}
 
+func (h *Handler) CreatePoll(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req CreatePollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	posted, err := h.Svc.CreatePoll(r.Context(), roomID, uid, req)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusCreated, posted.EventPayload())
+}
+
+func (h *Handler) GetPoll(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, pollID, ok := h.userRoomAndPoll(w, r)
+	if !ok {
+		return
+	}
+	res, err := h.Svc.GetPoll(roomID, pollID, uid)
+	writePollResults(w, res, err)
+}
+
+func (h *Handler) VotePoll(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, pollID, ok := h.userRoomAndPoll(w, r)
+	if !ok {
+		return
+	}
+	var req VoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	res, err := h.Svc.Vote(roomID, pollID, uid, req.Options)
+	writePollResults(w, res, err)
+}
+
+func (h *Handler) ClosePoll(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, pollID, ok := h.userRoomAndPoll(w, r)
+	if !ok {
+		return
+	}
+	res, err := h.Svc.ClosePoll(roomID, pollID, uid)
+	writePollResults(w, res, err)
+}
+
+func writePollResults(w http.ResponseWriter, res *PollResults, err error) {
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
 	utils.JSONResponse(w, http.StatusOK, res)
 }
 
+func (h *Handler) userRoomAndPoll(w http.ResponseWriter, r *http.Request) (gocql.UUID, gocql.UUID, gocql.UUID, bool) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return uid, roomID, gocql.UUID{}, false
+	}
+	pollID, err := gocql.ParseUUID(mux.Vars(r)["poll_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid poll id"})
+		return uid, roomID, gocql.UUID{}, false
+	}
+	return uid, roomID, pollID, true
+}
+
+func (h *Handler) CreateScheduled(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	var req CreateScheduledRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	sm, err := h.Svc.ScheduleMessage(roomID, uid, tokenScopes(r), req)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusCreated, sm)
+}
+
+func (h *Handler) ListScheduled(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Svc.ListScheduled(roomID, uid)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+func (h *Handler) GetScheduled(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, schedID, ok := h.userRoomAndScheduled(w, r)
+	if !ok {
+		return
+	}
+	sm, err := h.Svc.GetScheduled(roomID, uid, schedID)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, sm)
+}
+
+func (h *Handler) UpdateScheduled(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, schedID, ok := h.userRoomAndScheduled(w, r)
+	if !ok {
+		return
+	}
+	var req UpdateScheduledRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	sm, err := h.Svc.UpdateScheduled(roomID, uid, schedID, tokenScopes(r), req)
+	if err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, sm)
+}
+
+func (h *Handler) CancelScheduled(w http.ResponseWriter, r *http.Request) {
+	uid, roomID, schedID, ok := h.userRoomAndScheduled(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Svc.CancelScheduled(roomID, uid, schedID); err != nil {
+		utils.JSONResponse(w, roomErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "cancelled"})
+}
+
+func (h *Handler) userRoomAndScheduled(w http.ResponseWriter, r *http.Request) (gocql.UUID, gocql.UUID, gocql.UUID, bool) {
+	uid, roomID, ok := h.userAndRoom(w, r)
+	if !ok {
+		return uid, roomID, gocql.UUID{}, false
+	}
+	schedID, err := gocql.ParseUUID(mux.Vars(r)["sched_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid scheduled message id"})
+		return uid, roomID, gocql.UUID{}, false
+	}
+	return uid, roomID, schedID, true
+}
+
 type startDMReq struct {
-	PeerID string `json:"peerId"`
+	PeerID  string   `json:"peerId"`
+	PeerIDs []string `json:"peerIds"`
 }
 
 type startDMRes struct {
-	RoomID       string `json:"roomId"`
-	Created      bool   `json:"created"`
-	PeerId       string `json:"peerId"`
-	PeerUsername string `json:"peerUsername"`
+	RoomID       string          `json:"roomId"`
+	Created      bool            `json:"created"`
+	PeerId       string          `json:"peerId,omitempty"`
+	PeerUsername string          `json:"peerUsername,omitempty"`
+	Participants []DMParticipant `json:"participants,omitempty"`
+}
+
+type addDMMembersReq struct {
+	UserIDs []string `json:"userIds"`
 }
 
 func (h *Handler) StartDM(w http.ResponseWriter, r *http.Request) {
@@ -392,12 +1109,16 @@ func (h *Handler) StartDM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 2) who am I trying to DM (peer)?
+	// 2) who am I trying to DM (peer, or peers for a group)?
 	var req startDMReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "bad request"})
 		return
 	}
+	if len(req.PeerIDs) > 0 {
+		h.startGroupDM(w, r, me, req.PeerIDs)
+		return
+	}
 	if req.PeerID == "" {
 		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "peerId required"})
 		return
@@ -421,13 +1142,7 @@ func (h *Handler) StartDM(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 4) optional: fetch peer's username for UI header
-	var peerName string
-	if err := h.Scylla.
-		Query(`SELECT username FROM users WHERE id = ? LIMIT 1`, peer).
-		WithContext(r.Context()).
-		Scan(&peerName); err != nil && err != gocql.ErrNotFound {
-		// if query failed for some other reason, you can log it; keep peerName empty
-	}
+	peerName, _ := h.Svc.Repo.GetUsername(peer)
 
 	// 5) respond
 	utils.JSONResponse(w, http.StatusOK, startDMRes{
@@ -438,6 +1153,106 @@ func (h *Handler) StartDM(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (h *Handler) startGroupDM(w http.ResponseWriter, r *http.Request, me gocql.UUID, peerIDs []string) {
+	peers, ok := parseUUIDs(peerIDs)
+	if !ok {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid peer id"})
+		return
+	}
+	roomID, created, err := h.Svc.EnsureGroupDM(r.Context(), me, peers)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	h.writeDMResult(w, me, roomID, created)
+}
+
+// AddDMMembers adds people to a DM, which yields the DM of the enlarged group.
+func (h *Handler) AddDMMembers(w http.ResponseWriter, r *http.Request) {
+	uidStr := auth.GetUserID(r)
+	if uidStr == "" {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	me, err := gocql.ParseUUID(uidStr)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	roomID, err := h.roomFromPath(r)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
+		return
+	}
+	var req addDMMembersReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	add, ok := parseUUIDs(req.UserIDs)
+	if !ok {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+
+	newRoomID, created, err := h.Svc.AddDMParticipants(r.Context(), me, roomID, add)
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "forbidden") {
+			status = http.StatusForbidden
+		}
+		utils.JSONResponse(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	h.writeDMResult(w, me, newRoomID, created)
+}
+
+func (h *Handler) writeDMResult(w http.ResponseWriter, me, roomID gocql.UUID, created bool) {
+	res := startDMRes{RoomID: roomID.String(), Created: created}
+	if dm, err := h.Svc.Repo.GetDMByUser(me, roomID); err == nil && dm != nil {
+		for _, p := range dm.Participants {
+			if p == me {
+				continue
+			}
+			name, _ := h.Svc.Repo.GetUsername(p)
+			res.Participants = append(res.Participants, DMParticipant{ID: p.String(), Username: name})
+		}
+	}
+	utils.JSONResponse(w, http.StatusOK, res)
+}
+
+// ListDMs returns the caller's 1:1 and group DMs with a last-message preview.
+func (h *Handler) ListDMs(w http.ResponseWriter, r *http.Request) {
+	uidStr := auth.GetUserID(r)
+	if uidStr == "" {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	me, err := gocql.ParseUUID(uidStr)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	dms, err := h.Svc.ListDMs(r.Context(), me)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, dms)
+}
+
+func parseUUIDs(in []string) ([]gocql.UUID, bool) {
+	out := make([]gocql.UUID, 0, len(in))
+	for _, s := range in {
+		id, err := gocql.ParseUUID(s)
+		if err != nil {
+			return nil, false
+		}
+		out = append(out, id)
+	}
+	return out, true
+}
+
 // ListUsers returns a basic directory of users (id, username).
 // Requires a valid JWT; excludes the caller from the list.
 // ListUsers returns all users (except the current one) with id + username.
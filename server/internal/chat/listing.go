@@ -0,0 +1,244 @@
+package chat
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Room lists are served from two index tables (migration 024) rather than
+// by loading every room:
+//
+//   - room_activity_by_user orders a member's rooms by last activity. Each
+//     membership carries its current activity_id; moving it writes the new
+//     index row and deletes the old one. Rows a race left behind no longer
+//     match the membership and are skipped and removed when read.
+//   - public_rooms files listed public channels under their lower-cased
+//     name. The rooms table methods that change name, visibility, archive
+//     or delete state refile the room.
+
+// directoryShard is the one public_rooms partition in use.
+const directoryShard = 0
+
+// setActivity moves userID's membership of roomID to activity at. old is the
+// activity row it had, if any.
+func (r *Repository) setActivity(userID, roomID gocql.UUID, old *gocql.UUID, at time.Time) error {
+	id := gocql.UUIDFromTime(at)
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	if old != nil {
+		b.Query(`DELETE FROM room_activity_by_user WHERE user_id = ? AND activity_id = ?`, userID, *old)
+	}
+	b.Query(`INSERT INTO room_activity_by_user (user_id, activity_id, room_id) VALUES (?, ?, ?)`,
+		userID, id, roomID)
+	b.Query(`UPDATE rooms_by_user SET activity_id = ? WHERE user_id = ? AND room_id = ?`, id, userID, roomID)
+	b.Query(`UPDATE room_participants SET activity_id = ? WHERE room_id = ? AND user_id = ?`, id, roomID, userID)
+	return r.Session.ExecuteBatch(b)
+}
+
+// membershipActivity returns the activity row of userID's membership of
+// roomID, nil when there is none.
+func (r *Repository) membershipActivity(userID, roomID gocql.UUID) (*gocql.UUID, error) {
+	var id *gocql.UUID
+	err := r.Session.Query(`SELECT activity_id FROM rooms_by_user WHERE user_id = ? AND room_id = ?`,
+		userID, roomID).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	return id, err
+}
+
+// queueFanOut schedules fanOutActivity for roomID. One fan-out runs per room
+// at a time; messages arriving meanwhile only raise the activity it applies
+// next, so a busy room costs a pass per burst rather than per message.
+func (r *Repository) queueFanOut(roomID gocql.UUID, at time.Time) {
+	r.fanOutMu.Lock()
+	defer r.fanOutMu.Unlock()
+	if r.fanOuts == nil {
+		r.fanOuts = make(map[gocql.UUID]time.Time)
+	}
+	pending, running := r.fanOuts[roomID]
+	if !running || at.After(pending) {
+		r.fanOuts[roomID] = at
+	}
+	if !running {
+		go r.runFanOut(roomID)
+	}
+}
+
+func (r *Repository) runFanOut(roomID gocql.UUID) {
+	var done time.Time
+	for {
+		r.fanOutMu.Lock()
+		at := r.fanOuts[roomID]
+		if !at.After(done) {
+			delete(r.fanOuts, roomID)
+			r.fanOutMu.Unlock()
+			return
+		}
+		r.fanOutMu.Unlock()
+		if err := r.fanOutActivity(roomID, at); err != nil {
+			log.Printf("⚠️ room %s activity fan-out: %v", roomID, err)
+		}
+		done = at
+	}
+}
+
+// fanOutActivity moves every member of roomID whose activity is older than
+// at up to at. It costs a write per member, paid after each burst of
+// messages so that reading a room list costs a page.
+func (r *Repository) fanOutActivity(roomID gocql.UUID, at time.Time) error {
+	iter := r.Session.Query(`SELECT user_id, activity_id FROM room_participants WHERE room_id = ?`, roomID).Iter()
+	var (
+		userID gocql.UUID
+		old    *gocql.UUID
+	)
+	for iter.Scan(&userID, &old) {
+		if old != nil && !old.Time().Before(at) {
+			continue
+		}
+		if err := r.setActivity(userID, roomID, old, at); err != nil {
+			iter.Close()
+			return err
+		}
+		old = nil
+	}
+	return iter.Close()
+}
+
+// ActivityEntry is one row of a member's activity index.
+type ActivityEntry struct {
+	ID     gocql.UUID
+	RoomID gocql.UUID
+}
+
+// ListActivity returns up to limit of userID's index rows, newest first,
+// after the row before when it is non-nil.
+func (r *Repository) ListActivity(userID gocql.UUID, before *gocql.UUID, limit int) ([]ActivityEntry, error) {
+	q := r.Session.Query(`SELECT activity_id, room_id FROM room_activity_by_user WHERE user_id = ? LIMIT ?`,
+		userID, limit)
+	if before != nil {
+		q = r.Session.Query(`SELECT activity_id, room_id FROM room_activity_by_user
+		                     WHERE user_id = ? AND activity_id < ? LIMIT ?`, userID, *before, limit)
+	}
+	iter := q.Iter()
+	var out []ActivityEntry
+	var e ActivityEntry
+	for iter.Scan(&e.ID, &e.RoomID) {
+		out = append(out, e)
+	}
+	return out, iter.Close()
+}
+
+func (r *Repository) DeleteActivity(userID, activityID gocql.UUID) error {
+	return r.Session.Query(`DELETE FROM room_activity_by_user WHERE user_id = ? AND activity_id = ?`,
+		userID, activityID).Exec()
+}
+
+// GetMembership returns userID's rooms_by_user row for roomID.
+func (r *Repository) GetMembership(userID, roomID gocql.UUID) (*Membership, error) {
+	m := Membership{UserID: userID, RoomID: roomID}
+	err := r.Session.Query(
+		`SELECT member_role, joined_at, last_read_msg_id, activity_id FROM rooms_by_user WHERE user_id = ? AND room_id = ?`,
+		userID, roomID,
+	).Scan(&m.Role, &m.JoinedAt, &m.LastReadMsgID, &m.ActivityID)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// directoryListed reports whether room belongs in the public directory.
+func (r *Repository) directoryListed(room *Room) (bool, error) {
+	if room.Kind != "" && room.Kind != RoomKindChannel {
+		return false, nil
+	}
+	if room.Kind == "" && room.Name == "dm" {
+		return false, nil // DMs created before rooms had a kind
+	}
+	if room.ArchivedAt != nil || room.DeletedAt != nil {
+		return false, nil
+	}
+	return r.IsRoomPublic(room)
+}
+
+// SyncDirectory files the room in public_rooms under its current name, or
+// removes it when it should not be listed.
+func (r *Repository) SyncDirectory(roomID gocql.UUID) error {
+	room, err := r.GetRoom(roomID)
+	if err == gocql.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var filed *string
+	if err := r.Session.Query(`SELECT directory_key FROM rooms WHERE room_id = ?`, roomID).Scan(&filed); err != nil {
+		return err
+	}
+	listed, err := r.directoryListed(room)
+	if err != nil {
+		return err
+	}
+	key := strings.ToLower(room.Name)
+	if filed != nil && (!listed || *filed != key) {
+		if err := r.Session.Query(`DELETE FROM public_rooms WHERE shard = ? AND name_key = ? AND room_id = ?`,
+			directoryShard, *filed, roomID).Exec(); err != nil {
+			return err
+		}
+	}
+	if !listed {
+		if filed == nil {
+			return nil
+		}
+		return r.Session.Query(`UPDATE rooms SET directory_key = null WHERE room_id = ?`, roomID).Exec()
+	}
+	if err := r.Session.Query(`INSERT INTO public_rooms (shard, name_key, room_id) VALUES (?, ?, ?)`,
+		directoryShard, key, roomID).Exec(); err != nil {
+		return err
+	}
+	return r.Session.Query(`UPDATE rooms SET directory_key = ? WHERE room_id = ?`, key, roomID).Exec()
+}
+
+// DirectoryIter walks public_rooms in name order, only the names starting
+// with prefix when it is non-empty.
+func (r *Repository) DirectoryIter(prefix string) *gocql.Iter {
+	if prefix == "" {
+		return r.Session.Query(`SELECT name_key, room_id FROM public_rooms WHERE shard = ?`, directoryShard).
+			PageSize(500).Iter()
+	}
+	return r.Session.Query(`SELECT name_key, room_id FROM public_rooms
+	                        WHERE shard = ? AND name_key >= ? AND name_key < ?`,
+		directoryShard, prefix, prefix+"\U0010FFFF").PageSize(500).Iter()
+}
+
+// BackfillListing builds the index rows of a room created before migration
+// 024: its directory entry, and activity for members that have none.
+func (r *Repository) BackfillListing(room *Room) (members int, err error) {
+	if err := r.SyncDirectory(room.RoomID); err != nil {
+		return 0, err
+	}
+	iter := r.Session.Query(`SELECT user_id, joined_at, activity_id FROM room_participants WHERE room_id = ?`,
+		room.RoomID).Iter()
+	var (
+		userID   gocql.UUID
+		joinedAt time.Time
+		at       *gocql.UUID
+	)
+	for iter.Scan(&userID, &joinedAt, &at) {
+		if at == nil {
+			activity := joinedAt
+			if room.LastMessageAt != nil && room.LastMessageAt.After(activity) {
+				activity = *room.LastMessageAt
+			}
+			if err := r.setActivity(userID, room.RoomID, nil, activity); err != nil {
+				iter.Close()
+				return members, err
+			}
+			members++
+		}
+		at = nil
+	}
+	return members, iter.Close()
+}
@@ -1,21 +1,129 @@
 package chat
 
+import "time"
+
 type CreateRoomRequest struct {
-	Name string `json:"name"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility,omitempty"`
 }
 
 type CreateRoomResponse struct {
-	RoomID string `json:"room_id"`
-	Name   string `json:"name"`
+	RoomID     string `json:"room_id"`
+	Name       string `json:"name"`
+	Slug       string `json:"slug"`
+	Visibility string `json:"visibility"`
+}
+
+type RenameRoomRequest struct {
+	Name string `json:"name"`
+	Slug string `json:"slug,omitempty"`
+}
+
+type UpdateRoomRequest struct {
+	Name        *string `json:"name,omitempty"`
+	Topic       *string `json:"topic,omitempty"`
+	Description *string `json:"description,omitempty"`
+	AvatarURL   *string `json:"avatarUrl,omitempty"`
+	// EditWindowSeconds limits how long messages can be edited; 0 means no limit.
+	EditWindowSeconds *int `json:"editWindowSeconds,omitempty"`
+}
+
+// UpdateRetentionRequest changes a room's retention policy. Days of 0 keep
+// messages forever and -1 fall back to the workspace default.
+type UpdateRetentionRequest struct {
+	RetentionDays        *int  `json:"retentionDays,omitempty"`
+	DeletedRetentionDays *int  `json:"deletedRetentionDays,omitempty"`
+	LegalHold            *bool `json:"legalHold,omitempty"`
+}
+
+// SetDisappearingRequest sets the disappearing-message timer; 0 turns it off.
+type SetDisappearingRequest struct {
+	Seconds int `json:"seconds"`
+}
+
+type CreateScheduledRequest struct {
+	Content  string    `json:"content"`
+	SendAt   time.Time `json:"sendAt"`
+	ParentID string    `json:"parentId,omitempty"`
+}
+
+type UpdateScheduledRequest struct {
+	Content *string    `json:"content,omitempty"`
+	SendAt  *time.Time `json:"sendAt,omitempty"`
+}
+
+type CreatePollRequest struct {
+	Question    string     `json:"question"`
+	Options     []string   `json:"options"`
+	MultiChoice bool       `json:"multiChoice,omitempty"`
+	Anonymous   bool       `json:"anonymous,omitempty"`
+	ClosesAt    *time.Time `json:"closesAt,omitempty"`
+}
+
+// VoteRequest lists the chosen option indexes; empty withdraws the vote.
+type VoteRequest struct {
+	Options []int `json:"options"`
+}
+
+// RegisterCommandRequest registers an external slash command answered by URL.
+type RegisterCommandRequest struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+	Usage       string `json:"usage,omitempty"`
+}
+
+type CreateWebhookRequest struct {
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatarUrl,omitempty"`
+}
+
+// IncomingWebhookRequest is the body of a webhook call. It also accepts
+// Slack's incoming webhook shape (icon_url, snake_case attachment fields).
+type IncomingWebhookRequest struct {
+	Text        string               `json:"text"`
+	Username    string               `json:"username,omitempty"`
+	AvatarURL   string               `json:"avatarUrl,omitempty"`
+	IconURL     string               `json:"icon_url,omitempty"`
+	Attachments []IncomingAttachment `json:"attachments,omitempty"`
+}
+
+type IncomingAttachment struct {
+	Fallback       string            `json:"fallback"`
+	Color          string            `json:"color"`
+	Pretext        string            `json:"pretext"`
+	Title          string            `json:"title"`
+	TitleLink      string            `json:"titleLink"`
+	SlackTitleLink string            `json:"title_link"`
+	Text           string            `json:"text"`
+	ImageURL       string            `json:"imageUrl"`
+	SlackImageURL  string            `json:"image_url"`
+	Fields         []AttachmentField `json:"fields"`
+	Footer         string            `json:"footer"`
+}
+
+type MarkReadRequest struct {
+	MsgID string `json:"msgId,omitempty"`
 }
 
 type SendMessageRequest struct {
-	Content string `json:"content"`
+	Content  string `json:"content"`
+	ParentID string `json:"parentId,omitempty"`
+	TempID   string `json:"tempId,omitempty"`
 }
 
 type SendMessageResponse struct {
-	MsgID   string `json:"msg_id"`
-	Content string `json:"content"`
+	MsgID     string     `json:"msg_id"`
+	RoomID    string     `json:"room_id"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	ParentID  string     `json:"parent_id,omitempty"`
+	TempID    string     `json:"temp_id,omitempty"`
+	Replayed  bool       `json:"replayed,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Command is set when the content ran a slash command; an ephemeral
+	// response leaves the message fields empty.
+	Command *CommandResult `json:"command,omitempty"`
 }
 
 type EditMessageRequest struct {
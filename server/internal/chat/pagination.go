@@ -0,0 +1,210 @@
+package chat
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// MessageQuery selects a window of a room's history. At most one of Before,
+// After, Around and At should be set; none means the newest messages.
+type MessageQuery struct {
+	Limit  int
+	Before string // cursor or message id: older than this
+	After  string // cursor or message id: newer than this
+	Around string // message id: Limit messages either side, plus the message
+	At     string // RFC 3339 or unix millis: Limit messages either side of the instant
+}
+
+// MessagePage is a window of messages, newest first, with opaque cursors for
+// paging further back (Before) or forward (After).
+type MessagePage struct {
+	Messages      []Message `json:"messages"`
+	HasMoreBefore bool      `json:"hasMoreBefore"`
+	HasMoreAfter  bool      `json:"hasMoreAfter"`
+	BeforeCursor  string    `json:"beforeCursor,omitempty"`
+	AfterCursor   string    `json:"afterCursor,omitempty"`
+}
+
+// PageMessages returns a window of roomID's messages for the given query.
+// Callers must have checked access to the room.
+func (s *Service) PageMessages(roomID gocql.UUID, q MessageQuery) (*MessagePage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	switch {
+	case q.Around != "":
+		id, err := gocql.ParseUUID(q.Around)
+		if err != nil {
+			return nil, errors.New("invalid around")
+		}
+		anchor, err := s.Repo.GetMessage(roomID, id)
+		if err != nil {
+			return nil, errors.New("message not found")
+		}
+		return s.pageAround(roomID, id, anchor, limit)
+
+	case q.At != "":
+		t, err := parsePageTime(q.At)
+		if err != nil {
+			return nil, err
+		}
+		// Everything at or after t sorts above MinTimeUUID(t), everything
+		// strictly before it below, so the pivot needs no message of its own.
+		return s.pageAround(roomID, gocql.MinTimeUUID(t), nil, limit)
+
+	case q.After != "":
+		after, err := decodeMsgCursor(q.After)
+		if err != nil {
+			return nil, err
+		}
+		newer, err := s.Repo.ListMessagesAfter(roomID, limit+1, &after)
+		if err != nil {
+			return nil, err
+		}
+		page := &MessagePage{HasMoreBefore: true}
+		if len(newer) > limit {
+			newer = newer[:limit]
+			page.HasMoreAfter = true
+		}
+		page.Messages = reverseMessages(newer)
+		page.setCursors(after, after)
+		return page, nil
+
+	default:
+		var before *gocql.UUID
+		if q.Before != "" {
+			b, err := decodeMsgCursor(q.Before)
+			if err != nil {
+				return nil, err
+			}
+			before = &b
+		}
+		older, err := s.Repo.ListMessages(roomID, limit+1, before)
+		if err != nil {
+			return nil, err
+		}
+		page := &MessagePage{HasMoreAfter: before != nil}
+		if len(older) > limit {
+			older = older[:limit]
+			page.HasMoreBefore = true
+		}
+		page.Messages = older
+		if before != nil {
+			page.setCursors(*before, *before)
+		} else {
+			page.setCursors(gocql.UUID{}, gocql.UUID{})
+		}
+		return page, nil
+	}
+}
+
+// pageAround returns up to limit messages on each side of pivot, plus anchor
+// when it is a real message.
+func (s *Service) pageAround(roomID, pivot gocql.UUID, anchor *Message, limit int) (*MessagePage, error) {
+	older, err := s.Repo.ListMessages(roomID, limit+1, &pivot)
+	if err != nil {
+		return nil, err
+	}
+	newer, err := s.Repo.ListMessagesAfter(roomID, limit+1, &pivot)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &MessagePage{}
+	if len(older) > limit {
+		older = older[:limit]
+		page.HasMoreBefore = true
+	}
+	if len(newer) > limit {
+		newer = newer[:limit]
+		page.HasMoreAfter = true
+	}
+
+	msgs := reverseMessages(newer)
+	if anchor != nil {
+		msgs = append(msgs, *anchor)
+	}
+	page.Messages = append(msgs, older...)
+	page.setCursors(pivot, pivot)
+	return page, nil
+}
+
+// setCursors points BeforeCursor at the oldest message and AfterCursor at the
+// newest one, falling back to the query's own bounds for an empty page so the
+// client can keep polling in that direction.
+func (p *MessagePage) setCursors(olderBound, newerBound gocql.UUID) {
+	if n := len(p.Messages); n > 0 {
+		newerBound = p.Messages[0].MsgID
+		olderBound = p.Messages[n-1].MsgID
+	}
+	if olderBound != (gocql.UUID{}) {
+		p.BeforeCursor = encodeMsgCursor(olderBound)
+	}
+	if newerBound != (gocql.UUID{}) {
+		p.AfterCursor = encodeMsgCursor(newerBound)
+	}
+}
+
+func encodeMsgCursor(id gocql.UUID) string {
+	return base64.RawURLEncoding.EncodeToString(id.Bytes())
+}
+
+// decodeMsgCursor accepts an opaque cursor or, for older clients, a plain
+// message id.
+func decodeMsgCursor(cursor string) (gocql.UUID, error) {
+	if id, err := gocql.ParseUUID(cursor); err == nil {
+		return id, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return gocql.UUID{}, errors.New("invalid cursor")
+	}
+	id, err := gocql.UUIDFromBytes(raw)
+	if err != nil {
+		return gocql.UUID{}, errors.New("invalid cursor")
+	}
+	return id, nil
+}
+
+// IsMessageCursor reports whether s is an opaque cursor rather than a message id.
+func IsMessageCursor(s string) bool {
+	if s == "" {
+		return false
+	}
+	_, err := gocql.ParseUUID(s)
+	return err != nil
+}
+
+func parsePageTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("invalid at: use RFC 3339 or unix milliseconds")
+	}
+	return t.UTC(), nil
+}
+
+func reverseMessages(msgs []Message) []Message {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs
+}
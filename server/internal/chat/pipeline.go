@@ -0,0 +1,294 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"gochat/internal/ws"
+)
+
+const (
+	maxContentLen = 4000
+	maxTempIDLen  = 128
+
+	// How long a send waits for a concurrent one holding its tempId, and
+	// how often it checks.
+	tempIDWait = 3 * time.Second
+	tempIDPoll = 100 * time.Millisecond
+)
+
+// PostMessageInput is a message as submitted by a client over REST or WS.
+type PostMessageInput struct {
+	RoomID   gocql.UUID
+	UserID   gocql.UUID
+	Content  string
+	ParentID *gocql.UUID
+	TempID   string
+	// Scopes are the caller's API token scopes, nil for a user session or a
+	// server-side producer. Commands needing more than write:messages check
+	// them.
+	Scopes []string
+
+	// Set by server-side producers for non-text messages.
+	Kind        string
+	Poll        *PollResults
+	Attachments Attachments
+
+	skipCommands bool           // content is a command's output, not a command
+	webhook      *webhookAuthor // set for incoming webhooks, which are not room members
+}
+
+// PostedMessage is a persisted message together with its author's username.
+// Replayed is set when TempID matched an earlier send and nothing new was stored.
+type PostedMessage struct {
+	Message
+	Username string
+	TempID   string
+	Replayed bool
+	Poll     *PollResults
+	// Command is set when the content was a slash command. For ephemeral
+	// responses nothing was stored and Message only carries the RoomID.
+	Command *CommandResult
+}
+
+// PostMessage is the single write path for new messages: it validates,
+// authorizes, persists, enriches author info and publishes message.created.
+func (s *Service) PostMessage(ctx context.Context, in PostMessageInput) (*PostedMessage, error) {
+	content := strings.TrimSpace(in.Content)
+	if len(content) == 0 || len(content) > maxContentLen {
+		return nil, errors.New("invalid content")
+	}
+	if in.webhook == nil {
+		if err := s.EnsureMemberOrPublic(in.RoomID, in.UserID); err != nil {
+			return nil, err
+		}
+	}
+	room, err := s.writableRoom(in.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if in.Kind == "" && !in.skipCommands && in.webhook == nil && strings.HasPrefix(content, "/") {
+		if !strings.HasPrefix(content, "//") {
+			return s.runSlashCommand(ctx, in, content)
+		}
+		content = content[1:]
+	}
+	if in.ParentID != nil {
+		parent, err := s.Repo.GetMessage(in.RoomID, *in.ParentID)
+		if err == gocql.ErrNotFound {
+			return nil, errors.New("parent message not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if parent.DeletedAt != nil {
+			return nil, errors.New("parent message deleted")
+		}
+	}
+
+	msgID := gocql.TimeUUID()
+	if in.TempID != "" {
+		if len(in.TempID) > maxTempIDLen {
+			return nil, errors.New("tempId too long")
+		}
+		existing, replay, err := s.claimTempID(in, msgID)
+		if err != nil {
+			return nil, err
+		}
+		if replay != nil {
+			s.publish(ws.NewServerEvent("message.created", "server", in.UserID.String(), replay.EventPayload()))
+			return replay, nil
+		}
+		msgID = existing
+	}
+
+	msg := Message{
+		RoomID:      in.RoomID,
+		MsgID:       msgID,
+		UserID:      in.UserID,
+		Content:     content,
+		CreatedAt:   msgID.Time().UTC(),
+		ParentID:    in.ParentID,
+		Kind:        in.Kind,
+		Attachments: in.Attachments,
+	}
+	if in.Poll != nil {
+		msg.PollID = &in.Poll.PollID
+	}
+	if in.webhook != nil {
+		msg.WebhookID = &in.webhook.hookID
+		msg.AuthorName, msg.AuthorAvatar = in.webhook.name, in.webhook.avatar
+	}
+	ttl, disappearing := s.messageTTL(room)
+	msg.Disappearing = disappearing
+	if err := s.Repo.InsertMessage(&msg, ttl); err != nil {
+		return nil, err
+	}
+
+	posted := &PostedMessage{Message: msg, TempID: in.TempID, Poll: in.Poll}
+	if msg.WebhookID != nil {
+		posted.Username = msg.AuthorName
+	} else {
+		posted.Username = s.username(in.UserID)
+	}
+	s.publish(ws.NewServerEvent("message.created", "server", msg.RoomID.String(), posted.EventPayload()))
+	s.scheduleExpiry(&msg)
+	return posted, nil
+}
+
+// claimTempID records (user, tempId) -> msgID. Only the send whose claim
+// applied stores and publishes the message; a concurrent send with the same
+// key waits for it and returns it as a replay. When the claim is older than
+// tempIDWait and its message was never stored, the earlier attempt failed:
+// the key is taken over with another conditional write and its winner
+// retries the insert under the claimed id, so there is still one message.
+func (s *Service) claimTempID(in PostMessageInput, msgID gocql.UUID) (gocql.UUID, *PostedMessage, error) {
+	applied, prev, err := s.Repo.ClaimIdempotencyKey(in.UserID, in.TempID, in.RoomID, msgID)
+	if err != nil {
+		return gocql.UUID{}, nil, err
+	}
+	if applied {
+		return msgID, nil, nil
+	}
+	if prev.RoomID != in.RoomID {
+		return gocql.UUID{}, nil, errors.New("tempId already used in another room")
+	}
+	replay, err := s.awaitTempID(in, prev, time.Until(prev.ClaimedAt.Add(tempIDWait)))
+	if replay != nil || err != nil {
+		return prev.MsgID, replay, err
+	}
+	took, err := s.Repo.TakeOverIdempotencyKey(in.UserID, in.TempID, prev)
+	if err != nil {
+		return gocql.UUID{}, nil, err
+	}
+	if took {
+		return prev.MsgID, nil, nil
+	}
+	// Another retry took the key over first.
+	replay, err = s.awaitTempID(in, prev, tempIDWait)
+	if replay == nil && err == nil {
+		err = errors.New("message with this tempId is still being sent")
+	}
+	return prev.MsgID, replay, err
+}
+
+// awaitTempID polls for the message a tempId claim stores, for up to wait,
+// and returns it as a replay, or nil if it has not appeared.
+func (s *Service) awaitTempID(in PostMessageInput, prev *IdempotencyClaim, wait time.Duration) (*PostedMessage, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		msg, err := s.Repo.GetMessage(prev.RoomID, prev.MsgID)
+		if err == nil {
+			return &PostedMessage{Message: *msg, Username: s.username(msg.UserID), TempID: in.TempID, Replayed: true}, nil
+		}
+		if err != gocql.ErrNotFound {
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, nil
+		}
+		time.Sleep(tempIDPoll)
+	}
+}
+
+// username looks up a display name; failures only degrade the event payload.
+func (s *Service) username(userID gocql.UUID) string {
+	name, err := s.Repo.GetUsername(userID)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// EventPayload is the message.created payload clients render.
+func (p *PostedMessage) EventPayload() map[string]any {
+	author := map[string]any{"id": p.UserID.String(), "username": p.Username}
+	if p.UserID == SystemUserID {
+		author["system"] = true
+	}
+	if p.WebhookID != nil {
+		author["bot"] = true
+		author["webhookId"] = p.WebhookID.String()
+		if p.AuthorAvatar != "" {
+			author["avatarUrl"] = p.AuthorAvatar
+		}
+	}
+	payload := map[string]any{
+		"id":        p.MsgID.String(),
+		"tempId":    p.TempID,
+		"roomId":    p.RoomID.String(),
+		"author":    author,
+		"content":   p.Content,
+		"createdAt": p.CreatedAt.Format(time.RFC3339Nano),
+	}
+	if p.ParentID != nil {
+		payload["parentId"] = p.ParentID.String()
+	}
+	if p.ExpiresAt != nil {
+		payload["expiresAt"] = p.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	if p.Kind != "" {
+		payload["kind"] = p.Kind
+	}
+	if p.ActorID != nil {
+		payload["actorId"] = p.ActorID.String()
+	}
+	if p.PollID != nil {
+		payload["pollId"] = p.PollID.String()
+	}
+	if p.Poll != nil {
+		payload["poll"] = p.Poll
+	}
+	if len(p.Attachments) > 0 {
+		payload["attachments"] = p.Attachments
+	}
+	if p.Replayed {
+		payload["replayed"] = true
+	}
+	return payload
+}
+
+// publish forwards an event to the hub, if one is attached, and to OnEvent.
+func (s *Service) publish(ev ws.Event) {
+	if s.Hub != nil {
+		s.Hub.EmitSystem(ev)
+	}
+	if s.OnEvent != nil {
+		s.OnEvent(ev)
+	}
+}
+
+func memberJoinedEvent(roomID, userID gocql.UUID, username string) ws.Event {
+	return ws.NewServerEvent("member.joined", "server", roomID.String(), map[string]any{
+		"roomId":   roomID.String(),
+		"userId":   userID.String(),
+		"username": username,
+	})
+}
+
+func editedEvent(res *EditMessageResult) ws.Event {
+	return ws.NewServerEvent("message.updated", "server", res.RoomID, map[string]any{
+		"id":        res.MsgID,
+		"roomId":    res.RoomID,
+		"content":   res.Content,
+		"editedAt":  res.EditedAt.Format(time.RFC3339Nano),
+		"editCount": res.EditCount,
+	})
+}
+
+func deletedEvent(res *DeleteMessageResult) ws.Event {
+	payload := map[string]any{
+		"id":        res.MsgID,
+		"roomId":    res.RoomID,
+		"deletedAt": res.DeletedAt.Format(time.RFC3339Nano),
+		"deletedBy": res.DeletedBy,
+	}
+	if res.DeletedReason != nil {
+		payload["deletedReason"] = *res.DeletedReason
+	}
+	return ws.NewServerEvent("message.deleted", "server", res.RoomID, payload)
+}
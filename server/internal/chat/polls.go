@@ -0,0 +1,405 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gochat/internal/ws"
+
+	"github.com/gocql/gocql"
+)
+
+// A poll lives in the polls table and is posted as a message of kind
+// "poll" that references it. Votes are one row per voter; the tally is
+// computed from them until the poll closes, when it is frozen into
+// final_counts and further votes are refused.
+
+const (
+	maxPollQuestionLen = 300
+	maxPollOptionLen   = 100
+	minPollOptions     = 2
+	maxPollOptions     = 10
+	maxPollDuration    = 90 * 24 * time.Hour
+)
+
+var ErrPollClosed = errors.New("poll is closed")
+
+type Poll struct {
+	PollID      gocql.UUID
+	RoomID      gocql.UUID
+	MsgID       *gocql.UUID
+	CreatedBy   gocql.UUID
+	Question    string
+	Options     []string
+	MultiChoice bool
+	Anonymous   bool
+	ClosesAt    *time.Time
+	ClosedAt    *time.Time
+	FinalCounts []int
+	CreatedAt   time.Time
+}
+
+func (p *Poll) closed(now time.Time) bool {
+	return p.ClosedAt != nil || (p.ClosesAt != nil && !now.Before(*p.ClosesAt))
+}
+
+type PollOption struct {
+	Text   string   `json:"text"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters,omitempty"` // user ids; never set for anonymous polls
+}
+
+// PollResults is the public view of a poll. MyVotes is only set in replies
+// to the voter, never in broadcasts.
+type PollResults struct {
+	PollID      gocql.UUID   `json:"id"`
+	RoomID      gocql.UUID   `json:"roomId"`
+	MsgID       *gocql.UUID  `json:"msgId,omitempty"`
+	CreatedBy   gocql.UUID   `json:"createdBy"`
+	Question    string       `json:"question"`
+	Options     []PollOption `json:"options"`
+	MultiChoice bool         `json:"multiChoice"`
+	Anonymous   bool         `json:"anonymous"`
+	ClosesAt    *time.Time   `json:"closesAt,omitempty"`
+	Closed      bool         `json:"closed"`
+	ClosedAt    *time.Time   `json:"closedAt,omitempty"`
+	TotalVoters int          `json:"totalVoters"`
+	MyVotes     []int        `json:"myVotes,omitempty"`
+}
+
+type pollVote struct {
+	UserID  gocql.UUID
+	Options []int
+}
+
+// CreatePoll stores a poll and posts the message that carries it.
+func (s *Service) CreatePoll(ctx context.Context, roomID, userID gocql.UUID, req CreatePollRequest) (*PostedMessage, error) {
+	question := strings.TrimSpace(req.Question)
+	if question == "" || len(question) > maxPollQuestionLen {
+		return nil, errors.New("invalid question")
+	}
+	if len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		return nil, errors.New("a poll needs 2 to 10 options")
+	}
+	options := make([]string, len(req.Options))
+	for i, o := range req.Options {
+		o = strings.TrimSpace(o)
+		if o == "" || len(o) > maxPollOptionLen {
+			return nil, errors.New("invalid option")
+		}
+		options[i] = o
+	}
+	now := time.Now().UTC()
+	if req.ClosesAt != nil {
+		if !req.ClosesAt.After(now) || req.ClosesAt.Sub(now) > maxPollDuration {
+			return nil, errors.New("invalid closesAt")
+		}
+		t := req.ClosesAt.UTC().Truncate(time.Millisecond)
+		req.ClosesAt = &t
+	}
+	if err := s.EnsureMemberOrPublic(roomID, userID); err != nil {
+		return nil, err
+	}
+	if err := s.EnsureWritable(roomID); err != nil {
+		return nil, err
+	}
+
+	poll := &Poll{
+		PollID:      gocql.TimeUUID(),
+		RoomID:      roomID,
+		CreatedBy:   userID,
+		Question:    question,
+		Options:     options,
+		MultiChoice: req.MultiChoice,
+		Anonymous:   req.Anonymous,
+		ClosesAt:    req.ClosesAt,
+		CreatedAt:   now,
+	}
+	if err := s.Repo.InsertPoll(poll); err != nil {
+		return nil, err
+	}
+
+	posted, err := s.PostMessage(ctx, PostMessageInput{
+		RoomID:  roomID,
+		UserID:  userID,
+		Content: question,
+		Kind:    MessageKindPoll,
+		Poll:    tallyPoll(poll, nil, gocql.UUID{}),
+	})
+	if err != nil {
+		_ = s.Repo.DeletePoll(poll.PollID)
+		return nil, err
+	}
+	if err := s.Repo.SetPollMessage(poll.PollID, posted.MsgID); err != nil {
+		return nil, err
+	}
+	posted.Poll.MsgID = &posted.MsgID
+
+	if poll.ClosesAt != nil {
+		pollID := poll.PollID
+		time.AfterFunc(time.Until(*poll.ClosesAt), func() {
+			if p, err := s.Repo.GetPoll(pollID); err == nil {
+				s.finalizePoll(p, nil)
+			}
+		})
+	}
+	return posted, nil
+}
+
+// GetPoll returns the current results as seen by userID.
+func (s *Service) GetPoll(roomID, pollID, userID gocql.UUID) (*PollResults, error) {
+	if err := s.EnsureMemberOrPublic(roomID, userID); err != nil {
+		return nil, err
+	}
+	poll, err := s.roomPoll(roomID, pollID)
+	if err != nil {
+		return nil, err
+	}
+	if poll.ClosedAt == nil && poll.closed(time.Now()) {
+		s.finalizePoll(poll, nil)
+	}
+	return s.pollResults(poll, userID)
+}
+
+// Vote replaces userID's choices; an empty list withdraws the vote.
+func (s *Service) Vote(roomID, pollID, userID gocql.UUID, options []int) (*PollResults, error) {
+	if err := s.EnsureMemberOrPublic(roomID, userID); err != nil {
+		return nil, err
+	}
+	if err := s.EnsureWritable(roomID); err != nil {
+		return nil, err
+	}
+	poll, err := s.roomPoll(roomID, pollID)
+	if err != nil {
+		return nil, err
+	}
+	if poll.closed(time.Now()) {
+		if poll.ClosedAt == nil {
+			s.finalizePoll(poll, nil)
+		}
+		return nil, ErrPollClosed
+	}
+
+	seen := map[int]bool{}
+	for _, o := range options {
+		if o < 0 || o >= len(poll.Options) || seen[o] {
+			return nil, errors.New("invalid option")
+		}
+		seen[o] = true
+	}
+	if len(options) > 1 && !poll.MultiChoice {
+		return nil, errors.New("this poll allows a single choice")
+	}
+
+	if len(options) == 0 {
+		err = s.Repo.DeleteVote(pollID, userID)
+	} else {
+		err = s.Repo.UpsertVote(pollID, userID, options, time.Now().UTC())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.pollResults(poll, userID)
+	if err != nil {
+		return nil, err
+	}
+	s.publishPoll(res)
+	return res, nil
+}
+
+// ClosePoll closes a poll early. Its creator and room moderators may do so.
+func (s *Service) ClosePoll(roomID, pollID, userID gocql.UUID) (*PollResults, error) {
+	poll, err := s.roomPoll(roomID, pollID)
+	if err != nil {
+		return nil, err
+	}
+	if poll.CreatedBy != userID {
+		if err := s.ensureRoomModerator(roomID, userID); err != nil {
+			return nil, err
+		}
+	}
+	if poll.ClosedAt == nil {
+		now := time.Now().UTC()
+		s.finalizePoll(poll, &now)
+	}
+	return s.pollResults(poll, userID)
+}
+
+func (s *Service) roomPoll(roomID, pollID gocql.UUID) (*Poll, error) {
+	poll, err := s.Repo.GetPoll(pollID)
+	if err == gocql.ErrNotFound || (err == nil && poll.RoomID != roomID) {
+		return nil, errors.New("poll not found")
+	}
+	return poll, err
+}
+
+// finalizePoll freezes the tally of a poll that is due to close, or closes
+// it at the given time. Only the first caller wins and broadcasts the final
+// results; poll is updated in place either way.
+func (s *Service) finalizePoll(poll *Poll, at *time.Time) {
+	closedAt := at
+	if closedAt == nil {
+		if poll.ClosesAt == nil || time.Now().Before(*poll.ClosesAt) {
+			return
+		}
+		closedAt = poll.ClosesAt
+	}
+	votes, err := s.Repo.ListVotes(poll.PollID)
+	if err != nil {
+		log.Printf("polls: tally %s: %v", poll.PollID, err)
+		return
+	}
+	counts := tallyPoll(poll, votes, gocql.UUID{}).counts()
+	applied, err := s.Repo.ClosePoll(poll.PollID, *closedAt, counts)
+	if err != nil {
+		log.Printf("polls: close %s: %v", poll.PollID, err)
+		return
+	}
+	if !applied {
+		if p, err := s.Repo.GetPoll(poll.PollID); err == nil {
+			*poll = *p
+		}
+		return
+	}
+	poll.ClosedAt, poll.FinalCounts = closedAt, counts
+	s.publishPoll(tallyPoll(poll, votes, gocql.UUID{}))
+}
+
+func (s *Service) pollResults(poll *Poll, viewer gocql.UUID) (*PollResults, error) {
+	votes, err := s.Repo.ListVotes(poll.PollID)
+	if err != nil {
+		return nil, err
+	}
+	return tallyPoll(poll, votes, viewer), nil
+}
+
+// publishPoll broadcasts results to the room, without any viewer's choices.
+func (s *Service) publishPoll(res *PollResults) {
+	out := *res
+	out.MyVotes = nil
+	s.publish(ws.NewServerEvent("poll.updated", "server", res.RoomID.String(), map[string]any{
+		"roomId": res.RoomID.String(),
+		"poll":   &out,
+	}))
+}
+
+// tallyPoll builds the results view. Closed polls report their frozen
+// counts; voter ids are only listed for named polls.
+func tallyPoll(poll *Poll, votes []pollVote, viewer gocql.UUID) *PollResults {
+	res := &PollResults{
+		PollID:      poll.PollID,
+		RoomID:      poll.RoomID,
+		MsgID:       poll.MsgID,
+		CreatedBy:   poll.CreatedBy,
+		Question:    poll.Question,
+		Options:     make([]PollOption, len(poll.Options)),
+		MultiChoice: poll.MultiChoice,
+		Anonymous:   poll.Anonymous,
+		ClosesAt:    poll.ClosesAt,
+		Closed:      poll.closed(time.Now()),
+		ClosedAt:    poll.ClosedAt,
+		TotalVoters: len(votes),
+	}
+	for i, text := range poll.Options {
+		res.Options[i].Text = text
+	}
+	for _, v := range votes {
+		for _, o := range v.Options {
+			if o < 0 || o >= len(res.Options) {
+				continue
+			}
+			res.Options[o].Votes++
+			if !poll.Anonymous {
+				res.Options[o].Voters = append(res.Options[o].Voters, v.UserID.String())
+			}
+		}
+		if v.UserID == viewer {
+			res.MyVotes = v.Options
+		}
+	}
+	if poll.ClosedAt != nil && len(poll.FinalCounts) == len(res.Options) {
+		for i, n := range poll.FinalCounts {
+			res.Options[i].Votes = n
+		}
+	}
+	return res
+}
+
+func (r *PollResults) counts() []int {
+	out := make([]int, len(r.Options))
+	for i, o := range r.Options {
+		out[i] = o.Votes
+	}
+	return out
+}
+
+const pollColumns = `poll_id, room_id, msg_id, created_by, question, options, multi_choice, anonymous,
+	closes_at, closed_at, final_counts, created_at`
+
+func pollDest(p *Poll) []interface{} {
+	return []interface{}{&p.PollID, &p.RoomID, &p.MsgID, &p.CreatedBy, &p.Question, &p.Options,
+		&p.MultiChoice, &p.Anonymous, &p.ClosesAt, &p.ClosedAt, &p.FinalCounts, &p.CreatedAt}
+}
+
+func (r *Repository) InsertPoll(p *Poll) error {
+	return r.Session.Query(`INSERT INTO polls (`+pollColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.PollID, p.RoomID, p.MsgID, p.CreatedBy, p.Question, p.Options, p.MultiChoice, p.Anonymous,
+		p.ClosesAt, p.ClosedAt, p.FinalCounts, p.CreatedAt,
+	).Exec()
+}
+
+func (r *Repository) GetPoll(pollID gocql.UUID) (*Poll, error) {
+	var p Poll
+	if err := r.Session.Query(`SELECT `+pollColumns+` FROM polls WHERE poll_id = ?`, pollID).
+		Scan(pollDest(&p)...); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *Repository) SetPollMessage(pollID, msgID gocql.UUID) error {
+	return r.Session.Query(`UPDATE polls SET msg_id = ? WHERE poll_id = ?`, msgID, pollID).Exec()
+}
+
+func (r *Repository) DeletePoll(pollID gocql.UUID) error {
+	return r.Session.Query(`DELETE FROM polls WHERE poll_id = ?`, pollID).Exec()
+}
+
+// ClosePoll freezes the tally unless the poll was already closed.
+func (r *Repository) ClosePoll(pollID gocql.UUID, at time.Time, counts []int) (bool, error) {
+	return r.Session.Query(
+		`UPDATE polls SET closed_at = ?, final_counts = ? WHERE poll_id = ? IF closed_at = null`,
+		at, counts, pollID,
+	).MapScanCAS(map[string]interface{}{})
+}
+
+func (r *Repository) UpsertVote(pollID, userID gocql.UUID, options []int, at time.Time) error {
+	return r.Session.Query(
+		`INSERT INTO poll_votes (poll_id, user_id, options, voted_at) VALUES (?, ?, ?, ?)`,
+		pollID, userID, options, at,
+	).Exec()
+}
+
+func (r *Repository) DeleteVote(pollID, userID gocql.UUID) error {
+	return r.Session.Query(`DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?`, pollID, userID).Exec()
+}
+
+func (r *Repository) ListVotes(pollID gocql.UUID) ([]pollVote, error) {
+	iter := r.Session.Query(`SELECT user_id, options FROM poll_votes WHERE poll_id = ?`, pollID).Iter()
+	var out []pollVote
+	var v pollVote
+	for iter.Scan(&v.UserID, &v.Options) {
+		sort.Ints(v.Options)
+		out = append(out, v)
+		v = pollVote{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -2,6 +2,10 @@ package chat
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -9,6 +13,9 @@ import (
 
 type Repository struct {
 	Session *gocql.Session
+
+	fanOutMu sync.Mutex
+	fanOuts  map[gocql.UUID]time.Time // rooms with a fan-out running, and the latest activity still to apply
 }
 
 func NewRepository(sess *gocql.Session) *Repository {
@@ -21,7 +28,50 @@ type Room struct {
 	CreatedBy gocql.UUID `json:"createdBy"`
 	CreatedAt time.Time  `json:"createdAt"`
 
-	Slug string `json:"slug,omitempty"`
+	Slug          string     `json:"slug,omitempty"`
+	Kind          string     `json:"kind,omitempty"`
+	Visibility    string     `json:"visibility,omitempty"`
+	LastMessageAt *time.Time `json:"lastMessageAt,omitempty"`
+
+	Topic       string      `json:"topic,omitempty"`
+	Description string      `json:"description,omitempty"`
+	AvatarURL   string      `json:"avatarUrl,omitempty"`
+	UpdatedAt   *time.Time  `json:"updatedAt,omitempty"`
+	ArchivedAt  *time.Time  `json:"archivedAt,omitempty"`
+	ArchivedBy  *gocql.UUID `json:"archivedBy,omitempty"`
+	DeletedAt   *time.Time  `json:"deletedAt,omitempty"`
+	DeletedBy   *gocql.UUID `json:"deletedBy,omitempty"`
+
+	EditWindowSeconds *int `json:"editWindowSeconds,omitempty"`
+
+	RetentionDays        *int `json:"retentionDays,omitempty"`
+	DeletedRetentionDays *int `json:"deletedRetentionDays,omitempty"`
+	LegalHold            bool `json:"legalHold,omitempty"`
+
+	DisappearingSeconds *int `json:"disappearingSeconds,omitempty"`
+}
+
+const (
+	RoomKindChannel = "channel"
+	RoomKindDM      = "dm"
+	RoomKindGroupDM = "group"
+
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+const roomColumns = `room_id, name, created_by, created_at, slug, kind, visibility, last_message_at,
+	topic, description, avatar_url, updated_at, archived_at, archived_by, deleted_at, deleted_by,
+	edit_window_seconds, retention_days, deleted_retention_days, legal_hold,
+	disappearing_seconds`
+
+func roomDest(rm *Room) []interface{} {
+	return []interface{}{&rm.RoomID, &rm.Name, &rm.CreatedBy, &rm.CreatedAt,
+		&rm.Slug, &rm.Kind, &rm.Visibility, &rm.LastMessageAt,
+		&rm.Topic, &rm.Description, &rm.AvatarURL, &rm.UpdatedAt,
+		&rm.ArchivedAt, &rm.ArchivedBy, &rm.DeletedAt, &rm.DeletedBy,
+		&rm.EditWindowSeconds, &rm.RetentionDays, &rm.DeletedRetentionDays, &rm.LegalHold,
+		&rm.DisappearingSeconds}
 }
 
 type Message struct {
@@ -35,27 +85,220 @@ type Message struct {
 	DeletedBy     *gocql.UUID `json:"deletedBy,omitempty"`
 	DeletedReason *string     `json:"deletedReason,omitempty"`
 	ParentID      *gocql.UUID `json:"parentId,omitempty"` // 👈 add this (pointer = nullable)
+	EditCount     int         `json:"editCount"`
+	ExpiresAt     *time.Time  `json:"expiresAt,omitempty"`
+	Kind          string      `json:"kind,omitempty"` // "" for user messages, otherwise a MessageKind constant
+	PollID        *gocql.UUID `json:"pollId,omitempty"`
+	// Set on messages posted by an incoming webhook, whose id is the UserID.
+	WebhookID    *gocql.UUID `json:"webhookId,omitempty"`
+	AuthorName   string      `json:"authorName,omitempty"`
+	AuthorAvatar string      `json:"authorAvatar,omitempty"`
+	Attachments  Attachments `json:"attachments,omitempty"`
+	// Disappearing marks a TTL set by the room's disappearing timer, which
+	// legal holds and longer retention leave in place.
+	Disappearing bool `json:"disappearing,omitempty"`
+	// ActorID is the member whose action a system message announces; the
+	// message itself is authored by SystemUserID.
+	ActorID *gocql.UUID `json:"actorId,omitempty"`
+}
+
+// SystemUserID (00000000-0000-0000-0000-000000000001) authors system
+// messages. No account has it, so no one can edit or delete them as the
+// author.
+var SystemUserID = gocql.UUID{15: 1}
+
+const systemUsername = "system"
 
+const (
+	MessageKindSystem = "system"
+	MessageKindPoll   = "poll"
+)
+
+const messageColumns = `room_id, msg_id, user_id, content, created_at,
+                      edited_at, deleted_at, deleted_by, deleted_reason, parent_id, edit_count,
+                      expires_at, kind, poll_id, webhook_id, author_name, author_avatar, attachments, disappearing, actor_id`
+
+func messageDest(m *Message) []interface{} {
+	return []interface{}{&m.RoomID, &m.MsgID, &m.UserID, &m.Content, &m.CreatedAt,
+		&m.EditedAt, &m.DeletedAt, &m.DeletedBy, &m.DeletedReason, &m.ParentID, &m.EditCount,
+		&m.ExpiresAt, &m.Kind, &m.PollID, &m.WebhookID, &m.AuthorName, &m.AuthorAvatar, &m.Attachments, &m.Disappearing, &m.ActorID}
 }
 
 func (r *Repository) InsertRoom(room *Room) error {
-	const q = `INSERT INTO rooms (room_id, name, created_by, created_at)
-	           VALUES (?, ?, ?, ?)`
-	return r.Session.Query(q, room.RoomID, room.Name, room.CreatedBy, room.CreatedAt).Exec()
+	const q = `INSERT INTO rooms (room_id, name, created_by, created_at, kind, visibility)
+	           VALUES (?, ?, ?, ?, ?, ?)`
+	if err := r.Session.Query(q, room.RoomID, room.Name, room.CreatedBy, room.CreatedAt,
+		room.Kind, room.Visibility).Exec(); err != nil {
+		return err
+	}
+	return r.SyncDirectory(room.RoomID)
 }
 
-func (r *Repository) ListRooms(limit int) ([]Room, error) {
-	if limit <= 0 {
-		limit = 50
+func (r *Repository) GetRoom(roomID gocql.UUID) (*Room, error) {
+	var rm Room
+	q := r.Session.Query(`SELECT `+roomColumns+` FROM rooms WHERE room_id = ?`, roomID)
+	if err := q.Scan(roomDest(&rm)...); err != nil {
+		return nil, err
+	}
+	return &rm, nil
+}
+
+// IsRoomPublic reports whether anyone may read and join room. Rooms created
+// before visibility existed are public while they have no participants.
+func (r *Repository) IsRoomPublic(room *Room) (bool, error) {
+	switch room.Visibility {
+	case VisibilityPublic:
+		return true, nil
+	case VisibilityPrivate:
+		return false, nil
+	}
+	has, err := r.RoomHasParticipants(room.RoomID)
+	if err != nil {
+		return false, err
+	}
+	return !has, nil
+}
+
+// RoomSettings holds the optional fields of a room update; nil means unchanged.
+type RoomSettings struct {
+	Topic             *string
+	Description       *string
+	AvatarURL         *string
+	EditWindowSeconds *int
+	// DisappearingSeconds of 0 turns the timer off.
+	DisappearingSeconds *int
+}
+
+func (r *Repository) UpdateRoomSettings(roomID gocql.UUID, set RoomSettings, updatedAt time.Time) error {
+	cols := []string{"updated_at = ?"}
+	args := []interface{}{updatedAt}
+	if set.Topic != nil {
+		cols = append(cols, "topic = ?")
+		args = append(args, *set.Topic)
+	}
+	if set.Description != nil {
+		cols = append(cols, "description = ?")
+		args = append(args, *set.Description)
+	}
+	if set.AvatarURL != nil {
+		cols = append(cols, "avatar_url = ?")
+		args = append(args, *set.AvatarURL)
+	}
+	if set.EditWindowSeconds != nil {
+		cols = append(cols, "edit_window_seconds = ?")
+		args = append(args, *set.EditWindowSeconds)
+	}
+	if set.DisappearingSeconds != nil {
+		cols = append(cols, "disappearing_seconds = ?")
+		args = append(args, *set.DisappearingSeconds)
+	}
+	q := `UPDATE rooms SET ` + strings.Join(cols, ", ") + ` WHERE room_id = ?`
+	return r.Session.Query(q, append(args, roomID)...).Exec()
+}
+
+// SetRoomArchived archives the room when at is non-nil and unarchives it otherwise.
+func (r *Repository) SetRoomArchived(roomID gocql.UUID, at *time.Time, by *gocql.UUID) error {
+	if err := r.Session.Query(
+		`UPDATE rooms SET archived_at = ?, archived_by = ? WHERE room_id = ?`, at, by, roomID,
+	).Exec(); err != nil {
+		return err
+	}
+	return r.SyncDirectory(roomID)
+}
+
+// SetRoomDeleted soft-deletes the room when at is non-nil and restores it otherwise.
+func (r *Repository) SetRoomDeleted(roomID gocql.UUID, at *time.Time, by *gocql.UUID) error {
+	if err := r.Session.Query(
+		`UPDATE rooms SET deleted_at = ?, deleted_by = ? WHERE room_id = ?`, at, by, roomID,
+	).Exec(); err != nil {
+		return err
+	}
+	return r.SyncDirectory(roomID)
+}
+
+func (r *Repository) SetRoomVisibility(roomID gocql.UUID, visibility string) error {
+	if err := r.Session.Query(`UPDATE rooms SET visibility = ? WHERE room_id = ?`, visibility, roomID).Exec(); err != nil {
+		return err
+	}
+	return r.SyncDirectory(roomID)
+}
+
+// TouchRoomActivity records a message at at. Members' activity rows are
+// moved in the background, so a send does not wait on the room's size.
+func (r *Repository) TouchRoomActivity(roomID gocql.UUID, at time.Time) error {
+	if err := r.Session.Query(`UPDATE rooms SET last_message_at = ? WHERE room_id = ?`, at, roomID).Exec(); err != nil {
+		return err
+	}
+	r.queueFanOut(roomID, at)
+	return nil
+}
+
+// Membership is one row of rooms_by_user.
+type Membership struct {
+	UserID        gocql.UUID
+	RoomID        gocql.UUID
+	Role          string
+	JoinedAt      time.Time
+	LastReadMsgID *gocql.UUID
+	ActivityID    *gocql.UUID
+}
+
+// AddParticipant writes the participant row and its rooms_by_user mirror,
+// and files the room in the member's activity index.
+func (r *Repository) AddParticipant(roomID, userID gocql.UUID, role string, joinedAt time.Time) error {
+	if err := r.Session.Query(
+		`INSERT INTO room_participants (room_id, user_id, member_role, joined_at) VALUES (?, ?, ?, ?)`,
+		roomID, userID, role, joinedAt,
+	).Exec(); err != nil {
+		return err
+	}
+	if err := r.Session.Query(
+		`INSERT INTO rooms_by_user (user_id, room_id, member_role, joined_at) VALUES (?, ?, ?, ?)`,
+		userID, roomID, role, joinedAt,
+	).Exec(); err != nil {
+		return err
+	}
+	// Re-adding an existing member keeps its later activity.
+	old, err := r.membershipActivity(userID, roomID)
+	if err != nil || (old != nil && !old.Time().Before(joinedAt)) {
+		return err
+	}
+	return r.setActivity(userID, roomID, old, joinedAt)
+}
+
+// RemoveParticipant deletes the participant row, its rooms_by_user mirror
+// and its activity index row.
+func (r *Repository) RemoveParticipant(roomID, userID gocql.UUID) error {
+	activity, err := r.membershipActivity(userID, roomID)
+	if err != nil {
+		return err
+	}
+	if activity != nil {
+		if err := r.DeleteActivity(userID, *activity); err != nil {
+			return err
+		}
 	}
+	if err := r.Session.Query(
+		`DELETE FROM room_participants WHERE room_id = ? AND user_id = ?`, roomID, userID,
+	).Exec(); err != nil {
+		return err
+	}
+	return r.Session.Query(
+		`DELETE FROM rooms_by_user WHERE user_id = ? AND room_id = ?`, userID, roomID,
+	).Exec()
+}
+
+func (r *Repository) ListRoomsByUser(userID gocql.UUID) ([]Membership, error) {
 	iter := r.Session.Query(
-		`SELECT room_id, name, created_by, created_at FROM rooms LIMIT ?`, limit,
+		`SELECT user_id, room_id, member_role, joined_at, last_read_msg_id FROM rooms_by_user WHERE user_id = ?`,
+		userID,
 	).Iter()
 
-	out := make([]Room, 0, limit)
-	var rm Room
-	for iter.Scan(&rm.RoomID, &rm.Name, &rm.CreatedBy, &rm.CreatedAt) {
-		out = append(out, rm)
+	var out []Membership
+	var m Membership
+	for iter.Scan(&m.UserID, &m.RoomID, &m.Role, &m.JoinedAt, &m.LastReadMsgID) {
+		out = append(out, m)
+		m = Membership{}
 	}
 	if err := iter.Close(); err != nil {
 		return nil, err
@@ -63,92 +306,305 @@ func (r *Repository) ListRooms(limit int) ([]Room, error) {
 	return out, nil
 }
 
+func (r *Repository) SetLastRead(userID, roomID, msgID gocql.UUID) error {
+	return r.Session.Query(
+		`UPDATE rooms_by_user SET last_read_msg_id = ? WHERE user_id = ? AND room_id = ?`,
+		msgID, userID, roomID,
+	).Exec()
+}
+
+// CountMessagesAfter counts messages newer than after, stopping at limit.
+func (r *Repository) CountMessagesAfter(roomID, after gocql.UUID, limit int) (int, error) {
+	buckets, err := r.bucketsSince(roomID, BucketOf(after))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, b := range buckets {
+		iter := r.Session.Query(
+			`SELECT msg_id FROM room_messages_by_bucket WHERE room_id = ? AND bucket = ? AND msg_id > ? LIMIT ?`,
+			roomID, b, after, limit-n,
+		).Iter()
+		var id gocql.UUID
+		for iter.Scan(&id) {
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			return 0, err
+		}
+		if n >= limit {
+			break
+		}
+	}
+	return n, nil
+}
+
 func (r *Repository) UpsertRoomSlug(roomID gocql.UUID, slug string) error {
 	const q = `UPDATE rooms SET slug = ? WHERE room_id = ?`
 	return r.Session.Query(q, slug, roomID).Exec()
 }
 
+func (r *Repository) UpdateRoomName(roomID gocql.UUID, name string) error {
+	if err := r.Session.Query(`UPDATE rooms SET name = ? WHERE room_id = ?`, name, roomID).Exec(); err != nil {
+		return err
+	}
+	return r.SyncDirectory(roomID)
+}
+
+// ReserveSlug claims slug for roomID. It reports false if another room holds
+// it; a slug already held by roomID (e.g. from before a rename) counts as reserved.
+func (r *Repository) ReserveSlug(slug string, roomID gocql.UUID) (bool, error) {
+	var existingSlug string
+	var existingID gocql.UUID
+	var createdAt time.Time
+	applied, err := r.Session.Query(
+		`INSERT INTO rooms_by_slug (slug, room_id, created_at) VALUES (?, ?, ?) IF NOT EXISTS`,
+		slug, roomID, time.Now().UTC(),
+	).Consistency(gocql.Quorum).ScanCAS(&existingSlug, &existingID, &createdAt)
+	if err != nil {
+		return false, err
+	}
+	return applied || existingID == roomID, nil
+}
+
+// GetRoomIDBySlug resolves a current or former slug to its room.
 func (r *Repository) GetRoomIDBySlug(slug string) (gocql.UUID, error) {
 	var id gocql.UUID
-	const q = `SELECT room_id FROM rooms WHERE slug = ? LIMIT 1`
-	if err := r.Session.Query(q, slug).Scan(&id); err != nil {
+	const q = `SELECT room_id FROM rooms_by_slug WHERE slug = ?`
+	if err := r.Session.Query(q, slug).Consistency(gocql.Quorum).Scan(&id); err != nil {
 		return gocql.UUID{}, err
 	}
 	return id, nil
 }
 
-func (r *Repository) InsertMessage(m *Message) error {
-	const q = `INSERT INTO room_messages
-           (room_id, msg_id, user_id, content, created_at, parent_id)
-           VALUES (?, ?, ?, ?, ?, ?)`
-	return r.Session.Query(q,
-		m.RoomID, m.MsgID, m.UserID, m.Content, m.CreatedAt, m.ParentID,
-	).Exec()
+func (r *Repository) GetParticipantRole(roomID, userID gocql.UUID) (string, error) {
+	var role string
+	err := r.Session.Query(
+		`SELECT member_role FROM room_participants WHERE room_id = ? AND user_id = ?`,
+		roomID, userID,
+	).Scan(&role)
+	if err == gocql.ErrNotFound {
+		return "", nil
+	}
+	return role, err
+}
+
+// InsertMessage stores m. A positive ttl makes Scylla expire the message
+// after that long and sets m.ExpiresAt; zero keeps it until deleted. Set
+// m.Disappearing when ttl is the room's disappearing timer.
+func (r *Repository) InsertMessage(m *Message, ttl time.Duration) error {
+	bucket := BucketOf(m.MsgID)
+	if err := r.addBucket(m.RoomID, bucket); err != nil {
+		return err
+	}
+	m.ExpiresAt = nil
+	if ttl > 0 {
+		exp := m.CreatedAt.Add(ttl)
+		m.ExpiresAt = &exp
+	}
+	var kind *string
+	if m.Kind != "" {
+		kind = &m.Kind
+	}
+	var disappearing *bool
+	if m.Disappearing && ttl > 0 {
+		disappearing = &m.Disappearing
+	} else {
+		m.Disappearing = false
+	}
+	const q = `INSERT INTO room_messages_by_bucket
+           (room_id, bucket, msg_id, user_id, content, created_at, parent_id, expires_at, kind, poll_id,
+            webhook_id, author_name, author_avatar, attachments, disappearing, actor_id)
+           VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+           USING TTL ?`
+	if err := r.Session.Query(q,
+		m.RoomID, bucket, m.MsgID, m.UserID, m.Content, m.CreatedAt, m.ParentID, m.ExpiresAt, kind, m.PollID,
+		m.WebhookID, nullIfEmpty(m.AuthorName), nullIfEmpty(m.AuthorAvatar), m.Attachments, disappearing, m.ActorID, ttlSeconds(ttl),
+	).Exec(); err != nil {
+		return err
+	}
+	return r.TouchRoomActivity(m.RoomID, m.CreatedAt)
+}
+
+// nullIfEmpty binds "" as null so optional text columns leave no value behind.
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// IdempotencyClaim is the send that holds a (user, tempId) key.
+type IdempotencyClaim struct {
+	RoomID    gocql.UUID
+	MsgID     gocql.UUID
+	ClaimedAt time.Time
+}
+
+// ClaimIdempotencyKey stores (userID, tempID) -> (roomID, msgID) unless the key
+// already exists, in which case the existing claim is returned.
+func (r *Repository) ClaimIdempotencyKey(userID gocql.UUID, tempID string, roomID, msgID gocql.UUID) (bool, *IdempotencyClaim, error) {
+	existing := map[string]interface{}{}
+	applied, err := r.Session.Query(
+		`INSERT INTO message_idempotency (user_id, temp_id, room_id, msg_id, created_at)
+		 VALUES (?, ?, ?, ?, ?) IF NOT EXISTS`,
+		userID, tempID, roomID, msgID, time.Now().UTC(),
+	).Consistency(gocql.Quorum).MapScanCAS(existing)
+	if err != nil || applied {
+		return applied, nil, err
+	}
+	prev := &IdempotencyClaim{}
+	prev.RoomID, _ = existing["room_id"].(gocql.UUID)
+	prev.MsgID, _ = existing["msg_id"].(gocql.UUID)
+	prev.ClaimedAt, _ = existing["created_at"].(time.Time)
+	return false, prev, nil
+}
 
+// TakeOverIdempotencyKey hands the key to a new attempt at the same message,
+// if prev still holds it. The whole row is rewritten so it expires as one.
+func (r *Repository) TakeOverIdempotencyKey(userID gocql.UUID, tempID string, prev *IdempotencyClaim) (bool, error) {
+	return r.Session.Query(
+		`UPDATE message_idempotency SET room_id = ?, msg_id = ?, created_at = ?
+		 WHERE user_id = ? AND temp_id = ? IF created_at = ?`,
+		prev.RoomID, prev.MsgID, time.Now().UTC(), userID, tempID, prev.ClaimedAt,
+	).Consistency(gocql.Quorum).ScanCAS()
 }
 
+// ListMessages returns up to limit messages older than before (or the newest
+// ones), newest first, walking back through the room's buckets as needed.
 func (r *Repository) ListMessages(roomID gocql.UUID, limit int, before *gocql.UUID) ([]Message, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 50
 	}
 
-	var iter *gocql.Iter
-	const baseQ = `SELECT room_id, msg_id, user_id, content, created_at,
-                      edited_at, deleted_at, deleted_by, deleted_reason, parent_id
-               FROM room_messages`
-
+	from := 0
 	if before != nil {
-		q := baseQ + `
-            WHERE room_id = ? AND msg_id < ?
+		from = BucketOf(*before)
+	}
+	buckets, err := r.bucketsFrom(roomID, from)
+	if err != nil {
+		return nil, err
+	}
+
+	const baseQ = `SELECT ` + messageColumns + `
+               FROM room_messages_by_bucket`
+
+	msgs := make([]Message, 0, limit)
+	for _, b := range buckets {
+		var iter *gocql.Iter
+		if before != nil {
+			q := baseQ + `
+            WHERE room_id = ? AND bucket = ? AND msg_id < ?
             ORDER BY msg_id DESC
             LIMIT ?`
-		iter = r.Session.Query(q, roomID, *before, limit).Iter()
-	} else {
-		q := baseQ + `
-            WHERE room_id = ?
+			iter = r.Session.Query(q, roomID, b, *before, limit-len(msgs)).Iter()
+		} else {
+			q := baseQ + `
+            WHERE room_id = ? AND bucket = ?
             ORDER BY msg_id DESC
             LIMIT ?`
-		iter = r.Session.Query(q, roomID, limit).Iter()
+			iter = r.Session.Query(q, roomID, b, limit-len(msgs)).Iter()
+		}
+
+		var m Message
+		for iter.Scan(messageDest(&m)...) {
+			msgs = append(msgs, m)
+			m = Message{}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		if len(msgs) >= limit {
+			break
+		}
 	}
+	return msgs, nil
+}
 
-	msgs := make([]Message, 0, limit)
-	var m Message
-	for iter.Scan(&m.RoomID, &m.MsgID, &m.UserID, &m.Content, &m.CreatedAt,
-		&m.EditedAt, &m.DeletedAt, &m.DeletedBy, &m.DeletedReason, &m.ParentID) {
-		msgs = append(msgs, m)
+// ListMessagesAfter returns up to limit messages newer than after (or the
+// oldest ones), oldest first, walking forward through the room's buckets.
+func (r *Repository) ListMessagesAfter(roomID gocql.UUID, limit int, after *gocql.UUID) ([]Message, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
 	}
-	if err := iter.Close(); err != nil {
+
+	from := 0
+	if after != nil {
+		from = BucketOf(*after)
+	}
+	buckets, err := r.bucketsSince(roomID, from)
+	if err != nil {
 		return nil, err
 	}
+
+	const baseQ = `SELECT ` + messageColumns + `
+               FROM room_messages_by_bucket`
+
+	msgs := make([]Message, 0, limit)
+	for _, b := range buckets {
+		var iter *gocql.Iter
+		if after != nil {
+			q := baseQ + `
+            WHERE room_id = ? AND bucket = ? AND msg_id > ?
+            ORDER BY msg_id ASC
+            LIMIT ?`
+			iter = r.Session.Query(q, roomID, b, *after, limit-len(msgs)).Iter()
+		} else {
+			q := baseQ + `
+            WHERE room_id = ? AND bucket = ?
+            ORDER BY msg_id ASC
+            LIMIT ?`
+			iter = r.Session.Query(q, roomID, b, limit-len(msgs)).Iter()
+		}
+
+		var m Message
+		for iter.Scan(messageDest(&m)...) {
+			msgs = append(msgs, m)
+			m = Message{}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		if len(msgs) >= limit {
+			break
+		}
+	}
 	return msgs, nil
 }
 
-func (r *Repository) UpdateMessageContent(roomID, msgID gocql.UUID, newContent string, editedAt time.Time) error {
-	const q = `UPDATE room_messages
-	           SET content = ?, edited_at = ?
-	           WHERE room_id = ? AND msg_id = ?`
-	return r.Session.Query(q, newContent, editedAt, roomID, msgID).Exec()
+// UpdateMessageContent replaces the content and records the edit count; the
+// previous content should be saved with InsertRevision first.
+func (r *Repository) UpdateMessageContent(roomID, msgID gocql.UUID, newContent string, editedAt time.Time, editCount int) error {
+	ttl, err := r.messageTTL(roomID, msgID)
+	if err != nil {
+		return err
+	}
+	const q = `UPDATE room_messages_by_bucket USING TTL ?
+	           SET content = ?, edited_at = ?, edit_count = ?
+	           WHERE room_id = ? AND bucket = ? AND msg_id = ?`
+	return r.Session.Query(q, ttl, newContent, editedAt, editCount, roomID, BucketOf(msgID), msgID).Exec()
 }
 
 func (r *Repository) SoftDeleteMessage(roomID, msgID, deletedBy gocql.UUID, reason string, deletedAt time.Time) error {
-	const q = `UPDATE room_messages
+	ttl, err := r.messageTTL(roomID, msgID)
+	if err != nil {
+		return err
+	}
+	const q = `UPDATE room_messages_by_bucket USING TTL ?
 	           SET deleted_at = ?, deleted_by = ?, deleted_reason = ?
-	           WHERE room_id = ? AND msg_id = ?`
-	return r.Session.Query(q, deletedAt, deletedBy, reason, roomID, msgID).Exec()
+	           WHERE room_id = ? AND bucket = ? AND msg_id = ?`
+	return r.Session.Query(q, ttl, deletedAt, deletedBy, reason, roomID, BucketOf(msgID), msgID).Exec()
 }
 
 func (r *Repository) GetMessage(roomID, msgID gocql.UUID) (*Message, error) {
-	const q = `SELECT room_id, msg_id, user_id, content, created_at, edited_at, deleted_at, deleted_by, deleted_reason, parent_id
-           FROM room_messages
-           WHERE room_id = ? AND msg_id = ?
+	const q = `SELECT ` + messageColumns + `
+           FROM room_messages_by_bucket
+           WHERE room_id = ? AND bucket = ? AND msg_id = ?
            LIMIT 1`
 
 	var m Message
 
-	err := r.Session.Query(q, roomID, msgID).Scan(
-		&m.RoomID, &m.MsgID, &m.UserID, &m.Content, &m.CreatedAt,
-		&m.EditedAt, &m.DeletedAt, &m.DeletedBy, &m.DeletedReason, &m.ParentID,
-	)
+	err := r.Session.Query(q, roomID, BucketOf(msgID), msgID).Scan(messageDest(&m)...)
 	if err != nil {
 		return nil, err
 	}
@@ -165,11 +621,15 @@ func (r *Repository) EnsureDM(a, b gocql.UUID) (gocql.UUID, bool, error) {
 
 	// 1) lookup existing
 	var rid gocql.UUID
+	var createdAt time.Time
 	err := r.Session.Query(
-		`SELECT room_id FROM dm_threads WHERE user_a=? AND user_b=? LIMIT 1`,
+		`SELECT room_id, created_at FROM dm_threads WHERE user_a=? AND user_b=? LIMIT 1`,
 		ua, ub,
-	).Scan(&rid)
+	).Scan(&rid, &createdAt)
 	if err == nil && rid != (gocql.UUID{}) {
+		if err := r.backfillDM(rid, []gocql.UUID{ua, ub}, createdAt); err != nil {
+			return gocql.UUID{}, false, err
+		}
 		return rid, false, nil
 	}
 	if err != nil && err != gocql.ErrNotFound {
@@ -179,19 +639,16 @@ func (r *Repository) EnsureDM(a, b gocql.UUID) (gocql.UUID, bool, error) {
 	// 2) create new room
 	now := time.Now().UTC()
 	roomID := gocql.TimeUUID()
-	if err := r.Session.Query(
-		`INSERT INTO rooms (room_id, name, created_by, created_at) VALUES (?, ?, ?, ?)`,
-		roomID, "dm", ua, now,
-	).Exec(); err != nil {
+	if err := r.InsertRoom(&Room{
+		RoomID: roomID, Name: "dm", CreatedBy: ua, CreatedAt: now,
+		Kind: RoomKindDM, Visibility: VisibilityPrivate,
+	}); err != nil {
 		return gocql.UUID{}, false, err
 	}
 
 	// 3) add two participants
 	for _, uid := range []gocql.UUID{ua, ub} {
-		if err := r.Session.Query(
-			`INSERT INTO room_participants (room_id, user_id, member_role, joined_at) VALUES (?, ?, 'member', ?)`,
-			roomID, uid, now,
-		).Exec(); err != nil {
+		if err := r.AddParticipant(roomID, uid, "member", now); err != nil {
 			return gocql.UUID{}, false, err
 		}
 	}
@@ -204,9 +661,222 @@ func (r *Repository) EnsureDM(a, b gocql.UUID) (gocql.UUID, bool, error) {
 		return gocql.UUID{}, false, err
 	}
 
+	if err := r.addDMForUsers(roomID, []gocql.UUID{ua, ub}, now); err != nil {
+		return gocql.UUID{}, false, err
+	}
+
 	return roomID, true, nil
 }
 
+// backfillDM writes the participant and dms_by_user rows a thread created
+// before those tables existed lacks. Threads that have them are only read.
+func (r *Repository) backfillDM(roomID gocql.UUID, members []gocql.UUID, createdAt time.Time) error {
+	for _, uid := range members {
+		in, err := r.IsParticipant(roomID, uid)
+		if err != nil {
+			return err
+		}
+		if !in {
+			if err := r.AddParticipant(roomID, uid, "member", createdAt); err != nil {
+				return err
+			}
+		}
+		dm, err := r.GetDMByUser(uid, roomID)
+		if err != nil {
+			return err
+		}
+		if dm == nil {
+			if err := r.Session.Query(
+				`INSERT INTO dms_by_user (user_id, room_id, participants, created_at) VALUES (?, ?, ?, ?)`,
+				uid, roomID, members, createdAt,
+			).Exec(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DMKey returns the canonical key of a participant set: the sorted,
+// de-duplicated ids joined by commas.
+func DMKey(members []gocql.UUID) string {
+	ids := make([]string, 0, len(members))
+	seen := make(map[gocql.UUID]struct{}, len(members))
+	for _, m := range members {
+		if _, ok := seen[m]; ok {
+			continue
+		}
+		seen[m] = struct{}{}
+		ids = append(ids, m.String())
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// EnsureGroupDM returns the DM room for the given participant set; creates it if missing.
+// Two-person sets are delegated to EnsureDM so they keep using dm_threads.
+// Every participant must be an existing user, since the set is claimed for good.
+func (r *Repository) EnsureGroupDM(createdBy gocql.UUID, members []gocql.UUID) (gocql.UUID, bool, error) {
+	key := DMKey(members)
+	ids := strings.Split(key, ",")
+	for _, s := range ids {
+		id, _ := gocql.ParseUUID(s)
+		name, err := r.GetUsername(id)
+		if err != nil {
+			return gocql.UUID{}, false, err
+		}
+		if name == "" {
+			return gocql.UUID{}, false, fmt.Errorf("user %s not found", id)
+		}
+	}
+	if len(ids) == 2 {
+		a, _ := gocql.ParseUUID(ids[0])
+		b, _ := gocql.ParseUUID(ids[1])
+		return r.EnsureDM(a, b)
+	}
+
+	// 1) lookup existing
+	var rid gocql.UUID
+	err := r.Session.Query(
+		`SELECT room_id FROM dm_groups WHERE participants_key = ? LIMIT 1`, key,
+	).Scan(&rid)
+	if err == nil && rid != (gocql.UUID{}) {
+		return rid, false, nil
+	}
+	if err != nil && err != gocql.ErrNotFound {
+		return gocql.UUID{}, false, err
+	}
+
+	// 2) claim the key; a concurrent creator may win the race
+	now := time.Now().UTC()
+	roomID := gocql.TimeUUID()
+	set := make([]gocql.UUID, 0, len(ids))
+	for _, s := range ids {
+		u, _ := gocql.ParseUUID(s)
+		set = append(set, u)
+	}
+	existing := map[string]interface{}{}
+	applied, err := r.Session.Query(
+		`INSERT INTO dm_groups (participants_key, room_id, participants, created_at) VALUES (?, ?, ?, ?) IF NOT EXISTS`,
+		key, roomID, set, now,
+	).Consistency(gocql.Quorum).MapScanCAS(existing)
+	if err != nil {
+		return gocql.UUID{}, false, err
+	}
+	if !applied {
+		if id, ok := existing["room_id"].(gocql.UUID); ok {
+			return id, false, nil
+		}
+		return gocql.UUID{}, false, gocql.ErrNotFound
+	}
+
+	// 3) create room and participants
+	if err := r.InsertRoom(&Room{
+		RoomID: roomID, Name: "group", CreatedBy: createdBy, CreatedAt: now,
+		Kind: RoomKindGroupDM, Visibility: VisibilityPrivate,
+	}); err != nil {
+		return gocql.UUID{}, false, err
+	}
+	for _, uid := range set {
+		if err := r.AddParticipant(roomID, uid, "member", now); err != nil {
+			return gocql.UUID{}, false, err
+		}
+	}
+
+	if err := r.addDMForUsers(roomID, set, now); err != nil {
+		return gocql.UUID{}, false, err
+	}
+	return roomID, true, nil
+}
+
+func (r *Repository) addDMForUsers(roomID gocql.UUID, members []gocql.UUID, createdAt time.Time) error {
+	for _, uid := range members {
+		if err := r.Session.Query(
+			`INSERT INTO dms_by_user (user_id, room_id, participants, created_at) VALUES (?, ?, ?, ?)`,
+			uid, roomID, members, createdAt,
+		).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DMThread is one row of a user's DM listing.
+type DMThread struct {
+	RoomID       gocql.UUID
+	Participants []gocql.UUID
+	CreatedAt    time.Time
+}
+
+// ListDMsByUser returns the DM rooms userID takes part in.
+func (r *Repository) ListDMsByUser(userID gocql.UUID) ([]DMThread, error) {
+	iter := r.Session.Query(
+		`SELECT room_id, participants, created_at FROM dms_by_user WHERE user_id = ?`, userID,
+	).Iter()
+
+	var out []DMThread
+	var t DMThread
+	for iter.Scan(&t.RoomID, &t.Participants, &t.CreatedAt) {
+		out = append(out, t)
+		t = DMThread{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetDMByUser returns userID's DM row for roomID, or nil when userID is not in that DM.
+func (r *Repository) GetDMByUser(userID, roomID gocql.UUID) (*DMThread, error) {
+	t := &DMThread{RoomID: roomID}
+	err := r.Session.Query(
+		`SELECT participants, created_at FROM dms_by_user WHERE user_id = ? AND room_id = ?`,
+		userID, roomID,
+	).Scan(&t.Participants, &t.CreatedAt)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LatestMessage returns the newest message in roomID, or nil if the room is empty.
+func (r *Repository) LatestMessage(roomID gocql.UUID) (*Message, error) {
+	msgs, err := r.ListMessages(roomID, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	return &msgs[0], nil
+}
+
+// GetUsername returns the username for userID, or "" if the user does not exist.
+func (r *Repository) GetUsername(userID gocql.UUID) (string, error) {
+	var username string
+	err := r.Session.Query(`SELECT username FROM users WHERE id = ? LIMIT 1`, userID).Scan(&username)
+	if err == gocql.ErrNotFound {
+		return "", nil
+	}
+	return username, err
+}
+
+// GetUserIDByUsername returns the id of username, or ok=false if no user has it.
+func (r *Repository) GetUserIDByUsername(username string) (gocql.UUID, bool, error) {
+	var id gocql.UUID
+	err := r.Session.Query(`SELECT user_id FROM users_by_username WHERE username = ?`, username).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return gocql.UUID{}, false, nil
+	}
+	if err != nil {
+		return gocql.UUID{}, false, err
+	}
+	return id, true, nil
+}
+
 // IsParticipant checks if userID belongs to roomID.
 func (r *Repository) IsParticipant(roomID, userID gocql.UUID) (bool, error) {
 	var u gocql.UUID
@@ -232,5 +902,3 @@ func (r *Repository) RoomHasParticipants(roomID gocql.UUID) (bool, error) {
 	}
 	return err == nil, err
 }
-
-
@@ -0,0 +1,387 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+)
+
+// Retention is enforced in two places: new messages are written with a
+// Scylla TTL derived from the room's policy, and a background worker purges
+// what TTLs cannot cover (messages written before a policy was shortened and
+// soft-deleted messages, found through their own index in
+// retention_deleted.go). A legal hold on a room suspends both; the TTLs of
+// existing messages are cleared by a job (retention_jobs.go).
+
+const maxRetentionDays = 36500
+
+// RetentionConfig holds the workspace-wide defaults used by rooms without
+// their own policy. Zero days keeps messages forever.
+type RetentionConfig struct {
+	RetentionDays        int
+	DeletedRetentionDays int
+	Interval             time.Duration
+	DryRun               bool // the worker only logs what it would purge
+}
+
+// RetentionConfigFromEnv reads RETENTION_DAYS, DELETED_RETENTION_DAYS,
+// RETENTION_INTERVAL and RETENTION_DRY_RUN.
+func RetentionConfigFromEnv() RetentionConfig {
+	cfg := RetentionConfig{Interval: time.Hour}
+	cfg.RetentionDays, _ = strconv.Atoi(utils.GetEnv("RETENTION_DAYS", "0"))
+	cfg.DeletedRetentionDays, _ = strconv.Atoi(utils.GetEnv("DELETED_RETENTION_DAYS", "0"))
+	if d, err := time.ParseDuration(utils.GetEnv("RETENTION_INTERVAL", "1h")); err == nil && d > 0 {
+		cfg.Interval = d
+	}
+	cfg.DryRun, _ = strconv.ParseBool(utils.GetEnv("RETENTION_DRY_RUN", "false"))
+	return cfg
+}
+
+// RetentionPolicy is the effective policy of a room after defaults apply.
+type RetentionPolicy struct {
+	RetentionDays        int  `json:"retentionDays"`
+	DeletedRetentionDays int  `json:"deletedRetentionDays"`
+	LegalHold            bool `json:"legalHold"`
+}
+
+// RetentionReport describes what a purge pass removed, or would remove when
+// DryRun is set.
+type RetentionReport struct {
+	RoomID        gocql.UUID      `json:"roomId"`
+	Policy        RetentionPolicy `json:"policy"`
+	Expired       int             `json:"expiredMessages"`
+	DeletedPurged int             `json:"purgedDeletedMessages"`
+	DryRun        bool            `json:"dryRun"`
+}
+
+func (s *Service) retentionPolicy(room *Room) RetentionPolicy {
+	p := RetentionPolicy{
+		RetentionDays:        s.Retention.RetentionDays,
+		DeletedRetentionDays: s.Retention.DeletedRetentionDays,
+		LegalHold:            room.LegalHold,
+	}
+	if room.RetentionDays != nil {
+		p.RetentionDays = *room.RetentionDays
+	}
+	if room.DeletedRetentionDays != nil {
+		p.DeletedRetentionDays = *room.DeletedRetentionDays
+	}
+	return p
+}
+
+// retentionTTL is the TTL the room's retention policy puts on new messages,
+// zero for none.
+func (s *Service) retentionTTL(room *Room) time.Duration {
+	p := s.retentionPolicy(room)
+	if p.LegalHold || p.RetentionDays <= 0 {
+		return 0
+	}
+	return time.Duration(p.RetentionDays) * 24 * time.Hour
+}
+
+// UpdateRetention changes a room's retention policy. Days of -1 clear the
+// room's own value so the workspace default applies again. When existing
+// messages must lose their TTLs it also returns the job doing that; the
+// change has not fully taken effect until the job is done.
+func (s *Service) UpdateRetention(roomID, userID gocql.UUID, req UpdateRetentionRequest) (*Room, *RetentionJob, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, nil, err
+	}
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	before := s.retentionPolicy(room)
+
+	set := RetentionSettings{LegalHold: req.LegalHold}
+	for _, f := range []struct {
+		in  *int
+		out **int
+	}{{req.RetentionDays, &set.RetentionDays}, {req.DeletedRetentionDays, &set.DeletedRetentionDays}} {
+		if f.in == nil {
+			continue
+		}
+		if *f.in < -1 || *f.in > maxRetentionDays {
+			return nil, nil, errors.New("invalid retention days")
+		}
+		v := *f.in
+		*f.out = &v
+	}
+
+	if err := s.Repo.SetRoomRetention(roomID, set, time.Now().UTC()); err != nil {
+		return nil, nil, err
+	}
+	room, err = s.loadRoom(roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Deleted messages were filed for purging under the old policy, if any.
+	after := s.retentionPolicy(room)
+	if after.DeletedRetentionDays > 0 &&
+		(before.DeletedRetentionDays <= 0 || after.DeletedRetentionDays < before.DeletedRetentionDays) {
+		go s.indexDeletedMessages(room)
+	}
+
+	// Existing messages carry TTLs from the old policy. When the new one
+	// keeps them longer, drop the TTLs and let the worker apply the policy.
+	reason := ""
+	switch {
+	case after.LegalHold && !before.LegalHold:
+		reason = retentionJobLegalHold
+	case !after.LegalHold && keepsLonger(after.RetentionDays, before.RetentionDays):
+		reason = retentionJobLonger
+	default:
+		return room, nil, nil
+	}
+	job, err := s.startRetentionJob(roomID, reason)
+	if err != nil {
+		return nil, nil, err
+	}
+	return room, job, nil
+}
+
+func keepsLonger(after, before int) bool {
+	if before <= 0 {
+		return false
+	}
+	return after <= 0 || after > before
+}
+
+// PreviewRetention reports what the next purge would remove from a room
+// without deleting anything.
+func (s *Service) PreviewRetention(roomID, userID gocql.UUID) (*RetentionReport, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return s.purgeRoom(room, time.Now().UTC(), true, true)
+}
+
+// RunRetention purges expired messages every Retention.Interval, and takes
+// over stalled TTL-clearing jobs, while this replica is the leader, until
+// ctx is done.
+func (s *Service) RunRetention(ctx context.Context, isLeader func() bool) {
+	purge := time.NewTicker(s.Retention.Interval)
+	defer purge.Stop()
+	jobs := time.NewTicker(retentionJobTick)
+	defer jobs.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-purge.C:
+			if isLeader() {
+				s.PurgeExpired(s.Retention.DryRun)
+			}
+		case <-jobs.C:
+			if isLeader() {
+				s.resumeRetentionJobs(ctx)
+			}
+		}
+	}
+}
+
+// PurgeExpired applies every room's retention policy once and logs a summary.
+func (s *Service) PurgeExpired(dryRun bool) {
+	now := time.Now().UTC()
+	var expired, deleted int
+	touched := map[gocql.UUID]bool{}
+	for roomID, n := range s.purgeDeleted(now, dryRun) {
+		touched[roomID] = true
+		deleted += n
+	}
+	err := s.Repo.EachRoom(func(room *Room) error {
+		rep, err := s.purgeRoom(room, now, dryRun, false)
+		if err != nil {
+			log.Printf("retention: room %s: %v", room.RoomID, err)
+			return nil
+		}
+		if rep.Expired > 0 {
+			touched[room.RoomID] = true
+			expired += rep.Expired
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("retention: scan rooms: %v", err)
+	}
+	if rooms := len(touched); rooms > 0 {
+		verb := "purged"
+		if dryRun {
+			verb = "would purge"
+		}
+		log.Printf("retention: %s %d expired and %d deleted messages in %d rooms", verb, expired, deleted, rooms)
+	}
+}
+
+// purgeRoom purges the room's messages past its retention. The worker finds
+// soft-deleted messages through their index (purgeDeleted); deleted also
+// looks for them in the room's buckets, for a preview.
+func (s *Service) purgeRoom(room *Room, now time.Time, dryRun, deleted bool) (*RetentionReport, error) {
+	p := s.retentionPolicy(room)
+	rep := &RetentionReport{RoomID: room.RoomID, Policy: p, DryRun: dryRun}
+	if !deleted {
+		p.DeletedRetentionDays = 0
+	}
+	if p.LegalHold || (p.RetentionDays <= 0 && p.DeletedRetentionDays <= 0) {
+		return rep, nil
+	}
+	cutoff := now.AddDate(0, 0, -p.RetentionDays)
+	deletedCutoff := now.AddDate(0, 0, -p.DeletedRetentionDays)
+
+	buckets, err := s.Repo.bucketsSince(room.RoomID, 0)
+	if err != nil {
+		return nil, err
+	}
+	current := bucketOfTime(now)
+	for _, b := range buckets {
+		// Only soft-deleted messages can be due in buckets past the cutoff.
+		if p.DeletedRetentionDays <= 0 && b > bucketOfTime(cutoff) {
+			break
+		}
+		kept := 0
+		err := s.Repo.eachBucketMessage(room.RoomID, b, func(m *Message) error {
+			switch {
+			case p.RetentionDays > 0 && m.MsgID.Time().Before(cutoff):
+				rep.Expired++
+			case p.DeletedRetentionDays > 0 && m.DeletedAt != nil && m.DeletedAt.Before(deletedCutoff):
+				rep.DeletedPurged++
+			default:
+				kept++
+				return nil
+			}
+			if dryRun {
+				return nil
+			}
+			return s.Repo.PurgeMessage(room.RoomID, m.MsgID)
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Past months receive no new messages, so an emptied one can go.
+		if kept == 0 && b < current && !dryRun {
+			if err := s.Repo.DropBucket(room.RoomID, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rep, nil
+}
+
+// RetentionSettings holds the optional fields of a retention update; nil
+// means unchanged and -1 clears the room's own value.
+type RetentionSettings struct {
+	RetentionDays        *int
+	DeletedRetentionDays *int
+	LegalHold            *bool
+}
+
+func (r *Repository) SetRoomRetention(roomID gocql.UUID, set RetentionSettings, updatedAt time.Time) error {
+	cols := []string{"updated_at = ?"}
+	args := []interface{}{updatedAt}
+	for _, f := range []struct {
+		col string
+		v   *int
+	}{{"retention_days", set.RetentionDays}, {"deleted_retention_days", set.DeletedRetentionDays}} {
+		if f.v == nil {
+			continue
+		}
+		cols = append(cols, f.col+" = ?")
+		if *f.v < 0 {
+			args = append(args, nil)
+		} else {
+			args = append(args, *f.v)
+		}
+	}
+	if set.LegalHold != nil {
+		cols = append(cols, "legal_hold = ?")
+		args = append(args, *set.LegalHold)
+	}
+	q := `UPDATE rooms SET ` + strings.Join(cols, ", ") + ` WHERE room_id = ?`
+	return r.Session.Query(q, append(args, roomID)...).Exec()
+}
+
+// EachRoom calls fn for every room, paging through the table.
+func (r *Repository) EachRoom(fn func(*Room) error) error {
+	iter := r.Session.Query(`SELECT ` + roomColumns + ` FROM rooms`).PageSize(500).Iter()
+	var rm Room
+	for iter.Scan(roomDest(&rm)...) {
+		if err := fn(&rm); err != nil {
+			_ = iter.Close()
+			return err
+		}
+		rm = Room{}
+	}
+	return iter.Close()
+}
+
+func (r *Repository) eachBucketMessage(roomID gocql.UUID, bucket int, fn func(*Message) error) error {
+	iter := r.Session.Query(
+		`SELECT `+messageColumns+` FROM room_messages_by_bucket WHERE room_id = ? AND bucket = ?`,
+		roomID, bucket,
+	).PageSize(500).Iter()
+	var m Message
+	for iter.Scan(messageDest(&m)...) {
+		if err := fn(&m); err != nil {
+			_ = iter.Close()
+			return err
+		}
+		m = Message{}
+	}
+	return iter.Close()
+}
+
+// PurgeMessage hard-deletes a message and its edit history.
+func (r *Repository) PurgeMessage(roomID, msgID gocql.UUID) error {
+	if err := r.Session.Query(
+		`DELETE FROM room_messages_by_bucket WHERE room_id = ? AND bucket = ? AND msg_id = ?`,
+		roomID, BucketOf(msgID), msgID,
+	).Exec(); err != nil {
+		return err
+	}
+	return r.Session.Query(
+		`DELETE FROM message_revisions WHERE room_id = ? AND msg_id = ?`, roomID, msgID,
+	).Exec()
+}
+
+// DropBucket removes an emptied bucket from the room's bucket index.
+func (r *Repository) DropBucket(roomID gocql.UUID, bucket int) error {
+	return r.Session.Query(
+		`DELETE FROM room_message_buckets WHERE room_id = ? AND bucket = ?`, roomID, bucket,
+	).Exec()
+}
+
+// messageTTL returns the remaining TTL of a stored message in seconds, zero
+// if it has none, so updates to the row expire along with it.
+func (r *Repository) messageTTL(roomID, msgID gocql.UUID) (int, error) {
+	var ttl *int
+	err := r.Session.Query(
+		`SELECT TTL(user_id) FROM room_messages_by_bucket WHERE room_id = ? AND bucket = ? AND msg_id = ?`,
+		roomID, BucketOf(msgID), msgID,
+	).Scan(&ttl)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil || ttl == nil {
+		return 0, err
+	}
+	return *ttl, nil
+}
+
+func ttlSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(d / time.Second)
+}
@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Soft-deleted messages are purged DeletedRetentionDays after deletion.
+// Rather than scanning every room for them, a delete files the message in
+// deleted_message_due (migration 027) under the day it becomes due, and the
+// retention worker reads the days up to today. The policy is checked again
+// when an entry comes due: a longer policy or a legal hold files it again
+// later, and a room that now keeps deleted messages drops it. Messages
+// deleted while their room kept deleted messages forever are filed when the
+// room is given a policy (indexDeletedMessages); a new workspace default only
+// covers messages deleted after it is set.
+
+// Days the worker looks back for entries it missed, e.g. while no replica
+// was leader.
+const deletedDueLookback = 90
+
+func dueDay(t time.Time) int64 { return t.Unix() / 86400 }
+
+type deletedEntry struct {
+	Day    int64
+	RoomID gocql.UUID
+	MsgID  gocql.UUID
+}
+
+// queueDeletedPurge files a message deleted at deletedAt for purging, if the
+// room's policy purges deleted messages.
+func (s *Service) queueDeletedPurge(room *Room, msgID gocql.UUID, deletedAt time.Time) {
+	p := s.retentionPolicy(room)
+	if p.DeletedRetentionDays <= 0 {
+		return
+	}
+	day := dueDay(deletedAt.AddDate(0, 0, p.DeletedRetentionDays))
+	if err := s.Repo.InsertDeletedDue(deletedEntry{Day: day, RoomID: room.RoomID, MsgID: msgID}); err != nil {
+		log.Printf("⚠️ queue purge of deleted message %s: %v", msgID, err)
+	}
+}
+
+// indexDeletedMessages files the room's soft-deleted messages for purging,
+// after a policy change made them due sooner than they were filed, if at all.
+func (s *Service) indexDeletedMessages(room *Room) {
+	buckets, err := s.Repo.bucketsSince(room.RoomID, 0)
+	if err != nil {
+		log.Printf("retention: index deleted messages of room %s: %v", room.RoomID, err)
+		return
+	}
+	for _, b := range buckets {
+		err := s.Repo.eachBucketMessage(room.RoomID, b, func(m *Message) error {
+			if m.DeletedAt != nil {
+				s.queueDeletedPurge(room, m.MsgID, *m.DeletedAt)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("retention: index deleted messages of room %s: %v", room.RoomID, err)
+			return
+		}
+	}
+}
+
+// purgeDeleted purges the soft-deleted messages due by now and returns how
+// many it purged, or would purge, in each room.
+func (s *Service) purgeDeleted(now time.Time, dryRun bool) map[gocql.UUID]int {
+	purged := map[gocql.UUID]int{}
+	policies := map[gocql.UUID]*RetentionPolicy{}
+	for d := dueDay(now) - deletedDueLookback; d <= dueDay(now); d++ {
+		entries, err := s.Repo.DeletedDue(d)
+		if err != nil {
+			log.Printf("retention: deleted messages due on day %d: %v", d, err)
+			continue
+		}
+		for _, e := range entries {
+			ok, err := s.purgeDeletedEntry(e, now, dryRun, policies)
+			if err != nil {
+				log.Printf("retention: deleted message %s: %v", e.MsgID, err)
+				continue
+			}
+			if ok {
+				purged[e.RoomID]++
+			}
+		}
+	}
+	return purged
+}
+
+// purgeDeletedEntry purges the entry's message if the room's current policy
+// says it is due, refiling or dropping the entry otherwise.
+func (s *Service) purgeDeletedEntry(e deletedEntry, now time.Time, dryRun bool, policies map[gocql.UUID]*RetentionPolicy) (bool, error) {
+	m, err := s.Repo.GetMessage(e.RoomID, e.MsgID)
+	if err == gocql.ErrNotFound || (err == nil && m.DeletedAt == nil) {
+		return false, s.dropDeletedEntry(e, dryRun)
+	}
+	if err != nil {
+		return false, err
+	}
+	p, ok := policies[e.RoomID]
+	if !ok {
+		room, err := s.Repo.GetRoom(e.RoomID)
+		if err != nil && err != gocql.ErrNotFound {
+			return false, err
+		}
+		if room != nil {
+			rp := s.retentionPolicy(room)
+			p = &rp
+		}
+		policies[e.RoomID] = p
+	}
+	if p == nil || p.DeletedRetentionDays <= 0 {
+		return false, s.dropDeletedEntry(e, dryRun)
+	}
+	due := m.DeletedAt.AddDate(0, 0, p.DeletedRetentionDays)
+	switch {
+	case p.LegalHold:
+		return false, s.refileDeletedEntry(e, dueDay(now)+1, dryRun)
+	case due.After(now):
+		if dueDay(due) > e.Day {
+			return false, s.refileDeletedEntry(e, dueDay(due), dryRun)
+		}
+		return false, nil // later today
+	}
+	if dryRun {
+		return true, nil
+	}
+	if err := s.Repo.PurgeMessage(e.RoomID, e.MsgID); err != nil {
+		return false, err
+	}
+	return true, s.Repo.DeleteDeletedDue(e)
+}
+
+func (s *Service) dropDeletedEntry(e deletedEntry, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	return s.Repo.DeleteDeletedDue(e)
+}
+
+func (s *Service) refileDeletedEntry(e deletedEntry, day int64, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	next := e
+	next.Day = day
+	if err := s.Repo.InsertDeletedDue(next); err != nil {
+		return err
+	}
+	return s.Repo.DeleteDeletedDue(e)
+}
+
+func (r *Repository) InsertDeletedDue(e deletedEntry) error {
+	// Outlive the due day by the worker's lookback so a new leader still
+	// finds it.
+	ttl := time.Until(time.Unix((e.Day+1)*86400, 0)) + deletedDueLookback*24*time.Hour
+	return r.Session.Query(
+		`INSERT INTO deleted_message_due (due_day, room_id, msg_id) VALUES (?, ?, ?) USING TTL ?`,
+		e.Day, e.RoomID, e.MsgID, ttlSeconds(ttl),
+	).Exec()
+}
+
+func (r *Repository) DeletedDue(day int64) ([]deletedEntry, error) {
+	iter := r.Session.Query(`SELECT room_id, msg_id FROM deleted_message_due WHERE due_day = ?`, day).
+		PageSize(500).Iter()
+	var out []deletedEntry
+	e := deletedEntry{Day: day}
+	for iter.Scan(&e.RoomID, &e.MsgID) {
+		out = append(out, e)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repository) DeleteDeletedDue(e deletedEntry) error {
+	return r.Session.Query(
+		`DELETE FROM deleted_message_due WHERE due_day = ? AND room_id = ? AND msg_id = ?`,
+		e.Day, e.RoomID, e.MsgID,
+	).Exec()
+}
@@ -0,0 +1,367 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// When a legal hold is placed or a policy starts keeping messages longer,
+// the TTLs existing messages were written with must go before they fire.
+// That is a pass over every message of the room, so it runs as a job whose
+// progress lives in retention_jobs (migration 025) and is reported by the
+// API. The replica that took the request runs it at once; if that replica
+// dies the retention worker on the leader takes the job over once its
+// heartbeat is stale. Each runner holds the row by its updated_at and loses
+// it when another runner or a newer job for the room writes the row.
+//
+// Messages are rewritten with conditional updates of their own cells so an
+// edit or delete racing the job is not reverted, and messages carrying the
+// room's disappearing timer keep it.
+
+const (
+	RetentionJobPending = "pending"
+	RetentionJobRunning = "running"
+	RetentionJobDone    = "done"
+	RetentionJobFailed  = "failed"
+
+	retentionJobLegalHold = "legal_hold"
+	retentionJobLonger    = "longer_retention"
+
+	// A running job renews its lease this often; one not renewed for
+	// retentionJobStale is taken over.
+	retentionJobHeartbeat = 20 * time.Second
+	retentionJobStale     = 2 * time.Minute
+	retentionJobTick      = time.Minute
+	// Passes over the room stop once one finds nothing left to clear,
+	// which catches writes that raced the previous pass.
+	retentionJobPasses = 3
+	// Conditional updates of one message before giving up on it.
+	clearTTLAttempts = 5
+)
+
+var errRetentionJobLost = errors.New("job superseded or taken over")
+
+// RetentionJob is the latest TTL-clearing job of a room.
+type RetentionJob struct {
+	RoomID      gocql.UUID `json:"roomId"`
+	JobID       gocql.UUID `json:"jobId"`
+	Reason      string     `json:"reason"`
+	Status      string     `json:"status"`
+	Messages    int        `json:"clearedMessages"`
+	Error       string     `json:"error,omitempty"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Finished reports whether the job has stopped, successfully or not.
+func (j *RetentionJob) Finished() bool {
+	return j.Status == RetentionJobDone || j.Status == RetentionJobFailed
+}
+
+// jobTime is a timestamp as Scylla stores it, so leases compare equal.
+func jobTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// startRetentionJob records a new job for the room, replacing any earlier
+// one, and starts running it.
+func (s *Service) startRetentionJob(roomID gocql.UUID, reason string) (*RetentionJob, error) {
+	now := jobTime()
+	job := &RetentionJob{
+		RoomID:      roomID,
+		JobID:       gocql.TimeUUID(),
+		Reason:      reason,
+		Status:      RetentionJobPending,
+		RequestedAt: now,
+		UpdatedAt:   now,
+	}
+	if err := s.Repo.InsertRetentionJob(job); err != nil {
+		return nil, err
+	}
+	started := *job
+	go s.runRetentionJob(&started)
+	return job, nil
+}
+
+// RetentionJob returns the room's latest TTL-clearing job.
+func (s *Service) RetentionJob(roomID, userID gocql.UUID) (*RetentionJob, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	job, err := s.Repo.GetRetentionJob(roomID)
+	if err == gocql.ErrNotFound {
+		return nil, errors.New("retention job not found")
+	}
+	return job, err
+}
+
+// runRetentionJob runs job, whose row the caller last saw with job.UpdatedAt.
+func (s *Service) runRetentionJob(job *RetentionJob) {
+	lease := job.UpdatedAt
+	job.Status = RetentionJobRunning
+	if err := s.saveRetentionJob(job, &lease); err != nil {
+		return
+	}
+	log.Printf("retention: clearing ttls in room %s (%s)", job.RoomID, job.Reason)
+
+	err := s.clearRoomTTLs(job, &lease)
+	if err == errRetentionJobLost {
+		return
+	}
+	job.Status, job.Error = RetentionJobDone, ""
+	if err != nil {
+		log.Printf("❌ retention: clear ttls in room %s: %v", job.RoomID, err)
+		job.Status, job.Error = RetentionJobFailed, err.Error()
+	}
+	now := jobTime()
+	job.FinishedAt = &now
+	if s.saveRetentionJob(job, &lease) == nil && err == nil {
+		log.Printf("✅ retention: cleared ttls of %d messages in room %s", job.Messages, job.RoomID)
+	}
+}
+
+// saveRetentionJob writes job if the row is still held by lease, renewing
+// the lease. It returns errRetentionJobLost when the row has moved on.
+func (s *Service) saveRetentionJob(job *RetentionJob, lease *time.Time) error {
+	job.UpdatedAt = jobTime()
+	ok, err := s.Repo.UpdateRetentionJob(job, *lease)
+	if err != nil {
+		log.Printf("❌ retention: save job %s of room %s: %v", job.JobID, job.RoomID, err)
+		return errRetentionJobLost
+	}
+	if !ok {
+		log.Printf("retention: job %s of room %s was superseded or taken over", job.JobID, job.RoomID)
+		return errRetentionJobLost
+	}
+	*lease = job.UpdatedAt
+	return nil
+}
+
+// clearRoomTTLs removes the TTLs of the room's messages and revisions,
+// counting cleared messages in job.Messages.
+func (s *Service) clearRoomTTLs(job *RetentionJob, lease *time.Time) error {
+	for pass := 0; pass < retentionJobPasses; pass++ {
+		buckets, err := s.Repo.bucketsSince(job.RoomID, 0)
+		if err != nil {
+			return err
+		}
+		cleared := 0
+		for _, b := range buckets {
+			err := s.Repo.eachExpiringMessage(job.RoomID, b, func(m *Message, ttl int) error {
+				if ttl > 0 && !m.Disappearing {
+					ok, err := s.Repo.ClearMessageTTL(m)
+					if err != nil {
+						return err
+					}
+					if ok {
+						cleared++
+						job.Messages++
+					}
+				}
+				if m.EditCount > 0 && !m.Disappearing {
+					n, err := s.Repo.ClearRevisionTTLs(m.RoomID, m.MsgID)
+					if err != nil {
+						return err
+					}
+					cleared += n
+				}
+				if time.Since(*lease) > retentionJobHeartbeat {
+					return s.saveRetentionJob(job, lease)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if cleared == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// resumeRetentionJobs takes over jobs whose runner stopped renewing them.
+func (s *Service) resumeRetentionJobs(ctx context.Context) {
+	var stale []RetentionJob
+	err := s.Repo.EachRetentionJob(func(j *RetentionJob) error {
+		if !j.Finished() && time.Since(j.UpdatedAt) > retentionJobStale {
+			stale = append(stale, *j)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("retention: scan jobs: %v", err)
+	}
+	for i := range stale {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("retention: resuming job %s of room %s", stale[i].JobID, stale[i].RoomID)
+		s.runRetentionJob(&stale[i])
+	}
+}
+
+const retentionJobColumns = `room_id, job_id, reason, status, messages, error, requested_at, updated_at, finished_at`
+
+func retentionJobDest(j *RetentionJob) []interface{} {
+	return []interface{}{&j.RoomID, &j.JobID, &j.Reason, &j.Status, &j.Messages, &j.Error,
+		&j.RequestedAt, &j.UpdatedAt, &j.FinishedAt}
+}
+
+func (r *Repository) InsertRetentionJob(j *RetentionJob) error {
+	return r.Session.Query(`INSERT INTO retention_jobs (`+retentionJobColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		j.RoomID, j.JobID, j.Reason, j.Status, j.Messages, j.Error, j.RequestedAt, j.UpdatedAt, j.FinishedAt,
+	).Exec()
+}
+
+// UpdateRetentionJob writes the job's progress if the row still belongs to
+// the job and was last written at lease.
+func (r *Repository) UpdateRetentionJob(j *RetentionJob, lease time.Time) (bool, error) {
+	return r.Session.Query(`UPDATE retention_jobs
+	                        SET status = ?, messages = ?, error = ?, updated_at = ?, finished_at = ?
+	                        WHERE room_id = ? IF job_id = ? AND updated_at = ?`,
+		j.Status, j.Messages, j.Error, j.UpdatedAt, j.FinishedAt, j.RoomID, j.JobID, lease,
+	).MapScanCAS(map[string]interface{}{})
+}
+
+func (r *Repository) GetRetentionJob(roomID gocql.UUID) (*RetentionJob, error) {
+	var j RetentionJob
+	err := r.Session.Query(`SELECT `+retentionJobColumns+` FROM retention_jobs WHERE room_id = ?`, roomID).
+		Consistency(gocql.Quorum).Scan(retentionJobDest(&j)...)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (r *Repository) EachRetentionJob(fn func(*RetentionJob) error) error {
+	iter := r.Session.Query(`SELECT ` + retentionJobColumns + ` FROM retention_jobs`).PageSize(500).Iter()
+	var j RetentionJob
+	for iter.Scan(retentionJobDest(&j)...) {
+		if err := fn(&j); err != nil {
+			_ = iter.Close()
+			return err
+		}
+		j = RetentionJob{}
+	}
+	return iter.Close()
+}
+
+// eachExpiringMessage is eachBucketMessage with the longest TTL left on the
+// cells that carry one.
+func (r *Repository) eachExpiringMessage(roomID gocql.UUID, bucket int, fn func(*Message, int) error) error {
+	iter := r.Session.Query(
+		`SELECT `+messageColumns+`, TTL(user_id), TTL(content), TTL(deleted_at)
+		 FROM room_messages_by_bucket WHERE room_id = ? AND bucket = ?`,
+		roomID, bucket,
+	).PageSize(500).Iter()
+	var (
+		m    Message
+		ttls [3]*int
+	)
+	for iter.Scan(append(messageDest(&m), &ttls[0], &ttls[1], &ttls[2])...) {
+		ttl := 0
+		for _, t := range ttls {
+			if t != nil && *t > ttl {
+				ttl = *t
+			}
+		}
+		if err := fn(&m, ttl); err != nil {
+			_ = iter.Close()
+			return err
+		}
+		m, ttls = Message{}, [3]*int{}
+	}
+	return iter.Close()
+}
+
+// ClearMessageTTL rewrites the cells m has without a TTL and drops its
+// expires_at. The write only applies while the message is as m describes
+// it; after an edit or delete the message is read again and the rewrite
+// retried, so the change is never reverted. It reports false when the
+// message is gone.
+func (r *Repository) ClearMessageTTL(m *Message) (bool, error) {
+	for attempt := 0; attempt < clearTTLAttempts; attempt++ {
+		cols := []string{"user_id = ?", "content = ?", "created_at = ?", "expires_at = null"}
+		args := []interface{}{m.UserID, m.Content, m.CreatedAt}
+		for _, c := range []struct {
+			col string
+			set bool
+			v   interface{}
+		}{
+			{"edited_at", m.EditedAt != nil, m.EditedAt},
+			{"edit_count", m.EditedAt != nil, m.EditCount},
+			{"deleted_at", m.DeletedAt != nil, m.DeletedAt},
+			{"deleted_by", m.DeletedBy != nil, m.DeletedBy},
+			{"deleted_reason", m.DeletedReason != nil, m.DeletedReason},
+			{"parent_id", m.ParentID != nil, m.ParentID},
+			{"kind", m.Kind != "", m.Kind},
+			{"poll_id", m.PollID != nil, m.PollID},
+			{"webhook_id", m.WebhookID != nil, m.WebhookID},
+			{"author_name", m.AuthorName != "", m.AuthorName},
+			{"author_avatar", m.AuthorAvatar != "", m.AuthorAvatar},
+			{"attachments", len(m.Attachments) > 0, m.Attachments},
+			{"actor_id", m.ActorID != nil, m.ActorID},
+		} {
+			if c.set {
+				cols = append(cols, c.col+" = ?")
+				args = append(args, c.v)
+			}
+		}
+		q := `UPDATE room_messages_by_bucket USING TTL 0 SET ` + strings.Join(cols, ", ") + `
+		      WHERE room_id = ? AND bucket = ? AND msg_id = ?
+		      IF user_id = ? AND edited_at = ? AND deleted_at = ?`
+		args = append(args, m.RoomID, BucketOf(m.MsgID), m.MsgID, m.UserID, m.EditedAt, m.DeletedAt)
+		applied, err := r.Session.Query(q, args...).MapScanCAS(map[string]interface{}{})
+		if err != nil || applied {
+			return applied, err
+		}
+		m, err = r.GetMessage(m.RoomID, m.MsgID)
+		if err == gocql.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, fmt.Errorf("message %s kept changing while its ttl was cleared", m.MsgID)
+}
+
+// ClearRevisionTTLs rewrites the message's revisions that still have a TTL
+// without one, returning how many it rewrote. Revisions never change, and
+// IF EXISTS keeps purged ones from coming back.
+func (r *Repository) ClearRevisionTTLs(roomID, msgID gocql.UUID) (int, error) {
+	iter := r.Session.Query(
+		`SELECT rev_id, content, edited_by, edited_at, TTL(content) FROM message_revisions
+		 WHERE room_id = ? AND msg_id = ?`,
+		roomID, msgID,
+	).Iter()
+	var (
+		rev Revision
+		ttl *int
+		n   int
+	)
+	for iter.Scan(&rev.RevID, &rev.Content, &rev.EditedBy, &rev.EditedAt, &ttl) {
+		if ttl != nil && *ttl > 0 {
+			if _, err := r.Session.Query(
+				`UPDATE message_revisions USING TTL 0 SET content = ?, edited_by = ?, edited_at = ?
+				 WHERE room_id = ? AND msg_id = ? AND rev_id = ? IF EXISTS`,
+				rev.Content, rev.EditedBy, rev.EditedAt, roomID, msgID, rev.RevID,
+			).MapScanCAS(map[string]interface{}{}); err != nil {
+				_ = iter.Close()
+				return n, err
+			}
+			n++
+		}
+		rev, ttl = Revision{}, nil
+	}
+	return n, iter.Close()
+}
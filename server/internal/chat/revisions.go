@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// defaultEditWindow applies to rooms without an edit_window_seconds setting.
+const defaultEditWindow = 15 * time.Minute
+
+type Revision struct {
+	RevID    gocql.UUID `json:"revId"`
+	Content  string     `json:"content"`
+	EditedBy gocql.UUID `json:"editedBy"`
+	EditedAt time.Time  `json:"editedAt"`
+	// Diff turns this revision into the next one (or the current content).
+	Diff []DiffOp `json:"diff,omitempty"`
+}
+
+type DiffOp struct {
+	Op   string `json:"op"` // equal, insert or delete
+	Text string `json:"text"`
+}
+
+// InsertRevision saves a prior version of a message. It expires together
+// with the message.
+func (r *Repository) InsertRevision(roomID, msgID gocql.UUID, rev Revision) error {
+	ttl, err := r.messageTTL(roomID, msgID)
+	if err != nil {
+		return err
+	}
+	const q = `INSERT INTO message_revisions (room_id, msg_id, rev_id, content, edited_by, edited_at)
+	           VALUES (?, ?, ?, ?, ?, ?)
+	           USING TTL ?`
+	return r.Session.Query(q, roomID, msgID, rev.RevID, rev.Content, rev.EditedBy, rev.EditedAt, ttl).Exec()
+}
+
+// ListRevisions returns the prior versions of a message, oldest first.
+func (r *Repository) ListRevisions(roomID, msgID gocql.UUID) ([]Revision, error) {
+	iter := r.Session.Query(
+		`SELECT rev_id, content, edited_by, edited_at FROM message_revisions WHERE room_id = ? AND msg_id = ?`,
+		roomID, msgID,
+	).Iter()
+
+	var out []Revision
+	var rev Revision
+	for iter.Scan(&rev.RevID, &rev.Content, &rev.EditedBy, &rev.EditedAt) {
+		out = append(out, rev)
+		rev = Revision{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// editWindow returns how long after creation messages in room may be edited;
+// zero means no limit.
+func editWindow(room *Room) time.Duration {
+	if room.EditWindowSeconds == nil {
+		return defaultEditWindow
+	}
+	return time.Duration(*room.EditWindowSeconds) * time.Second
+}
+
+type MessageRevisions struct {
+	MsgID     string     `json:"msgId"`
+	Current   string     `json:"current"`
+	EditCount int        `json:"editCount"`
+	Revisions []Revision `json:"revisions"`
+}
+
+// GetRevisions returns a message's edit history to its author or a room moderator.
+// With withDiff each revision carries a word diff to the version that replaced it.
+func (s *Service) GetRevisions(roomID, msgID, userID gocql.UUID, withDiff bool) (*MessageRevisions, error) {
+	msg, err := s.Repo.GetMessage(roomID, msgID)
+	if err == gocql.ErrNotFound {
+		return nil, errors.New("message not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg.UserID != userID {
+		if err := s.ensureRoomModerator(roomID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	revs, err := s.Repo.ListRevisions(roomID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	if withDiff {
+		for i := range revs {
+			next := msg.Content
+			if i+1 < len(revs) {
+				next = revs[i+1].Content
+			}
+			revs[i].Diff = diffWords(revs[i].Content, next)
+		}
+	}
+	if revs == nil {
+		revs = []Revision{}
+	}
+	return &MessageRevisions{
+		MsgID:     msgID.String(),
+		Current:   msg.Content,
+		EditCount: msg.EditCount,
+		Revisions: revs,
+	}, nil
+}
+
+// ensureRoomModerator allows room admins plus participants with the moderator role.
+func (s *Service) ensureRoomModerator(roomID, userID gocql.UUID) error {
+	role, err := s.Repo.GetParticipantRole(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if role == "moderator" {
+		return nil
+	}
+	return s.ensureRoomAdmin(roomID, userID)
+}
+
+// diffCellLimit bounds the LCS table diffWords builds, about 2 MB. Edits
+// whose changed middle needs more come back as a whole-text replace.
+const diffCellLimit = 1 << 18
+
+// diffWords computes a word-level diff from a to b using the longest common
+// subsequence. Runs of whitespace are tokens of their own. The common prefix
+// and suffix are matched first, so only the changed middle costs a table.
+func diffWords(a, b string) []DiffOp {
+	aw, bw := splitWords(a), splitWords(b)
+
+	var ops []DiffOp
+	push := func(op, text string) {
+		if text == "" {
+			return
+		}
+		if len(ops) > 0 && ops[len(ops)-1].Op == op {
+			ops[len(ops)-1].Text += text
+			return
+		}
+		ops = append(ops, DiffOp{Op: op, Text: text})
+	}
+
+	pre := 0
+	for pre < len(aw) && pre < len(bw) && aw[pre] == bw[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(aw)-pre && suf < len(bw)-pre && aw[len(aw)-1-suf] == bw[len(bw)-1-suf] {
+		suf++
+	}
+	push("equal", strings.Join(aw[:pre], ""))
+	tail := strings.Join(aw[len(aw)-suf:], "")
+	aw, bw = aw[pre:len(aw)-suf], bw[pre:len(bw)-suf]
+	n, m := len(aw), len(bw)
+
+	if (n+1)*(m+1) > diffCellLimit {
+		push("delete", strings.Join(aw, ""))
+		push("insert", strings.Join(bw, ""))
+		push("equal", tail)
+		return ops
+	}
+
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if aw[i] == bw[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case aw[i] == bw[j]:
+			push("equal", aw[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			push("delete", aw[i])
+			i++
+		default:
+			push("insert", bw[j])
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		push("delete", aw[i])
+	}
+	for ; j < m; j++ {
+		push("insert", bw[j])
+	}
+	push("equal", tail)
+	return ops
+}
+
+func splitWords(s string) []string {
+	var out []string
+	start := 0
+	for i := 1; i <= len(s); i++ {
+		if i == len(s) || isSpace(s[i]) != isSpace(s[i-1]) {
+			out = append(out, s[start:i])
+			start = i
+		}
+	}
+	return out
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' }
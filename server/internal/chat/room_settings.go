@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrRoomArchived = errors.New("room is archived")
+)
+
+const (
+	maxTopicLen       = 250
+	maxDescriptionLen = 2000
+	maxAvatarURLLen   = 2048
+)
+
+// loadRoom returns the room unless it does not exist or has been deleted.
+func (s *Service) loadRoom(roomID gocql.UUID) (*Room, error) {
+	room, err := s.Repo.GetRoom(roomID)
+	if err == gocql.ErrNotFound {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if room.DeletedAt != nil {
+		return nil, ErrRoomNotFound
+	}
+	return room, nil
+}
+
+// EnsureWritable rejects posting into archived or deleted rooms.
+func (s *Service) EnsureWritable(roomID gocql.UUID) error {
+	_, err := s.writableRoom(roomID)
+	return err
+}
+
+func (s *Service) writableRoom(roomID gocql.UUID) (*Room, error) {
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.ArchivedAt != nil {
+		return nil, ErrRoomArchived
+	}
+	return room, nil
+}
+
+// UpdateRoom applies a partial settings update. A name change goes through
+// RenameRoom so the slug follows it.
+func (s *Service) UpdateRoom(roomID, userID gocql.UUID, req UpdateRoomRequest) (*Room, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	set := RoomSettings{}
+	if req.Topic != nil {
+		t := strings.TrimSpace(*req.Topic)
+		if len(t) > maxTopicLen {
+			return nil, errors.New("topic too long")
+		}
+		set.Topic = &t
+	}
+	if req.Description != nil {
+		d := strings.TrimSpace(*req.Description)
+		if len(d) > maxDescriptionLen {
+			return nil, errors.New("description too long")
+		}
+		set.Description = &d
+	}
+	if req.AvatarURL != nil {
+		a := strings.TrimSpace(*req.AvatarURL)
+		if len(a) > maxAvatarURLLen || (a != "" && !strings.HasPrefix(a, "https://") && !strings.HasPrefix(a, "http://")) {
+			return nil, errors.New("invalid avatar url")
+		}
+		set.AvatarURL = &a
+	}
+
+	if req.EditWindowSeconds != nil {
+		if *req.EditWindowSeconds < 0 {
+			return nil, errors.New("editWindowSeconds must be >= 0")
+		}
+		set.EditWindowSeconds = req.EditWindowSeconds
+	}
+
+	if req.Name != nil && strings.TrimSpace(*req.Name) != room.Name {
+		if _, err := s.RenameRoom(roomID, userID, RenameRoomRequest{Name: *req.Name}); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Repo.UpdateRoomSettings(roomID, set, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return s.Repo.GetRoom(roomID)
+}
+
+// SetArchived archives or unarchives a room. Archived rooms stay readable but
+// reject new messages and are hidden from default listings.
+func (s *Service) SetArchived(roomID, userID gocql.UUID, archived bool) (*Room, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	if _, err := s.loadRoom(roomID); err != nil {
+		return nil, err
+	}
+	var at *time.Time
+	var by *gocql.UUID
+	if archived {
+		now := time.Now().UTC()
+		at, by = &now, &userID
+	}
+	if err := s.Repo.SetRoomArchived(roomID, at, by); err != nil {
+		return nil, err
+	}
+	return s.Repo.GetRoom(roomID)
+}
+
+// DeleteRoom soft-deletes a room; RestoreRoom brings it back with its messages intact.
+func (s *Service) DeleteRoom(roomID, userID gocql.UUID) (*Room, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	if _, err := s.loadRoom(roomID); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if err := s.Repo.SetRoomDeleted(roomID, &now, &userID); err != nil {
+		return nil, err
+	}
+	return s.Repo.GetRoom(roomID)
+}
+
+func (s *Service) RestoreRoom(roomID, userID gocql.UUID) (*Room, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	room, err := s.Repo.GetRoom(roomID)
+	if err == gocql.ErrNotFound {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if room.DeletedAt == nil {
+		return room, nil
+	}
+	if err := s.Repo.SetRoomDeleted(roomID, nil, nil); err != nil {
+		return nil, err
+	}
+	return s.Repo.GetRoom(roomID)
+}
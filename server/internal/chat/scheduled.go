@@ -0,0 +1,370 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"gochat/internal/ws"
+
+	"github.com/gocql/gocql"
+)
+
+// Scheduled messages sit in scheduled_messages until due, with an entry in
+// the hourly scheduled_due queue. The scheduler runs on the elected leader
+// and delivers through PostMessage, using the schedule id as the tempId so
+// a delivery retried by a new leader still yields a single message.
+
+const (
+	ScheduledPending = "pending"
+	ScheduledFailed  = "failed"
+
+	maxScheduleAhead  = 365 * 24 * time.Hour
+	scheduleTick      = 5 * time.Second
+	scheduleLookback  = 7 * 24 // hours scanned when a process becomes leader
+	scheduledTempIDNS = "scheduled:"
+)
+
+type ScheduledMessage struct {
+	SchedID   gocql.UUID  `json:"id"`
+	RoomID    gocql.UUID  `json:"roomId"`
+	UserID    gocql.UUID  `json:"userId"`
+	Content   string      `json:"content"`
+	ParentID  *gocql.UUID `json:"parentId,omitempty"`
+	SendAt    time.Time   `json:"sendAt"`
+	Status    string      `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt *time.Time  `json:"updatedAt,omitempty"`
+}
+
+type dueEntry struct {
+	SendAt  time.Time
+	SchedID gocql.UUID
+	UserID  gocql.UUID
+	RoomID  gocql.UUID
+}
+
+func dueHour(t time.Time) int64 { return t.Unix() / 3600 }
+
+// ScheduleMessage stores a message to be posted by userID at req.SendAt.
+// scopes are the caller's API token scopes, nil for a user session; they
+// must allow any command the content runs, since delivery has no token.
+func (s *Service) ScheduleMessage(roomID, userID gocql.UUID, scopes []string, req CreateScheduledRequest) (*ScheduledMessage, error) {
+	content := strings.TrimSpace(req.Content)
+	if len(content) == 0 || len(content) > maxContentLen {
+		return nil, errors.New("invalid content")
+	}
+	if err := s.ensureCommandScope(content, scopes); err != nil {
+		return nil, err
+	}
+	sendAt, err := validSendAt(req.SendAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.EnsureMemberOrPublic(roomID, userID); err != nil {
+		return nil, err
+	}
+	if err := s.EnsureWritable(roomID); err != nil {
+		return nil, err
+	}
+
+	sm := &ScheduledMessage{
+		SchedID:   gocql.TimeUUID(),
+		RoomID:    roomID,
+		UserID:    userID,
+		Content:   content,
+		SendAt:    sendAt,
+		Status:    ScheduledPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.ParentID != "" {
+		pid, err := gocql.ParseUUID(req.ParentID)
+		if err != nil {
+			return nil, errors.New("invalid parent id")
+		}
+		sm.ParentID = &pid
+	}
+	if err := s.Repo.InsertScheduled(sm); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+func (s *Service) ListScheduled(roomID, userID gocql.UUID) ([]ScheduledMessage, error) {
+	return s.Repo.ListScheduled(userID, roomID)
+}
+
+func (s *Service) GetScheduled(roomID, userID, schedID gocql.UUID) (*ScheduledMessage, error) {
+	sm, err := s.Repo.GetScheduled(userID, roomID, schedID)
+	if err == gocql.ErrNotFound {
+		return nil, errors.New("scheduled message not found")
+	}
+	return sm, err
+}
+
+// UpdateScheduled edits a pending or failed scheduled message. Rescheduling
+// a failed one puts it back in the queue.
+func (s *Service) UpdateScheduled(roomID, userID, schedID gocql.UUID, scopes []string, req UpdateScheduledRequest) (*ScheduledMessage, error) {
+	sm, err := s.GetScheduled(roomID, userID, schedID)
+	if err != nil {
+		return nil, err
+	}
+	prevSendAt := sm.SendAt
+
+	if req.Content != nil {
+		content := strings.TrimSpace(*req.Content)
+		if len(content) == 0 || len(content) > maxContentLen {
+			return nil, errors.New("invalid content")
+		}
+		if err := s.ensureCommandScope(content, scopes); err != nil {
+			return nil, err
+		}
+		sm.Content = content
+	}
+	if req.SendAt != nil {
+		sendAt, err := validSendAt(*req.SendAt)
+		if err != nil {
+			return nil, err
+		}
+		sm.SendAt = sendAt
+		sm.Status = ScheduledPending
+		sm.Error = ""
+	}
+	now := time.Now().UTC()
+	sm.UpdatedAt = &now
+
+	if err := s.Repo.UpdateScheduled(sm, prevSendAt); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+func (s *Service) CancelScheduled(roomID, userID, schedID gocql.UUID) error {
+	sm, err := s.GetScheduled(roomID, userID, schedID)
+	if err != nil {
+		return err
+	}
+	return s.Repo.DeleteScheduled(sm)
+}
+
+func validSendAt(t time.Time) (time.Time, error) {
+	if t.IsZero() {
+		return time.Time{}, errors.New("sendAt is required")
+	}
+	t = t.UTC().Truncate(time.Millisecond)
+	now := time.Now()
+	if !t.After(now) {
+		return time.Time{}, errors.New("sendAt must be in the future")
+	}
+	if t.Sub(now) > maxScheduleAhead {
+		return time.Time{}, errors.New("sendAt is too far ahead")
+	}
+	return t, nil
+}
+
+// RunScheduler delivers due scheduled messages and announces expired
+// disappearing messages until ctx is done, doing work only while isLeader
+// reports true.
+func (s *Service) RunScheduler(ctx context.Context, isLeader func() bool) {
+	t := time.NewTicker(scheduleTick)
+	defer t.Stop()
+
+	// from is the first hour still to scan; a new leader looks back far
+	// enough to pick up anything missed while no one was leading.
+	var from int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !isLeader() {
+			from = 0
+			continue
+		}
+		now := time.Now().UTC()
+		if from == 0 {
+			from = dueHour(now) - scheduleLookback
+		}
+		delivered := s.deliverDue(ctx, from, now)
+		if s.expireDue(ctx, from, now) && delivered {
+			// Keep the previous hour: entries can land just behind the tick.
+			from = dueHour(now) - 1
+		}
+	}
+}
+
+// deliverDue sends everything due by now in hours from..now, reporting
+// whether every hour was scanned.
+func (s *Service) deliverDue(ctx context.Context, from int64, now time.Time) bool {
+	for h := from; h <= dueHour(now); h++ {
+		entries, err := s.Repo.DueScheduled(h, now)
+		if err != nil {
+			log.Printf("scheduler: hour %d: %v", h, err)
+			return false
+		}
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return false
+			}
+			s.deliverScheduled(ctx, e)
+		}
+	}
+	return true
+}
+
+func (s *Service) deliverScheduled(ctx context.Context, e dueEntry) {
+	sm, err := s.Repo.GetScheduled(e.UserID, e.RoomID, e.SchedID)
+	if err == gocql.ErrNotFound {
+		_ = s.Repo.deleteDue(e)
+		return
+	}
+	if err != nil {
+		log.Printf("scheduler: load %s: %v", e.SchedID, err)
+		return
+	}
+	// Edited or already failed since this entry was queued.
+	if sm.Status != ScheduledPending || !sm.SendAt.Equal(e.SendAt) {
+		_ = s.Repo.deleteDue(e)
+		return
+	}
+
+	// PostMessage re-checks membership and that the room is still writable.
+	posted, err := s.PostMessage(ctx, PostMessageInput{
+		RoomID:   sm.RoomID,
+		UserID:   sm.UserID,
+		Content:  sm.Content,
+		ParentID: sm.ParentID,
+		TempID:   scheduledTempIDNS + sm.SchedID.String(),
+	})
+	if err != nil {
+		if err := s.Repo.MarkScheduledFailed(sm, err.Error()); err != nil {
+			log.Printf("scheduler: mark %s failed: %v", sm.SchedID, err)
+			return
+		}
+		s.publish(ws.NewServerEvent("scheduled.failed", "server", sm.UserID.String(), map[string]any{
+			"id":     sm.SchedID.String(),
+			"roomId": sm.RoomID.String(),
+			"error":  err.Error(),
+		}))
+		return
+	}
+	if err := s.Repo.DeleteScheduled(sm); err != nil {
+		log.Printf("scheduler: clear %s: %v", sm.SchedID, err)
+	}
+	s.publish(ws.NewServerEvent("scheduled.sent", "server", sm.UserID.String(), map[string]any{
+		"id":     sm.SchedID.String(),
+		"roomId": sm.RoomID.String(),
+		"msgId":  posted.MsgID.String(),
+	}))
+}
+
+const scheduledColumns = `sched_id, room_id, user_id, content, parent_id, send_at, status, error, created_at, updated_at`
+
+func scheduledDest(sm *ScheduledMessage) []interface{} {
+	return []interface{}{&sm.SchedID, &sm.RoomID, &sm.UserID, &sm.Content, &sm.ParentID,
+		&sm.SendAt, &sm.Status, &sm.Error, &sm.CreatedAt, &sm.UpdatedAt}
+}
+
+func (r *Repository) InsertScheduled(sm *ScheduledMessage) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO scheduled_messages (`+scheduledColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sm.SchedID, sm.RoomID, sm.UserID, sm.Content, sm.ParentID, sm.SendAt, sm.Status, sm.Error, sm.CreatedAt, sm.UpdatedAt)
+	b.Query(`INSERT INTO scheduled_due (due_hour, send_at, sched_id, user_id, room_id) VALUES (?, ?, ?, ?, ?)`,
+		dueHour(sm.SendAt), sm.SendAt, sm.SchedID, sm.UserID, sm.RoomID)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) GetScheduled(userID, roomID, schedID gocql.UUID) (*ScheduledMessage, error) {
+	var sm ScheduledMessage
+	err := r.Session.Query(
+		`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE user_id = ? AND room_id = ? AND sched_id = ?`,
+		userID, roomID, schedID,
+	).Scan(scheduledDest(&sm)...)
+	if err != nil {
+		return nil, err
+	}
+	return &sm, nil
+}
+
+// ListScheduled returns userID's scheduled messages in roomID, oldest first.
+func (r *Repository) ListScheduled(userID, roomID gocql.UUID) ([]ScheduledMessage, error) {
+	iter := r.Session.Query(
+		`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE user_id = ? AND room_id = ?`,
+		userID, roomID,
+	).Iter()
+	out := []ScheduledMessage{}
+	var sm ScheduledMessage
+	for iter.Scan(scheduledDest(&sm)...) {
+		out = append(out, sm)
+		sm = ScheduledMessage{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateScheduled saves sm and moves its queue entry from prevSendAt.
+func (r *Repository) UpdateScheduled(sm *ScheduledMessage, prevSendAt time.Time) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`UPDATE scheduled_messages SET content = ?, send_at = ?, status = ?, error = ?, updated_at = ?
+	         WHERE user_id = ? AND room_id = ? AND sched_id = ?`,
+		sm.Content, sm.SendAt, sm.Status, sm.Error, sm.UpdatedAt, sm.UserID, sm.RoomID, sm.SchedID)
+	b.Query(`DELETE FROM scheduled_due WHERE due_hour = ? AND send_at = ? AND sched_id = ?`,
+		dueHour(prevSendAt), prevSendAt, sm.SchedID)
+	if sm.Status == ScheduledPending {
+		b.Query(`INSERT INTO scheduled_due (due_hour, send_at, sched_id, user_id, room_id) VALUES (?, ?, ?, ?, ?)`,
+			dueHour(sm.SendAt), sm.SendAt, sm.SchedID, sm.UserID, sm.RoomID)
+	}
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) DeleteScheduled(sm *ScheduledMessage) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`DELETE FROM scheduled_messages WHERE user_id = ? AND room_id = ? AND sched_id = ?`,
+		sm.UserID, sm.RoomID, sm.SchedID)
+	b.Query(`DELETE FROM scheduled_due WHERE due_hour = ? AND send_at = ? AND sched_id = ?`,
+		dueHour(sm.SendAt), sm.SendAt, sm.SchedID)
+	return r.Session.ExecuteBatch(b)
+}
+
+// MarkScheduledFailed keeps a message that could not be delivered so its
+// author can see why and reschedule it.
+func (r *Repository) MarkScheduledFailed(sm *ScheduledMessage, reason string) error {
+	now := time.Now().UTC()
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`UPDATE scheduled_messages SET status = ?, error = ?, updated_at = ?
+	         WHERE user_id = ? AND room_id = ? AND sched_id = ?`,
+		ScheduledFailed, reason, now, sm.UserID, sm.RoomID, sm.SchedID)
+	b.Query(`DELETE FROM scheduled_due WHERE due_hour = ? AND send_at = ? AND sched_id = ?`,
+		dueHour(sm.SendAt), sm.SendAt, sm.SchedID)
+	return r.Session.ExecuteBatch(b)
+}
+
+// DueScheduled returns the queue entries of one hour that are due by now.
+func (r *Repository) DueScheduled(hour int64, now time.Time) ([]dueEntry, error) {
+	iter := r.Session.Query(
+		`SELECT send_at, sched_id, user_id, room_id FROM scheduled_due WHERE due_hour = ? AND send_at <= ?`,
+		hour, now,
+	).Iter()
+	var out []dueEntry
+	var e dueEntry
+	for iter.Scan(&e.SendAt, &e.SchedID, &e.UserID, &e.RoomID) {
+		out = append(out, e)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repository) deleteDue(e dueEntry) error {
+	return r.Session.Query(
+		`DELETE FROM scheduled_due WHERE due_hour = ? AND send_at = ? AND sched_id = ?`,
+		dueHour(e.SendAt), e.SendAt, e.SchedID,
+	).Exec()
+}
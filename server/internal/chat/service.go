@@ -2,18 +2,25 @@ package chat
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gocql/gocql"
+
+	"gochat/internal/ratelimit"
+	"gochat/internal/ws"
 )
 
 type EditMessageResult struct {
-	RoomID   string    `json:"roomId"`
-	MsgID    string    `json:"msgId"`
-	Content  string    `json:"content"`
-	EditedAt time.Time `json:"editedAt"`
+	RoomID    string    `json:"roomId"`
+	MsgID     string    `json:"msgId"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"editedAt"`
+	EditCount int       `json:"editCount"`
 }
 
 type DeleteMessageResult struct {
@@ -26,48 +33,308 @@ type DeleteMessageResult struct {
 
 type Service struct {
 	Repo *Repository
+	// Hub receives the events produced by writes; nil disables publishing.
+	Hub *ws.Hub
+	// Retention holds the workspace-wide defaults; the zero value keeps
+	// messages forever.
+	Retention RetentionConfig
+	// Limiter throttles incoming webhooks; nil disables rate limiting.
+	Limiter *ratelimit.Limiter
+	// OnEvent, if set, sees every event published by a write; outgoing
+	// webhooks subscribe through it.
+	OnEvent func(ws.Event)
+
+	commands map[string]*SlashCommand
 }
 
-func NewService(repo *Repository) *Service { return &Service{Repo: repo} }
+func NewService(repo *Repository) *Service {
+	s := &Service{Repo: repo}
+	s.registerBuiltinCommands()
+	return s
+}
 
 func (s *Service) CreateRoom(userID gocql.UUID, req CreateRoomRequest) (*CreateRoomResponse, error) {
 	name := strings.TrimSpace(req.Name)
 	if len(name) < 3 {
 		return nil, errors.New("room name must be at least 3 chars")
 	}
+	visibility := req.Visibility
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	if visibility != VisibilityPublic && visibility != VisibilityPrivate {
+		return nil, errors.New("visibility must be public or private")
+	}
 	room := &Room{
-		RoomID:    gocql.TimeUUID(),
-		Name:      name,
-		CreatedBy: userID,
-		CreatedAt: time.Now().UTC(),
+		RoomID:     gocql.TimeUUID(),
+		Name:       name,
+		CreatedBy:  userID,
+		CreatedAt:  time.Now().UTC(),
+		Kind:       RoomKindChannel,
+		Visibility: visibility,
 	}
 	if err := s.Repo.InsertRoom(room); err != nil {
 		return nil, err
 	}
-	return &CreateRoomResponse{RoomID: room.RoomID.String(), Name: room.Name}, nil
+	if err := s.Repo.AddParticipant(room.RoomID, userID, "owner", room.CreatedAt); err != nil {
+		return nil, err
+	}
+	slug, err := s.reserveSlugFor(room.RoomID, Slugify(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.UpsertRoomSlug(room.RoomID, slug); err != nil {
+		return nil, err
+	}
+	return &CreateRoomResponse{RoomID: room.RoomID.String(), Name: room.Name, Slug: slug, Visibility: room.Visibility}, nil
 }
 
-func (s *Service) ListRooms(limit int) ([]Room, error) {
-	return s.Repo.ListRooms(limit)
+// JoinRoom adds userID to a public room. Private rooms are invite-only.
+func (s *Service) JoinRoom(roomID, userID gocql.UUID) error {
+	ok, err := s.Repo.IsParticipant(roomID, userID)
+	if err != nil || ok {
+		return err
+	}
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if room.ArchivedAt != nil {
+		return ErrRoomArchived
+	}
+	public, err := s.Repo.IsRoomPublic(room)
+	if err != nil {
+		return err
+	}
+	if !public {
+		return errors.New("forbidden: room is private")
+	}
+	// pin legacy rooms as public; otherwise gaining a participant would make them private
+	if room.Visibility == "" {
+		if err := s.Repo.SetRoomVisibility(roomID, VisibilityPublic); err != nil {
+			return err
+		}
+	}
+	if err := s.Repo.AddParticipant(roomID, userID, "member", time.Now().UTC()); err != nil {
+		return err
+	}
+	s.publish(memberJoinedEvent(roomID, userID, s.username(userID)))
+	return nil
 }
 
-func (s *Service) SendMessage(roomID, userID gocql.UUID, req SendMessageRequest) (*SendMessageResponse, error) {
-	content := strings.TrimSpace(req.Content)
-	if len(content) == 0 || len(content) > 4000 {
-		return nil, errors.New("invalid content")
+func (s *Service) LeaveRoom(roomID, userID gocql.UUID) error {
+	return s.Repo.RemoveParticipant(roomID, userID)
+}
+
+// MarkRead records msgID (or the newest message if msgID is nil) as the last
+// message userID has read in roomID.
+func (s *Service) MarkRead(roomID, userID gocql.UUID, msgID *gocql.UUID) error {
+	if msgID == nil {
+		last, err := s.Repo.LatestMessage(roomID)
+		if err != nil || last == nil {
+			return err
+		}
+		msgID = &last.MsgID
+	}
+	return s.Repo.SetLastRead(userID, roomID, *msgID)
+}
+
+// unreadCap bounds the unread count per room; clients render it as "99+".
+const unreadCap = 100
+
+type RoomSummary struct {
+	RoomID         string    `json:"roomId"`
+	Name           string    `json:"name"`
+	Slug           string    `json:"slug,omitempty"`
+	Kind           string    `json:"kind,omitempty"`
+	Role           string    `json:"role,omitempty"`
+	Archived       bool      `json:"archived,omitempty"`
+	LastActivityAt time.Time `json:"lastActivityAt"`
+	Unread         int       `json:"unread"`
+	LastMessage    *Message  `json:"lastMessage,omitempty"`
+}
+
+// ListRooms returns a page of the caller's rooms, most recently active first.
+// The cursor is opaque to clients; pass the returned one to fetch the next page.
+// Archived rooms are left out unless includeArchived is set.
+func (s *Service) ListRooms(userID gocql.UUID, limit int, cursor string, includeArchived bool) ([]RoomSummary, string, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	after, err := decodeRoomCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Read the activity index in batches until the page and one more room are
+	// found; index rows for stale, deleted or hidden rooms are passed over.
+	page := make([]RoomSummary, 0, limit)
+	members := make([]*Membership, 0, limit)
+	var last gocql.UUID
+	more := false
+	for !more {
+		entries, err := s.Repo.ListActivity(userID, after, limit+1)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, e := range entries {
+			e := e
+			after = &e.ID
+			sum, m, ok, err := s.roomSummary(userID, e, includeArchived)
+			if err != nil {
+				return nil, "", err
+			}
+			if !ok {
+				continue
+			}
+			if len(page) == limit {
+				more = true
+				break
+			}
+			page = append(page, sum)
+			members = append(members, m)
+			last = e.ID
+		}
+		if len(entries) <= limit {
+			break
+		}
+	}
+
+	// previews and unread counts are only computed for the page being returned
+	for i, m := range members {
+		if page[i].LastMessage, err = s.Repo.LatestMessage(m.RoomID); err != nil {
+			return nil, "", err
+		}
+		since := gocql.MinTimeUUID(m.JoinedAt)
+		if m.LastReadMsgID != nil {
+			since = *m.LastReadMsgID
+		}
+		if page[i].Unread, err = s.Repo.CountMessagesAfter(m.RoomID, since, unreadCap); err != nil {
+			return nil, "", err
+		}
+	}
+
+	next := ""
+	if more {
+		next = encodeRoomCursor(last)
+	}
+	return page, next, nil
+}
+
+// roomSummary describes the room behind an activity index row. It reports
+// false for rows the listing skips, and removes rows a race left stale.
+func (s *Service) roomSummary(userID gocql.UUID, e ActivityEntry, includeArchived bool) (RoomSummary, *Membership, bool, error) {
+	m, err := s.Repo.GetMembership(userID, e.RoomID)
+	if err != nil && err != gocql.ErrNotFound {
+		return RoomSummary{}, nil, false, err
+	}
+	if err == gocql.ErrNotFound || m.ActivityID == nil || *m.ActivityID != e.ID {
+		return RoomSummary{}, nil, false, s.Repo.DeleteActivity(userID, e.ID)
+	}
+	room, err := s.Repo.GetRoom(e.RoomID)
+	if err == gocql.ErrNotFound {
+		return RoomSummary{}, nil, false, nil
+	}
+	if err != nil {
+		return RoomSummary{}, nil, false, err
+	}
+	if room.DeletedAt != nil || (room.ArchivedAt != nil && !includeArchived) {
+		return RoomSummary{}, nil, false, nil
+	}
+	return RoomSummary{
+		RoomID:         room.RoomID.String(),
+		Name:           room.Name,
+		Slug:           room.Slug,
+		Kind:           room.Kind,
+		Role:           m.Role,
+		Archived:       room.ArchivedAt != nil,
+		LastActivityAt: e.ID.Time().UTC(),
+	}, m, true, nil
+}
+
+func encodeRoomCursor(activityID gocql.UUID) string {
+	return base64.RawURLEncoding.EncodeToString(activityID.Bytes())
+}
+
+func decodeRoomCursor(cursor string) (*gocql.UUID, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	id, err := gocql.UUIDFromBytes(raw)
+	if err != nil || id.Version() != 1 {
+		return nil, errors.New("invalid cursor")
+	}
+	return &id, nil
+}
+
+// DirectoryRooms lists discoverable (public channel) rooms whose name starts
+// with q, in name order. It reads a range of the public_rooms index, so every
+// listed room is reachable however many rooms exist.
+func (s *Service) DirectoryRooms(q string, limit int) ([]Room, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
 	}
+	q = strings.ToLower(strings.TrimSpace(q))
 
-	msg := &Message{
-		RoomID:    roomID,
-		MsgID:     gocql.TimeUUID(),
-		UserID:    userID,
-		Content:   content,
-		CreatedAt: time.Now().UTC(),
+	iter := s.Repo.DirectoryIter(q)
+	out := make([]Room, 0, limit)
+	var (
+		key    string
+		roomID gocql.UUID
+	)
+	for len(out) < limit && iter.Scan(&key, &roomID) {
+		rm, err := s.Repo.GetRoom(roomID)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		out = append(out, *rm)
 	}
-	if err := s.Repo.InsertMessage(msg); err != nil {
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SendMessage is the REST entry point into PostMessage. scopes are the
+// caller's API token scopes, nil for a user session.
+func (s *Service) SendMessage(ctx context.Context, roomID, userID gocql.UUID, scopes []string, req SendMessageRequest) (*SendMessageResponse, error) {
+	in := PostMessageInput{RoomID: roomID, UserID: userID, Content: req.Content, TempID: req.TempID, Scopes: scopes}
+	if req.ParentID != "" {
+		parentID, err := gocql.ParseUUID(req.ParentID)
+		if err != nil {
+			return nil, errors.New("invalid parent id")
+		}
+		in.ParentID = &parentID
+	}
+	msg, err := s.PostMessage(ctx, in)
+	if err != nil {
 		return nil, err
 	}
-	return &SendMessageResponse{MsgID: msg.MsgID.String(), Content: msg.Content}, nil
+	if msg.Command != nil && msg.MsgID == (gocql.UUID{}) {
+		return &SendMessageResponse{RoomID: msg.RoomID.String(), TempID: msg.TempID, Command: msg.Command}, nil
+	}
+	resp := &SendMessageResponse{
+		MsgID:     msg.MsgID.String(),
+		RoomID:    msg.RoomID.String(),
+		Content:   msg.Content,
+		CreatedAt: msg.CreatedAt,
+		TempID:    msg.TempID,
+		Replayed:  msg.Replayed,
+		ExpiresAt: msg.ExpiresAt,
+		Command:   msg.Command,
+	}
+	if msg.ParentID != nil {
+		resp.ParentID = msg.ParentID.String()
+	}
+	return resp, nil
 }
 
 func (s *Service) GetMessages(roomID gocql.UUID, limit int, beforeStr string) ([]Message, error) {
@@ -82,9 +349,12 @@ func (s *Service) GetMessages(roomID gocql.UUID, limit int, beforeStr string) ([
 
 func (s *Service) EditMessage(roomID, msgID, userID gocql.UUID, newContent string) (*EditMessageResult, error) {
 	newContent = strings.TrimSpace(newContent)
-	if len(newContent) == 0 || len(newContent) > 4000 {
+	if len(newContent) == 0 || len(newContent) > maxContentLen {
 		return nil, errors.New("invalid content")
 	}
+	if err := s.EnsureMemberOrPublic(roomID, userID); err != nil {
+		return nil, err
+	}
 
 	msg, err := s.Repo.GetMessage(roomID, msgID)
 	if err != nil {
@@ -94,27 +364,68 @@ func (s *Service) EditMessage(roomID, msgID, userID gocql.UUID, newContent strin
 	if msg.DeletedAt != nil {
 		return nil, errors.New("message deleted")
 	}
+	if msg.Kind != "" {
+		return nil, errors.New("only plain messages can be edited")
+	}
 
 	if msg.UserID != userID {
 		return nil, errors.New("forbidden")
 	}
-	if time.Since(msg.CreatedAt) > 15*time.Minute {
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.ArchivedAt != nil {
+		return nil, ErrRoomArchived
+	}
+	if window := editWindow(room); window > 0 && time.Since(msg.CreatedAt) > window {
 		return nil, errors.New("edit window has expired")
 	}
+	if newContent == msg.Content {
+		return &EditMessageResult{
+			RoomID:    roomID.String(),
+			MsgID:     msgID.String(),
+			Content:   msg.Content,
+			EditedAt:  derefTime(msg.EditedAt, msg.CreatedAt),
+			EditCount: msg.EditCount,
+		}, nil
+	}
 
 	editedAt := time.Now().UTC()
-	if err := s.Repo.UpdateMessageContent(roomID, msgID, newContent, editedAt); err != nil {
+	// keep the version being replaced before overwriting it
+	if err := s.Repo.InsertRevision(roomID, msgID, Revision{
+		RevID:    gocql.UUIDFromTime(editedAt),
+		Content:  msg.Content,
+		EditedBy: userID,
+		EditedAt: editedAt,
+	}); err != nil {
 		return nil, err
 	}
-	return &EditMessageResult{
-		RoomID:   roomID.String(),
-		MsgID:    msgID.String(),
-		Content:  newContent,
-		EditedAt: editedAt,
-	}, nil
+	if err := s.Repo.UpdateMessageContent(roomID, msgID, newContent, editedAt, msg.EditCount+1); err != nil {
+		return nil, err
+	}
+	res := &EditMessageResult{
+		RoomID:    roomID.String(),
+		MsgID:     msgID.String(),
+		Content:   newContent,
+		EditedAt:  editedAt,
+		EditCount: msg.EditCount + 1,
+	}
+	s.publish(editedEvent(res))
+	return res, nil
+}
+
+func derefTime(t *time.Time, fallback time.Time) time.Time {
+	if t == nil {
+		return fallback
+	}
+	return *t
 }
 
 func (s *Service) DeleteMessage(roomID, msgID, userID gocql.UUID, reason string) (*DeleteMessageResult, error) {
+	if err := s.EnsureMemberOrPublic(roomID, userID); err != nil {
+		return nil, err
+	}
 
 	msg, err := s.Repo.GetMessage(roomID, msgID)
 	if err != nil {
@@ -131,6 +442,13 @@ func (s *Service) DeleteMessage(roomID, msgID, userID gocql.UUID, reason string)
 		}, nil
 	}
 
+	if msg.Kind == MessageKindSystem {
+		return nil, errors.New("forbidden: system messages cannot be deleted")
+	}
+	room, err := s.writableRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
 	if msg.UserID != userID {
 		return nil, errors.New("forbidden")
 	}
@@ -138,18 +456,21 @@ func (s *Service) DeleteMessage(roomID, msgID, userID gocql.UUID, reason string)
 	if err := s.Repo.SoftDeleteMessage(roomID, msgID, userID, reason, deletedAt); err != nil {
 		return nil, err
 	}
+	s.queueDeletedPurge(room, msgID, deletedAt)
 	var reasonPtr *string
 	if strings.TrimSpace(reason) != "" {
 		r := strings.TrimSpace(reason)
 		reasonPtr = &r
 	}
-	return &DeleteMessageResult{
+	res := &DeleteMessageResult{
 		RoomID:        roomID.String(),
 		MsgID:         msgID.String(),
 		DeletedAt:     deletedAt,
 		DeletedBy:     userID.String(),
 		DeletedReason: reasonPtr,
-	}, nil
+	}
+	s.publish(deletedEvent(res))
+	return res, nil
 }
 
 // func (s *Service) EnsureDM(a, b gocql.UUID) (gocql.UUID, bool, error) {
@@ -168,11 +489,110 @@ func (s *Service) EnsureDM(ctx context.Context, me gocql.UUID, peer gocql.UUID)
 	return s.Repo.EnsureDM(me, peer)
 }
 
+// maxDMParticipants caps group DMs, including the caller.
+const maxDMParticipants = 9
+
+// EnsureGroupDM returns the DM room shared by me and peers, creating it if missing.
+// The same participant set always resolves to the same room.
+func (s *Service) EnsureGroupDM(ctx context.Context, me gocql.UUID, peers []gocql.UUID) (roomID gocql.UUID, created bool, err error) {
+	members := []gocql.UUID{me}
+	for _, p := range peers {
+		if p != me {
+			members = append(members, p)
+		}
+	}
+	n := len(strings.Split(DMKey(members), ","))
+	if n < 2 {
+		return gocql.UUID{}, false, errors.New("cannot DM yourself")
+	}
+	if n > maxDMParticipants {
+		return gocql.UUID{}, false, fmt.Errorf("a DM can have at most %d participants", maxDMParticipants)
+	}
+	return s.Repo.EnsureGroupDM(me, members)
+}
+
+// AddDMParticipants adds users to an existing DM. DMs are identified by their
+// participant set, so this resolves (or creates) the DM of the enlarged group
+// rather than mutating the original room.
+func (s *Service) AddDMParticipants(ctx context.Context, me, roomID gocql.UUID, add []gocql.UUID) (gocql.UUID, bool, error) {
+	dm, err := s.Repo.GetDMByUser(me, roomID)
+	if err != nil {
+		return gocql.UUID{}, false, err
+	}
+	if dm == nil {
+		return gocql.UUID{}, false, errors.New("forbidden: not a participant")
+	}
+	if len(add) == 0 {
+		return gocql.UUID{}, false, errors.New("userIds required")
+	}
+	return s.EnsureGroupDM(ctx, me, append(dm.Participants, add...))
+}
+
+type DMParticipant struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type DMSummary struct {
+	RoomID       string          `json:"roomId"`
+	Participants []DMParticipant `json:"participants"`
+	LastMessage  *Message        `json:"lastMessage,omitempty"`
+	CreatedAt    time.Time       `json:"createdAt"`
+}
+
+// ListDMs returns the caller's DMs (excluding the caller from participants),
+// most recently active first.
+func (s *Service) ListDMs(ctx context.Context, me gocql.UUID) ([]DMSummary, error) {
+	threads, err := s.Repo.ListDMsByUser(me)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[gocql.UUID]string{}
+	out := make([]DMSummary, 0, len(threads))
+	for _, t := range threads {
+		sum := DMSummary{RoomID: t.RoomID.String(), CreatedAt: t.CreatedAt}
+		for _, p := range t.Participants {
+			if p == me {
+				continue
+			}
+			name, ok := names[p]
+			if !ok {
+				if name, err = s.Repo.GetUsername(p); err != nil {
+					return nil, err
+				}
+				names[p] = name
+			}
+			sum.Participants = append(sum.Participants, DMParticipant{ID: p.String(), Username: name})
+		}
+		if sum.LastMessage, err = s.Repo.LatestMessage(t.RoomID); err != nil {
+			return nil, err
+		}
+		out = append(out, sum)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return dmActivity(out[i]).After(dmActivity(out[j]))
+	})
+	return out, nil
+}
+
+func dmActivity(d DMSummary) time.Time {
+	if d.LastMessage != nil {
+		return d.LastMessage.CreatedAt
+	}
+	return d.CreatedAt
+}
+
 func (s *Service) IsParticipant(roomID, userID gocql.UUID) (bool, error) {
 	return s.Repo.IsParticipant(roomID, userID)
 }
 
 func (s *Service) EnsureMemberOrPublic(roomID, userID gocql.UUID) error {
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return err
+	}
 	ok, err := s.Repo.IsParticipant(roomID, userID)
 	if err != nil {
 		return err
@@ -180,12 +600,11 @@ func (s *Service) EnsureMemberOrPublic(roomID, userID gocql.UUID) error {
 	if ok {
 		return nil
 	}
-	// If no participants exist, this is a public room → allow.
-	has, err := s.Repo.RoomHasParticipants(roomID)
+	public, err := s.Repo.IsRoomPublic(room)
 	if err != nil {
 		return err
 	}
-	if !has {
+	if public {
 		return nil
 	}
 	return errors.New("forbidden: not a participant")
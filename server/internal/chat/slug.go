@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gocql/gocql"
+)
+
+const maxSlugLen = 48
+
+var ErrSlugTaken = errors.New("slug already taken")
+
+// reservedSlugs collide with fixed routes under /rooms.
+var reservedSlugs = map[string]bool{"directory": true}
+
+// Slugify turns a room name into a lowercase, dash-separated slug.
+func Slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= maxSlugLen {
+			break
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		slug = "room"
+	}
+	return slug
+}
+
+// validSlug reports whether s could have been produced by Slugify and cannot
+// be mistaken for a room UUID.
+func validSlug(s string) bool {
+	if s == "" || len(s) > maxSlugLen || Slugify(s) != s || reservedSlugs[s] {
+		return false
+	}
+	_, err := gocql.ParseUUID(s)
+	return err != nil
+}
+
+// reserveSlugFor claims base for roomID, falling back to base-2, base-3, ...
+// and finally a random suffix when the name is popular.
+func (s *Service) reserveSlugFor(roomID gocql.UUID, base string) (string, error) {
+	for i := 1; i <= 20; i++ {
+		slug := base
+		if i > 1 {
+			slug = base + "-" + strconv.Itoa(i)
+		}
+		if reservedSlugs[slug] {
+			continue
+		}
+		ok, err := s.Repo.ReserveSlug(slug, roomID)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return slug, nil
+		}
+	}
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	slug := base + "-" + hex.EncodeToString(buf)
+	ok, err := s.Repo.ReserveSlug(slug, roomID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrSlugTaken
+	}
+	return slug, nil
+}
+
+// ResolveRoom accepts a room UUID or a current/former slug and returns the room id.
+func (s *Service) ResolveRoom(ref string) (gocql.UUID, error) {
+	if id, err := gocql.ParseUUID(ref); err == nil {
+		return id, nil
+	}
+	id, err := s.Repo.GetRoomIDBySlug(strings.ToLower(ref))
+	if err == gocql.ErrNotFound {
+		return gocql.UUID{}, errors.New("room not found")
+	}
+	return id, err
+}
+
+// RenameRoom changes a room's name and slug. The previous slug keeps resolving
+// to the room so old links still work. An explicit slug must be free.
+func (s *Service) RenameRoom(roomID, userID gocql.UUID, req RenameRoomRequest) (*Room, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	room, err := s.loadRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = room.Name
+	}
+	if len(name) < 3 {
+		return nil, errors.New("room name must be at least 3 chars")
+	}
+
+	slug := room.Slug
+	if req.Slug != "" {
+		want := strings.ToLower(strings.TrimSpace(req.Slug))
+		if !validSlug(want) {
+			return nil, errors.New("invalid slug")
+		}
+		ok, err := s.Repo.ReserveSlug(want, roomID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrSlugTaken
+		}
+		slug = want
+	} else if name != room.Name || slug == "" {
+		if slug, err = s.reserveSlugFor(roomID, Slugify(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	if name != room.Name {
+		if err := s.Repo.UpdateRoomName(roomID, name); err != nil {
+			return nil, err
+		}
+	}
+	if slug != room.Slug {
+		if err := s.Repo.UpsertRoomSlug(roomID, slug); err != nil {
+			return nil, err
+		}
+	}
+	room.Name, room.Slug = name, slug
+	return room, nil
+}
+
+// ensureRoomAdmin allows the room creator and participants with the owner or admin role.
+// EnsureRoomAdmin is ensureRoomAdmin for other packages.
+func (s *Service) EnsureRoomAdmin(roomID, userID gocql.UUID) error {
+	return s.ensureRoomAdmin(roomID, userID)
+}
+
+func (s *Service) ensureRoomAdmin(roomID, userID gocql.UUID) error {
+	role, err := s.Repo.GetParticipantRole(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if role == "owner" || role == "admin" {
+		return nil
+	}
+	room, err := s.Repo.GetRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if room.CreatedBy == userID {
+		return nil
+	}
+	return errors.New("forbidden: room admin required")
+}
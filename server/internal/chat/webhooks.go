@@ -0,0 +1,388 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Incoming webhooks let CI, monitoring and other tools post into a room
+// without a user account: POST /hooks/{hook_id}/{token}. Messages go through
+// PostMessage like any other, authored by the webhook itself (its id is the
+// message's UserID) under the webhook's or the payload's display name.
+
+const (
+	webhookRateLimit  = 30 // messages per webhook per window
+	webhookRateWindow = time.Minute
+
+	maxWebhookNameLen  = 80
+	maxAttachments     = 10
+	maxAttachmentField = 20
+)
+
+var attachmentColorRe = regexp.MustCompile(`^(good|warning|danger|#[0-9a-fA-F]{6})$`)
+
+// Webhook is an incoming webhook bound to one room. Token is only returned
+// when the webhook is created or rotated; only its hash is stored.
+type Webhook struct {
+	HookID    gocql.UUID `json:"id"`
+	RoomID    gocql.UUID `json:"roomId"`
+	Name      string     `json:"name"`
+	AvatarURL string     `json:"avatarUrl,omitempty"`
+	CreatedBy gocql.UUID `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	URL       string     `json:"url,omitempty"` // filled in by the handler
+
+	tokenHash string
+}
+
+// Attachment is a simple rich block under a message, modelled on Slack's
+// legacy attachments.
+type Attachment struct {
+	Fallback  string            `json:"fallback,omitempty"`
+	Color     string            `json:"color,omitempty"`
+	Pretext   string            `json:"pretext,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	TitleLink string            `json:"titleLink,omitempty"`
+	Text      string            `json:"text,omitempty"`
+	ImageURL  string            `json:"imageUrl,omitempty"`
+	Fields    []AttachmentField `json:"fields,omitempty"`
+	Footer    string            `json:"footer,omitempty"`
+}
+
+type AttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short,omitempty"`
+}
+
+// Attachments is stored as a JSON text column.
+type Attachments []Attachment
+
+func (a Attachments) MarshalCQL(info gocql.TypeInfo) ([]byte, error) {
+	if len(a) == 0 {
+		return nil, nil
+	}
+	return json.Marshal([]Attachment(a))
+}
+
+func (a *Attachments) UnmarshalCQL(info gocql.TypeInfo, data []byte) error {
+	if len(data) == 0 {
+		*a = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*[]Attachment)(a))
+}
+
+// RateLimitError is returned when a caller has used up its rate limit.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string { return "rate limited" }
+
+func newWebhookToken() (token, hash string, err error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(buf)
+	return token, hashWebhookToken(token), nil
+}
+
+func hashWebhookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validWebhookURL(u string) bool {
+	return u == "" || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
+}
+
+// CreateWebhook adds an incoming webhook to a room; room admins only.
+func (s *Service) CreateWebhook(roomID, userID gocql.UUID, req CreateWebhookRequest) (*Webhook, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	if _, err := s.writableRoom(roomID); err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxWebhookNameLen {
+		return nil, errors.New("invalid name")
+	}
+	avatar := strings.TrimSpace(req.AvatarURL)
+	if !validWebhookURL(avatar) {
+		return nil, errors.New("invalid avatarUrl")
+	}
+	token, hash, err := newWebhookToken()
+	if err != nil {
+		return nil, err
+	}
+	h := &Webhook{
+		HookID:    gocql.TimeUUID(),
+		RoomID:    roomID,
+		Name:      name,
+		AvatarURL: avatar,
+		CreatedBy: userID,
+		CreatedAt: time.Now().UTC(),
+		Token:     token,
+		tokenHash: hash,
+	}
+	if err := s.Repo.InsertWebhook(h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (s *Service) ListWebhooks(roomID, userID gocql.UUID) ([]Webhook, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	hooks, err := s.Repo.ListWebhooks(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if hooks == nil {
+		hooks = []Webhook{}
+	}
+	return hooks, nil
+}
+
+// roomWebhook loads a webhook and checks it belongs to roomID.
+func (s *Service) roomWebhook(roomID, hookID gocql.UUID) (*Webhook, error) {
+	h, err := s.Repo.GetWebhook(hookID)
+	if err == gocql.ErrNotFound || (err == nil && h.RoomID != roomID) {
+		return nil, errors.New("webhook not found")
+	}
+	return h, err
+}
+
+// RotateWebhook replaces the webhook's token; the old URL stops working.
+func (s *Service) RotateWebhook(roomID, hookID, userID gocql.UUID) (*Webhook, error) {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return nil, err
+	}
+	h, err := s.roomWebhook(roomID, hookID)
+	if err != nil {
+		return nil, err
+	}
+	token, hash, err := newWebhookToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if err := s.Repo.UpdateWebhookToken(hookID, hash, now); err != nil {
+		return nil, err
+	}
+	h.Token, h.tokenHash, h.RotatedAt = token, hash, &now
+	return h, nil
+}
+
+// RevokeWebhook deletes the webhook. Messages it posted are kept.
+func (s *Service) RevokeWebhook(roomID, hookID, userID gocql.UUID) error {
+	if err := s.ensureRoomAdmin(roomID, userID); err != nil {
+		return err
+	}
+	if _, err := s.roomWebhook(roomID, hookID); err != nil {
+		return err
+	}
+	return s.Repo.DeleteWebhook(roomID, hookID)
+}
+
+// PostWebhookMessage authenticates an incoming webhook call and posts its
+// payload to the webhook's room.
+func (s *Service) PostWebhookMessage(ctx context.Context, hookID gocql.UUID, token string, req IncomingWebhookRequest) (*PostedMessage, error) {
+	h, err := s.Repo.GetWebhook(hookID)
+	if err == gocql.ErrNotFound {
+		return nil, errors.New("webhook not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashWebhookToken(token)), []byte(h.tokenHash)) != 1 {
+		return nil, errors.New("webhook not found")
+	}
+	if s.Limiter != nil {
+		ok, retry, err := s.Limiter.Allow(ctx, "webhook:"+hookID.String(), webhookRateLimit, webhookRateWindow)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &RateLimitError{RetryAfter: retry}
+		}
+	}
+
+	attachments, err := normalizeAttachments(req.Attachments)
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(req.Text)
+	if content == "" {
+		content = attachmentSummary(attachments)
+	}
+	name := strings.TrimSpace(req.Username)
+	if name == "" {
+		name = h.Name
+	}
+	if len(name) > maxWebhookNameLen {
+		return nil, errors.New("invalid username")
+	}
+	avatar := strings.TrimSpace(req.AvatarURL)
+	if avatar == "" {
+		avatar = strings.TrimSpace(req.IconURL)
+	}
+	if avatar == "" {
+		avatar = h.AvatarURL
+	}
+	if !validWebhookURL(avatar) {
+		return nil, errors.New("invalid avatarUrl")
+	}
+
+	return s.PostMessage(ctx, PostMessageInput{
+		RoomID:      h.RoomID,
+		UserID:      h.HookID,
+		Content:     content,
+		Attachments: attachments,
+		webhook:     &webhookAuthor{hookID: h.HookID, name: name, avatar: avatar},
+	})
+}
+
+// webhookAuthor is who a webhook message is shown as.
+type webhookAuthor struct {
+	hookID gocql.UUID
+	name   string
+	avatar string
+}
+
+// normalizeAttachments accepts both our camelCase and Slack's snake_case
+// attachment fields and validates the result.
+func normalizeAttachments(in []IncomingAttachment) (Attachments, error) {
+	if len(in) > maxAttachments {
+		return nil, fmt.Errorf("at most %d attachments", maxAttachments)
+	}
+	var out Attachments
+	for _, a := range in {
+		att := Attachment{
+			Fallback:  a.Fallback,
+			Color:     a.Color,
+			Pretext:   a.Pretext,
+			Title:     a.Title,
+			TitleLink: firstNonEmpty(a.TitleLink, a.SlackTitleLink),
+			Text:      a.Text,
+			ImageURL:  firstNonEmpty(a.ImageURL, a.SlackImageURL),
+			Fields:    a.Fields,
+			Footer:    a.Footer,
+		}
+		if att.Color != "" && !attachmentColorRe.MatchString(att.Color) {
+			return nil, errors.New("invalid attachment color")
+		}
+		if !validWebhookURL(att.TitleLink) || !validWebhookURL(att.ImageURL) {
+			return nil, errors.New("invalid attachment url")
+		}
+		if len(att.Fields) > maxAttachmentField {
+			return nil, fmt.Errorf("at most %d fields per attachment", maxAttachmentField)
+		}
+		for _, s := range []string{att.Fallback, att.Pretext, att.Title, att.Text, att.Footer} {
+			if len(s) > maxContentLen {
+				return nil, errors.New("attachment too long")
+			}
+		}
+		out = append(out, att)
+	}
+	return out, nil
+}
+
+// attachmentSummary is the message text for a payload with only attachments,
+// used by clients that don't render them and by notifications.
+func attachmentSummary(atts Attachments) string {
+	for _, a := range atts {
+		if s := firstNonEmpty(a.Fallback, a.Title, a.Pretext, a.Text); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+const webhookColumns = `hook_id, room_id, name, avatar_url, token_hash, created_by, created_at, rotated_at`
+
+func webhookDest(h *Webhook) []interface{} {
+	return []interface{}{&h.HookID, &h.RoomID, &h.Name, &h.AvatarURL, &h.tokenHash, &h.CreatedBy, &h.CreatedAt, &h.RotatedAt}
+}
+
+func (r *Repository) InsertWebhook(h *Webhook) error {
+	if err := r.Session.Query(`INSERT INTO room_webhooks (`+webhookColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		h.HookID, h.RoomID, h.Name, h.AvatarURL, h.tokenHash, h.CreatedBy, h.CreatedAt, h.RotatedAt,
+	).Exec(); err != nil {
+		return err
+	}
+	return r.Session.Query(`INSERT INTO room_webhooks_by_room (room_id, hook_id) VALUES (?, ?)`,
+		h.RoomID, h.HookID).Exec()
+}
+
+func (r *Repository) GetWebhook(hookID gocql.UUID) (*Webhook, error) {
+	var h Webhook
+	if err := r.Session.Query(`SELECT `+webhookColumns+` FROM room_webhooks WHERE hook_id = ?`, hookID).
+		Scan(webhookDest(&h)...); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (r *Repository) ListWebhooks(roomID gocql.UUID) ([]Webhook, error) {
+	iter := r.Session.Query(`SELECT hook_id FROM room_webhooks_by_room WHERE room_id = ?`, roomID).Iter()
+	var ids []gocql.UUID
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	var out []Webhook
+	for _, id := range ids {
+		h, err := r.GetWebhook(id)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *h)
+	}
+	return out, nil
+}
+
+func (r *Repository) UpdateWebhookToken(hookID gocql.UUID, tokenHash string, rotatedAt time.Time) error {
+	return r.Session.Query(`UPDATE room_webhooks SET token_hash = ?, rotated_at = ? WHERE hook_id = ?`,
+		tokenHash, rotatedAt, hookID).Exec()
+}
+
+func (r *Repository) DeleteWebhook(roomID, hookID gocql.UUID) error {
+	if err := r.Session.Query(`DELETE FROM room_webhooks WHERE hook_id = ?`, hookID).Exec(); err != nil {
+		return err
+	}
+	return r.Session.Query(`DELETE FROM room_webhooks_by_room WHERE room_id = ? AND hook_id = ?`,
+		roomID, hookID).Exec()
+}
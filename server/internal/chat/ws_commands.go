@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gocql/gocql"
+
+	"gochat/internal/ws"
+)
+
+// RegisterCommands routes the message commands clients send over /ws through
+// the same service methods the REST handlers use.
+func (s *Service) RegisterCommands(hub *ws.Hub) {
+	hub.HandleCommand("message.send", s.wsSend)
+	hub.HandleCommand("message.edit", s.wsEdit)
+	hub.HandleCommand("message.delete", s.wsDelete)
+	hub.HandleCommand("poll.vote", s.wsPollVote)
+}
+
+func (s *Service) wsSend(ctx context.Context, c *ws.Client, ev ws.Event) error {
+	userID, roomID, err := s.wsUserAndRoom(c, ev)
+	if err != nil {
+		return err
+	}
+	in := PostMessageInput{RoomID: roomID, UserID: userID, Scopes: c.Scopes}
+	in.Content, _ = ev.Payload["content"].(string)
+	in.TempID, _ = ev.Payload["tempId"].(string)
+	if p, _ := ev.Payload["parentId"].(string); p != "" {
+		parentID, err := gocql.ParseUUID(p)
+		if err != nil {
+			return errors.New("invalid parent id")
+		}
+		in.ParentID = &parentID
+	}
+	_, err = s.PostMessage(ctx, in)
+	return err
+}
+
+func (s *Service) wsEdit(ctx context.Context, c *ws.Client, ev ws.Event) error {
+	userID, roomID, err := s.wsUserAndRoom(c, ev)
+	if err != nil {
+		return err
+	}
+	msgID, err := wsMsgID(ev)
+	if err != nil {
+		return err
+	}
+	content, _ := ev.Payload["content"].(string)
+	_, err = s.EditMessage(roomID, msgID, userID, content)
+	return err
+}
+
+func (s *Service) wsDelete(ctx context.Context, c *ws.Client, ev ws.Event) error {
+	userID, roomID, err := s.wsUserAndRoom(c, ev)
+	if err != nil {
+		return err
+	}
+	msgID, err := wsMsgID(ev)
+	if err != nil {
+		return err
+	}
+	reason, _ := ev.Payload["reason"].(string)
+	_, err = s.DeleteMessage(roomID, msgID, userID, reason)
+	return err
+}
+
+func (s *Service) wsPollVote(ctx context.Context, c *ws.Client, ev ws.Event) error {
+	userID, roomID, err := s.wsUserAndRoom(c, ev)
+	if err != nil {
+		return err
+	}
+	id, _ := ev.Payload["pollId"].(string)
+	pollID, err := gocql.ParseUUID(id)
+	if err != nil {
+		return errors.New("invalid poll id")
+	}
+	raw, _ := ev.Payload["options"].([]any)
+	options := make([]int, 0, len(raw))
+	for _, v := range raw {
+		// JSON numbers decode as float64
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) {
+			return errors.New("invalid option")
+		}
+		options = append(options, int(f))
+	}
+	_, err = s.Vote(roomID, pollID, userID, options)
+	return err
+}
+
+func (s *Service) wsUserAndRoom(c *ws.Client, ev ws.Event) (gocql.UUID, gocql.UUID, error) {
+	userID, err := gocql.ParseUUID(c.UserID)
+	if err != nil {
+		return gocql.UUID{}, gocql.UUID{}, errors.New("invalid user id")
+	}
+	ref, _ := ev.Payload["roomId"].(string)
+	if ref == "" {
+		ref = ev.To
+	}
+	roomID, err := s.ResolveRoom(ref)
+	if err != nil {
+		return gocql.UUID{}, gocql.UUID{}, errors.New("invalid room id")
+	}
+	return userID, roomID, nil
+}
+
+func wsMsgID(ev ws.Event) (gocql.UUID, error) {
+	id, _ := ev.Payload["msgId"].(string)
+	if id == "" {
+		id, _ = ev.Payload["id"].(string)
+	}
+	msgID, err := gocql.ParseUUID(id)
+	if err != nil {
+		return gocql.UUID{}, errors.New("invalid message id")
+	}
+	return msgID, nil
+}
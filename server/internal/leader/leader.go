@@ -0,0 +1,81 @@
+// Package leader elects one process among the server replicas to run
+// singleton background jobs, using a Redis key as a lease.
+package leader
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+)
+
+// renew extends the lease only while we still hold it.
+var renew = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// release drops the lease only while we still hold it.
+var release = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+type Elector struct {
+	rdb    *redis.Client
+	key    string
+	id     string
+	ttl    time.Duration
+	leader atomic.Bool
+}
+
+// New returns an elector competing for key. The lease lasts ttl and is
+// renewed every ttl/3, so a crashed leader is replaced within ttl.
+func New(rdb *redis.Client, key string, ttl time.Duration) *Elector {
+	return &Elector{rdb: rdb, key: key, id: gocql.TimeUUID().String(), ttl: ttl}
+}
+
+// IsLeader reports whether this process currently holds the lease. Jobs
+// should check it before each unit of work.
+func (e *Elector) IsLeader() bool { return e.leader.Load() }
+
+// Run campaigns for the lease until ctx is done, then releases it.
+func (e *Elector) Run(ctx context.Context) {
+	t := time.NewTicker(e.ttl / 3)
+	defer t.Stop()
+	for {
+		e.tick(ctx)
+		select {
+		case <-ctx.Done():
+			if e.leader.Swap(false) {
+				_ = release.Run(context.Background(), e.rdb, []string{e.key}, e.id).Err()
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (e *Elector) tick(ctx context.Context) {
+	if e.leader.Load() {
+		n, err := renew.Run(ctx, e.rdb, []string{e.key}, e.id, e.ttl.Milliseconds()).Int()
+		if err != nil || n == 0 {
+			e.leader.Store(false)
+			log.Printf("leader: lost %s", e.key)
+		}
+		return
+	}
+	ok, err := e.rdb.SetNX(ctx, e.key, e.id, e.ttl).Result()
+	if err != nil {
+		return
+	}
+	if ok {
+		e.leader.Store(true)
+		log.Printf("leader: acquired %s", e.key)
+	}
+}
@@ -0,0 +1,142 @@
+// Package mailer sends transactional email. Production uses SMTP; local
+// development and tests write messages to an outbox directory instead.
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gochat/internal/utils"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// FromEnv picks the mailer the environment configures:
+//
+//	MAIL_SMTP_HOST  send through this SMTP server (MAIL_SMTP_PORT, default 587,
+//	                MAIL_SMTP_USER and MAIL_SMTP_PASSWORD for PLAIN auth)
+//	MAIL_OUTBOX_DIR otherwise write messages here, one .eml file each
+//	MAIL_FROM       sender address (default "gochat <no-reply@localhost>")
+//
+// With neither set it fails, except with ENV=dev where messages are dropped
+// and only their recipient and subject logged.
+func FromEnv() (Mailer, error) {
+	from := utils.GetEnv("MAIL_FROM", "gochat <no-reply@localhost>")
+	if host := os.Getenv("MAIL_SMTP_HOST"); host != "" {
+		return &SMTP{
+			Addr:     net.JoinHostPort(host, utils.GetEnv("MAIL_SMTP_PORT", "587")),
+			Username: os.Getenv("MAIL_SMTP_USER"),
+			Password: os.Getenv("MAIL_SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	}
+	dir := os.Getenv("MAIL_OUTBOX_DIR")
+	if dir == "" && os.Getenv("ENV") != "dev" {
+		return nil, errors.New("no mailer configured; set MAIL_SMTP_HOST or MAIL_OUTBOX_DIR")
+	}
+	return &Outbox{Dir: dir, From: from}, nil
+}
+
+// format renders m as an RFC 5322 message.
+func format(from string, m Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Text, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// headerSafe rejects values that would inject extra headers.
+func headerSafe(m Message) error {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+		return fmt.Errorf("mailer: invalid header value")
+	}
+	return nil
+}
+
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	if err := headerSafe(m); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, envelopeAddr(s.From), []string{m.To}, format(s.From, m))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// envelopeAddr extracts the bare address from `Name <addr>`.
+func envelopeAddr(from string) string {
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return from
+}
+
+// Outbox keeps messages instead of sending them. Each goes to Dir as an .eml
+// file when Dir is set and is dropped otherwise. Only the recipient and
+// subject are logged, since bodies carry sign-in and reset links.
+type Outbox struct {
+	Dir  string
+	From string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func (o *Outbox) Send(_ context.Context, m Message) error {
+	if err := headerSafe(m); err != nil {
+		return err
+	}
+	if o.Dir == "" {
+		log.Printf("📧 mail to %s: %s (not kept; set MAIL_OUTBOX_DIR)", m.To, m.Subject)
+		return nil
+	}
+	if err := os.MkdirAll(o.Dir, 0o755); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.seq++
+	name := fmt.Sprintf("%s-%03d.eml", time.Now().UTC().Format("20060102T150405.000"), o.seq)
+	o.mu.Unlock()
+	log.Printf("📧 mail to %s: %s (%s)", m.To, m.Subject, name)
+	return os.WriteFile(filepath.Join(o.Dir, name), format(o.From, m), 0o644)
+}
@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"net/http"
+	"strconv"
+
+	"gochat/internal/auth"
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	Svc *Service
+}
+
+func NewHandler(s *Service) *Handler { return &Handler{Svc: s} }
+
+// Register mounts the routes on an authenticated /api router.
+func (h *Handler) Register(r *mux.Router) {
+	r.HandleFunc("/me/notifications", h.List).Methods("GET")
+	r.HandleFunc("/me/notifications/{notif_id}", h.Dismiss).Methods("DELETE")
+}
+
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	uid, err := gocql.ParseUUID(auth.GetUserID(r))
+	if err != nil {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	list, err := h.Svc.List(uid, limit)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+func (h *Handler) Dismiss(w http.ResponseWriter, r *http.Request) {
+	uid, err := gocql.ParseUUID(auth.GetUserID(r))
+	if err != nil {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	id, err := gocql.ParseUUID(mux.Vars(r)["notif_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid notification id"})
+		return
+	}
+	if err := h.Svc.Dismiss(uid, id); err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "dismissed"})
+}
@@ -0,0 +1,82 @@
+// Package notify delivers per-user events over the hub and keeps the ones
+// that could not be delivered so the client can fetch them on reconnect.
+package notify
+
+import (
+	"encoding/json"
+	"time"
+
+	"gochat/internal/ws"
+
+	"github.com/gocql/gocql"
+)
+
+type Notification struct {
+	ID        gocql.UUID     `json:"id"`
+	Type      string         `json:"type"`
+	Payload   map[string]any `json:"payload"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+type Service struct {
+	Session *gocql.Session
+	// Hub delivers to online users; nil stores everything.
+	Hub *ws.Hub
+}
+
+func NewService(sess *gocql.Session, hub *ws.Hub) *Service {
+	return &Service{Session: sess, Hub: hub}
+}
+
+// Deliver sends an event of type typ to userID, storing it as a notification
+// when the user has no open connection. It reports whether it went live.
+func (s *Service) Deliver(userID gocql.UUID, typ string, payload map[string]any) (bool, error) {
+	if s.Hub != nil && s.Hub.SendToUser(userID.String(), ws.NewServerEvent(typ, "server", userID.String(), payload)) {
+		return true, nil
+	}
+	return false, s.store(userID, typ, payload)
+}
+
+func (s *Service) store(userID gocql.UUID, typ string, payload map[string]any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.Session.Query(
+		`INSERT INTO notifications (user_id, notif_id, type, payload, created_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, gocql.TimeUUID(), typ, string(raw), time.Now().UTC(),
+	).Exec()
+}
+
+// List returns the user's queued notifications, newest first.
+func (s *Service) List(userID gocql.UUID, limit int) ([]Notification, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	iter := s.Session.Query(
+		`SELECT notif_id, type, payload, created_at FROM notifications WHERE user_id = ? LIMIT ?`,
+		userID, limit,
+	).Iter()
+
+	out := []Notification{}
+	var (
+		n   Notification
+		raw string
+	)
+	for iter.Scan(&n.ID, &n.Type, &raw, &n.CreatedAt) {
+		_ = json.Unmarshal([]byte(raw), &n.Payload)
+		out = append(out, n)
+		n = Notification{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Dismiss removes one notification.
+func (s *Service) Dismiss(userID, id gocql.UUID) error {
+	return s.Session.Query(
+		`DELETE FROM notifications WHERE user_id = ? AND notif_id = ?`, userID, id,
+	).Exec()
+}
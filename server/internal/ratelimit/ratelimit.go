@@ -0,0 +1,46 @@
+// Package ratelimit counts requests per key in fixed Redis windows, so a
+// limit holds across all server replicas.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// incr bumps the window's counter and sets its expiry on first use.
+var incr = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n`)
+
+type Limiter struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// New returns a limiter whose keys are namespaced under prefix.
+func New(rdb *redis.Client, prefix string) *Limiter {
+	return &Limiter{rdb: rdb, prefix: prefix}
+}
+
+// Allow counts one hit against key and reports whether it is within limit
+// hits per window. When it is not, retryAfter is the time left in the window.
+func (l *Limiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (ok bool, retryAfter time.Duration, err error) {
+	now := time.Now()
+	slot := now.UnixNano() / int64(window)
+	k := fmt.Sprintf("ratelimit:%s:%s:%d", l.prefix, key, slot)
+	n, err := incr.Run(ctx, l.rdb, []string{k}, window.Milliseconds()).Int()
+	if err != nil {
+		return false, 0, err
+	}
+	if n > limit {
+		end := time.Unix(0, (slot+1)*int64(window))
+		return false, end.Sub(now), nil
+	}
+	return true, 0, nil
+}
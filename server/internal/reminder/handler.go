@@ -0,0 +1,144 @@
+package reminder
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gochat/internal/auth"
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	Svc *Service
+}
+
+func NewHandler(s *Service) *Handler { return &Handler{Svc: s} }
+
+// Register mounts the routes on an authenticated /api router.
+func (h *Handler) Register(r *mux.Router) {
+	r.HandleFunc("/me/reminders", h.Create).Methods("POST")
+	r.HandleFunc("/me/reminders", h.List).Methods("GET")
+	r.HandleFunc("/me/reminders/{reminder_id}", h.Get).Methods("GET")
+	r.HandleFunc("/me/reminders/{reminder_id}", h.Delete).Methods("DELETE")
+	r.HandleFunc("/me/reminders/{reminder_id}/snooze", h.Snooze).Methods("POST")
+	r.HandleFunc("/me/reminders/{reminder_id}/complete", h.Complete).Methods("POST")
+}
+
+func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
+	uid, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var req CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	rm, err := h.Svc.Create(uid, req)
+	if err != nil {
+		utils.JSONResponse(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusCreated, rm)
+}
+
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	uid, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Svc.List(uid, r.URL.Query().Get("status"))
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndReminder(w, r)
+	if !ok {
+		return
+	}
+	rm, err := h.Svc.Get(uid, id)
+	writeReminder(w, rm, err)
+}
+
+func (h *Handler) Snooze(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndReminder(w, r)
+	if !ok {
+		return
+	}
+	var req SnoozeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	rm, err := h.Svc.Snooze(uid, id, req)
+	writeReminder(w, rm, err)
+}
+
+func (h *Handler) Complete(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndReminder(w, r)
+	if !ok {
+		return
+	}
+	rm, err := h.Svc.Complete(uid, id)
+	writeReminder(w, rm, err)
+}
+
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndReminder(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Svc.Delete(uid, id); err != nil {
+		utils.JSONResponse(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func writeReminder(w http.ResponseWriter, rm *Reminder, err error) {
+	if err != nil {
+		utils.JSONResponse(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, rm)
+}
+
+func errorStatus(err error) int {
+	switch {
+	case strings.HasSuffix(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "forbidden"):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func userID(w http.ResponseWriter, r *http.Request) (gocql.UUID, bool) {
+	uid, err := gocql.ParseUUID(auth.GetUserID(r))
+	if err != nil {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return gocql.UUID{}, false
+	}
+	return uid, true
+}
+
+func userAndReminder(w http.ResponseWriter, r *http.Request) (gocql.UUID, gocql.UUID, bool) {
+	uid, ok := userID(w, r)
+	if !ok {
+		return uid, gocql.UUID{}, false
+	}
+	id, err := gocql.ParseUUID(mux.Vars(r)["reminder_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid reminder id"})
+		return uid, gocql.UUID{}, false
+	}
+	return uid, id, true
+}
@@ -0,0 +1,42 @@
+package reminder
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusFired     = "fired"
+	StatusCompleted = "completed"
+)
+
+type Reminder struct {
+	ID          gocql.UUID  `json:"id"`
+	UserID      gocql.UUID  `json:"userId"`
+	RoomID      *gocql.UUID `json:"roomId,omitempty"`
+	MsgID       *gocql.UUID `json:"msgId,omitempty"`
+	Text        string      `json:"text,omitempty"`
+	DueAt       time.Time   `json:"dueAt"`
+	Status      string      `json:"status"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	FiredAt     *time.Time  `json:"firedAt,omitempty"`
+	CompletedAt *time.Time  `json:"completedAt,omitempty"`
+}
+
+// CreateRequest references a message (roomId + msgId), carries free text,
+// or both. The due time is either dueAt or a duration such as "30m".
+type CreateRequest struct {
+	RoomID string     `json:"roomId,omitempty"`
+	MsgID  string     `json:"msgId,omitempty"`
+	Text   string     `json:"text,omitempty"`
+	DueAt  *time.Time `json:"dueAt,omitempty"`
+	In     string     `json:"in,omitempty"`
+}
+
+// SnoozeRequest moves a reminder to until, or by the duration in For.
+type SnoozeRequest struct {
+	Until *time.Time `json:"until,omitempty"`
+	For   string     `json:"for,omitempty"`
+}
@@ -0,0 +1,115 @@
+package reminder
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+type Repository struct {
+	Session *gocql.Session
+}
+
+func NewRepository(sess *gocql.Session) *Repository {
+	return &Repository{Session: sess}
+}
+
+type dueEntry struct {
+	DueAt      time.Time
+	ReminderID gocql.UUID
+	UserID     gocql.UUID
+}
+
+func dueHour(t time.Time) int64 { return t.Unix() / 3600 }
+
+const reminderColumns = `reminder_id, user_id, room_id, msg_id, text, due_at, status, created_at, fired_at, completed_at`
+
+func reminderDest(rm *Reminder) []interface{} {
+	return []interface{}{&rm.ID, &rm.UserID, &rm.RoomID, &rm.MsgID, &rm.Text,
+		&rm.DueAt, &rm.Status, &rm.CreatedAt, &rm.FiredAt, &rm.CompletedAt}
+}
+
+func (r *Repository) Insert(rm *Reminder) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO reminders (`+reminderColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rm.ID, rm.UserID, rm.RoomID, rm.MsgID, rm.Text, rm.DueAt, rm.Status, rm.CreatedAt, rm.FiredAt, rm.CompletedAt)
+	b.Query(`INSERT INTO reminders_due (due_hour, due_at, reminder_id, user_id) VALUES (?, ?, ?, ?)`,
+		dueHour(rm.DueAt), rm.DueAt, rm.ID, rm.UserID)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) Get(userID, id gocql.UUID) (*Reminder, error) {
+	var rm Reminder
+	err := r.Session.Query(
+		`SELECT `+reminderColumns+` FROM reminders WHERE user_id = ? AND reminder_id = ?`, userID, id,
+	).Scan(reminderDest(&rm)...)
+	if err != nil {
+		return nil, err
+	}
+	return &rm, nil
+}
+
+// List returns the user's reminders, newest first.
+func (r *Repository) List(userID gocql.UUID) ([]Reminder, error) {
+	iter := r.Session.Query(
+		`SELECT `+reminderColumns+` FROM reminders WHERE user_id = ?`, userID,
+	).Iter()
+	var out []Reminder
+	var rm Reminder
+	for iter.Scan(reminderDest(&rm)...) {
+		out = append(out, rm)
+		rm = Reminder{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Save writes rm's mutable fields and moves its queue entry from prevDue.
+// Only pending reminders stay queued.
+func (r *Repository) Save(rm *Reminder, prevDue time.Time) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`UPDATE reminders SET due_at = ?, status = ?, fired_at = ?, completed_at = ?
+	         WHERE user_id = ? AND reminder_id = ?`,
+		rm.DueAt, rm.Status, rm.FiredAt, rm.CompletedAt, rm.UserID, rm.ID)
+	b.Query(`DELETE FROM reminders_due WHERE due_hour = ? AND due_at = ? AND reminder_id = ?`,
+		dueHour(prevDue), prevDue, rm.ID)
+	if rm.Status == StatusPending {
+		b.Query(`INSERT INTO reminders_due (due_hour, due_at, reminder_id, user_id) VALUES (?, ?, ?, ?)`,
+			dueHour(rm.DueAt), rm.DueAt, rm.ID, rm.UserID)
+	}
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) Delete(rm *Reminder) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`DELETE FROM reminders WHERE user_id = ? AND reminder_id = ?`, rm.UserID, rm.ID)
+	b.Query(`DELETE FROM reminders_due WHERE due_hour = ? AND due_at = ? AND reminder_id = ?`,
+		dueHour(rm.DueAt), rm.DueAt, rm.ID)
+	return r.Session.ExecuteBatch(b)
+}
+
+// Due returns the queue entries of one hour that are due by now.
+func (r *Repository) Due(hour int64, now time.Time) ([]dueEntry, error) {
+	iter := r.Session.Query(
+		`SELECT due_at, reminder_id, user_id FROM reminders_due WHERE due_hour = ? AND due_at <= ?`,
+		hour, now,
+	).Iter()
+	var out []dueEntry
+	var e dueEntry
+	for iter.Scan(&e.DueAt, &e.ReminderID, &e.UserID) {
+		out = append(out, e)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repository) deleteDue(e dueEntry) error {
+	return r.Session.Query(
+		`DELETE FROM reminders_due WHERE due_hour = ? AND due_at = ? AND reminder_id = ?`,
+		dueHour(e.DueAt), e.DueAt, e.ReminderID,
+	).Exec()
+}
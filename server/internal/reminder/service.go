@@ -0,0 +1,292 @@
+package reminder
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gochat/internal/chat"
+	"gochat/internal/notify"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	maxTextLen = 1000
+	maxAhead   = 365 * 24 * time.Hour
+	tick       = 5 * time.Second
+	lookback   = 7 * 24 // hours scanned when a process becomes leader
+)
+
+var ErrNotFound = errors.New("reminder not found")
+
+type Service struct {
+	Repo   *Repository
+	Chat   *chat.Service
+	Notify *notify.Service
+}
+
+func NewService(repo *Repository, chatSvc *chat.Service, n *notify.Service) *Service {
+	return &Service{Repo: repo, Chat: chatSvc, Notify: n}
+}
+
+func (s *Service) Create(userID gocql.UUID, req CreateRequest) (*Reminder, error) {
+	text := strings.TrimSpace(req.Text)
+	if len(text) > maxTextLen {
+		return nil, errors.New("text too long")
+	}
+	dueAt, err := dueTime(req.DueAt, req.In)
+	if err != nil {
+		return nil, err
+	}
+
+	rm := &Reminder{
+		ID:        gocql.TimeUUID(),
+		UserID:    userID,
+		Text:      text,
+		DueAt:     dueAt,
+		Status:    StatusPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.MsgID != "" {
+		roomID, err := s.Chat.ResolveRoom(req.RoomID)
+		if err != nil {
+			return nil, errors.New("invalid room id")
+		}
+		msgID, err := gocql.ParseUUID(req.MsgID)
+		if err != nil {
+			return nil, errors.New("invalid message id")
+		}
+		if err := s.Chat.EnsureMemberOrPublic(roomID, userID); err != nil {
+			return nil, err
+		}
+		if _, err := s.Chat.Repo.GetMessage(roomID, msgID); err != nil {
+			return nil, errors.New("message not found")
+		}
+		rm.RoomID, rm.MsgID = &roomID, &msgID
+	} else if text == "" {
+		return nil, errors.New("text or msgId is required")
+	}
+
+	if err := s.Repo.Insert(rm); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+func (s *Service) Get(userID, id gocql.UUID) (*Reminder, error) {
+	rm, err := s.Repo.Get(userID, id)
+	if err == gocql.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return rm, err
+}
+
+// List returns the user's reminders with the given status, or every
+// reminder that is not completed, soonest first.
+func (s *Service) List(userID gocql.UUID, status string) ([]Reminder, error) {
+	all, err := s.Repo.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	out := []Reminder{}
+	for _, rm := range all {
+		if (status == "" && rm.Status != StatusCompleted) || rm.Status == status {
+			out = append(out, rm)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DueAt.Before(out[j].DueAt) })
+	return out, nil
+}
+
+// Snooze puts a pending or fired reminder back in the queue.
+func (s *Service) Snooze(userID, id gocql.UUID, req SnoozeRequest) (*Reminder, error) {
+	rm, err := s.Get(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if rm.Status == StatusCompleted {
+		return nil, errors.New("reminder already completed")
+	}
+	dueAt, err := dueTime(req.Until, req.For)
+	if err != nil {
+		return nil, err
+	}
+	prev := rm.DueAt
+	rm.DueAt, rm.Status, rm.FiredAt = dueAt, StatusPending, nil
+	if err := s.Repo.Save(rm, prev); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+func (s *Service) Complete(userID, id gocql.UUID) (*Reminder, error) {
+	rm, err := s.Get(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if rm.Status == StatusCompleted {
+		return rm, nil
+	}
+	now := time.Now().UTC()
+	rm.Status, rm.CompletedAt = StatusCompleted, &now
+	if err := s.Repo.Save(rm, rm.DueAt); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+func (s *Service) Delete(userID, id gocql.UUID) error {
+	rm, err := s.Get(userID, id)
+	if err != nil {
+		return err
+	}
+	return s.Repo.Delete(rm)
+}
+
+func dueTime(at *time.Time, in string) (time.Time, error) {
+	var t time.Time
+	switch {
+	case at != nil && in != "":
+		return time.Time{}, errors.New("give either a time or a duration")
+	case at != nil:
+		t = *at
+	case in != "":
+		d, err := time.ParseDuration(in)
+		if err != nil || d <= 0 {
+			return time.Time{}, errors.New("invalid duration")
+		}
+		t = time.Now().Add(d)
+	default:
+		return time.Time{}, errors.New("due time is required")
+	}
+	t = t.UTC().Truncate(time.Millisecond)
+	now := time.Now()
+	if !t.After(now) {
+		return time.Time{}, errors.New("due time must be in the future")
+	}
+	if t.Sub(now) > maxAhead {
+		return time.Time{}, errors.New("due time is too far ahead")
+	}
+	return t, nil
+}
+
+// RunWorker fires due reminders until ctx is done, doing work only while
+// isLeader reports true.
+func (s *Service) RunWorker(ctx context.Context, isLeader func() bool) {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	var from int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !isLeader() {
+			from = 0
+			continue
+		}
+		now := time.Now().UTC()
+		if from == 0 {
+			from = dueHour(now) - lookback
+		}
+		if s.fireDue(ctx, from, now) {
+			from = dueHour(now) - 1
+		}
+	}
+}
+
+func (s *Service) fireDue(ctx context.Context, from int64, now time.Time) bool {
+	for h := from; h <= dueHour(now); h++ {
+		entries, err := s.Repo.Due(h, now)
+		if err != nil {
+			log.Printf("reminders: hour %d: %v", h, err)
+			return false
+		}
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return false
+			}
+			s.fire(e, now)
+		}
+	}
+	return true
+}
+
+func (s *Service) fire(e dueEntry, now time.Time) {
+	rm, err := s.Repo.Get(e.UserID, e.ReminderID)
+	if err == gocql.ErrNotFound {
+		_ = s.Repo.deleteDue(e)
+		return
+	}
+	if err != nil {
+		log.Printf("reminders: load %s: %v", e.ReminderID, err)
+		return
+	}
+	// Snoozed or completed since this entry was queued.
+	if rm.Status != StatusPending || !rm.DueAt.Equal(e.DueAt) {
+		_ = s.Repo.deleteDue(e)
+		return
+	}
+
+	rm.Status, rm.FiredAt = StatusFired, &now
+	if err := s.Repo.Save(rm, rm.DueAt); err != nil {
+		log.Printf("reminders: save %s: %v", rm.ID, err)
+		return
+	}
+	if _, err := s.Notify.Deliver(rm.UserID, "reminder.due", s.duePayload(rm)); err != nil {
+		log.Printf("reminders: deliver %s: %v", rm.ID, err)
+	}
+}
+
+// duePayload is the reminder.due event body, with a preview of the
+// referenced message when it still exists.
+func (s *Service) duePayload(rm *Reminder) map[string]any {
+	payload := map[string]any{
+		"id":     rm.ID.String(),
+		"text":   rm.Text,
+		"dueAt":  rm.DueAt.Format(time.RFC3339Nano),
+		"status": rm.Status,
+	}
+	if rm.RoomID == nil || rm.MsgID == nil {
+		return payload
+	}
+	payload["roomId"] = rm.RoomID.String()
+	payload["msgId"] = rm.MsgID.String()
+	if s.Chat.EnsureMemberOrPublic(*rm.RoomID, rm.UserID) != nil {
+		return payload
+	}
+	if msg, err := s.Chat.Repo.GetMessage(*rm.RoomID, *rm.MsgID); err == nil && msg.DeletedAt == nil {
+		payload["message"] = map[string]any{
+			"content":   msg.Content,
+			"authorId":  msg.UserID.String(),
+			"createdAt": msg.CreatedAt.Format(time.RFC3339Nano),
+		}
+	}
+	return payload
+}
+
+// RegisterSlashCommands adds /remind to the chat command registry.
+func (s *Service) RegisterSlashCommands() {
+	s.Chat.RegisterSlashCommand("remind", "Remind yourself about something", "<in 30m> <what>", s.cmdRemind)
+}
+
+func (s *Service) cmdRemind(ctx context.Context, inv *chat.CommandInvocation) (*chat.CommandResponse, error) {
+	d, text, err := chat.ParseCommandDuration(inv.Args)
+	if err != nil || text == "" {
+		return &chat.CommandResponse{Text: "Usage: /remind in 30m check the build"}, nil
+	}
+	due := time.Now().Add(d)
+	rm, err := s.Create(inv.UserID, CreateRequest{RoomID: inv.RoomID.String(), Text: text, DueAt: &due})
+	if err != nil {
+		return nil, err
+	}
+	return &chat.CommandResponse{
+		Text: "OK, I'll remind you at " + rm.DueAt.Format("15:04 MST, Jan 2") + ": " + text,
+	}, nil
+}
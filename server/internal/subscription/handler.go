@@ -0,0 +1,174 @@
+package subscription
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gochat/internal/auth"
+	"gochat/internal/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+type Handler struct {
+	Svc *Service
+}
+
+func NewHandler(s *Service) *Handler { return &Handler{Svc: s} }
+
+// Register mounts the routes on an authenticated /api router.
+func (h *Handler) Register(r *mux.Router) {
+	r.HandleFunc("/subscriptions", h.Create).Methods("POST")
+	r.HandleFunc("/subscriptions", h.List).Methods("GET")
+	r.HandleFunc("/subscriptions/{sub_id}", h.Get).Methods("GET")
+	r.HandleFunc("/subscriptions/{sub_id}", h.Update).Methods("PATCH")
+	r.HandleFunc("/subscriptions/{sub_id}", h.Delete).Methods("DELETE")
+	r.HandleFunc("/subscriptions/{sub_id}/deliveries", h.Deliveries).Methods("GET")
+	r.HandleFunc("/subscriptions/{sub_id}/dead-letters", h.DeadLetters).Methods("GET")
+	r.HandleFunc("/subscriptions/{sub_id}/deliveries/{delivery_id}/redeliver", h.Redeliver).Methods("POST")
+}
+
+func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
+	uid, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var req CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	sub, err := h.Svc.Create(uid, req)
+	if err != nil {
+		utils.JSONResponse(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusCreated, sub)
+}
+
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	uid, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Svc.List(uid)
+	if err != nil {
+		utils.JSONResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, list)
+}
+
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndSubscription(w, r)
+	if !ok {
+		return
+	}
+	sub, err := h.Svc.Get(uid, id)
+	writeJSON(w, sub, err)
+}
+
+func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndSubscription(w, r)
+	if !ok {
+		return
+	}
+	var req UpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid request payload"})
+		return
+	}
+	sub, err := h.Svc.Update(uid, id, req)
+	writeJSON(w, sub, err)
+}
+
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndSubscription(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Svc.Delete(uid, id); err != nil {
+		utils.JSONResponse(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// Deliveries serves the delivery log: ?limit=&before=<delivery id>.
+func (h *Handler) Deliveries(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndSubscription(w, r)
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	list, err := h.Svc.Deliveries(uid, id, limit, r.URL.Query().Get("before"))
+	writeJSON(w, list, err)
+}
+
+func (h *Handler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndSubscription(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.Svc.DeadLetters(uid, id)
+	writeJSON(w, list, err)
+}
+
+func (h *Handler) Redeliver(w http.ResponseWriter, r *http.Request) {
+	uid, id, ok := userAndSubscription(w, r)
+	if !ok {
+		return
+	}
+	deliveryID, err := gocql.ParseUUID(mux.Vars(r)["delivery_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid delivery id"})
+		return
+	}
+	d, err := h.Svc.Redeliver(uid, id, deliveryID)
+	writeJSON(w, d, err)
+}
+
+func writeJSON(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		utils.JSONResponse(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	utils.JSONResponse(w, http.StatusOK, v)
+}
+
+func errorStatus(err error) int {
+	switch {
+	case strings.HasSuffix(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "forbidden"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "already pending"):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func userID(w http.ResponseWriter, r *http.Request) (gocql.UUID, bool) {
+	uid, err := gocql.ParseUUID(auth.GetUserID(r))
+	if err != nil {
+		utils.JSONResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return gocql.UUID{}, false
+	}
+	return uid, true
+}
+
+func userAndSubscription(w http.ResponseWriter, r *http.Request) (gocql.UUID, gocql.UUID, bool) {
+	uid, ok := userID(w, r)
+	if !ok {
+		return uid, gocql.UUID{}, false
+	}
+	id, err := gocql.ParseUUID(mux.Vars(r)["sub_id"])
+	if err != nil {
+		utils.JSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid subscription id"})
+		return uid, gocql.UUID{}, false
+	}
+	return uid, id, true
+}
@@ -0,0 +1,87 @@
+package subscription
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Events that can be subscribed to. They are the hub event types.
+const (
+	EventMessageCreated = "message.created"
+	EventMessageUpdated = "message.updated"
+	EventMessageDeleted = "message.deleted"
+	EventMemberJoined   = "member.joined"
+	EventReactionAdded  = "reaction.added"
+)
+
+var knownEvents = map[string]bool{
+	EventMessageCreated: true,
+	EventMessageUpdated: true,
+	EventMessageDeleted: true,
+	EventMemberJoined:   true,
+	EventReactionAdded:  true,
+}
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Subscription sends the chosen events from the chosen rooms to URL. Secret
+// signs every delivery and is only returned when the subscription is created.
+type Subscription struct {
+	ID          gocql.UUID   `json:"id"`
+	OwnerID     gocql.UUID   `json:"ownerId"`
+	URL         string       `json:"url"`
+	Secret      string       `json:"secret,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Events      []string     `json:"events"`
+	RoomIDs     []gocql.UUID `json:"roomIds"`
+	Active      bool         `json:"active"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	UpdatedAt   time.Time    `json:"updatedAt"`
+}
+
+// Delivery is one event sent (or still to be sent) to a subscription.
+type Delivery struct {
+	ID            gocql.UUID      `json:"id"`
+	SubID         gocql.UUID      `json:"subscriptionId"`
+	EventType     string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	ResponseCode  int             `json:"responseCode,omitempty"`
+	LastError     string          `json:"lastError,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt,omitempty"`
+	DeliveredAt   *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+// DeadLetter is a delivery that used up its retries.
+type DeadLetter struct {
+	DeliveryID gocql.UUID `json:"deliveryId"`
+	SubID      gocql.UUID `json:"subscriptionId"`
+	EventType  string     `json:"event"`
+	LastError  string     `json:"lastError,omitempty"`
+	FailedAt   time.Time  `json:"failedAt"`
+}
+
+// CreateRequest subscribes URL to events in rooms (ids or slugs).
+type CreateRequest struct {
+	URL         string   `json:"url"`
+	Description string   `json:"description,omitempty"`
+	Events      []string `json:"events"`
+	Rooms       []string `json:"rooms"`
+}
+
+// UpdateRequest changes the fields that are set.
+type UpdateRequest struct {
+	URL         *string   `json:"url,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Events      *[]string `json:"events,omitempty"`
+	Rooms       *[]string `json:"rooms,omitempty"`
+	Active      *bool     `json:"active,omitempty"`
+}
@@ -0,0 +1,227 @@
+package subscription
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+type Repository struct {
+	Session *gocql.Session
+}
+
+func NewRepository(sess *gocql.Session) *Repository {
+	return &Repository{Session: sess}
+}
+
+type outboxEntry struct {
+	DueAt      time.Time
+	DeliveryID gocql.UUID
+	SubID      gocql.UUID
+}
+
+func dueHour(t time.Time) int64 { return t.Unix() / 3600 }
+
+const subColumns = `sub_id, owner_id, url, secret, description, events, room_ids, active, created_at, updated_at`
+
+func subDest(s *Subscription) []interface{} {
+	return []interface{}{&s.ID, &s.OwnerID, &s.URL, &s.Secret, &s.Description,
+		&s.Events, &s.RoomIDs, &s.Active, &s.CreatedAt, &s.UpdatedAt}
+}
+
+// Save writes sub and points its rooms at it; prevRooms are unlinked first.
+func (r *Repository) Save(sub *Subscription, prevRooms []gocql.UUID) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO event_subscriptions (`+subColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sub.ID, sub.OwnerID, sub.URL, sub.Secret, sub.Description, sub.Events, sub.RoomIDs,
+		sub.Active, sub.CreatedAt, sub.UpdatedAt)
+	b.Query(`INSERT INTO event_subscriptions_by_owner (owner_id, sub_id) VALUES (?, ?)`, sub.OwnerID, sub.ID)
+	for _, id := range prevRooms {
+		b.Query(`DELETE FROM event_subscriptions_by_room WHERE room_id = ? AND sub_id = ?`, id, sub.ID)
+	}
+	for _, id := range sub.RoomIDs {
+		b.Query(`INSERT INTO event_subscriptions_by_room (room_id, sub_id) VALUES (?, ?)`, id, sub.ID)
+	}
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) Get(id gocql.UUID) (*Subscription, error) {
+	var sub Subscription
+	err := r.Session.Query(`SELECT `+subColumns+` FROM event_subscriptions WHERE sub_id = ?`, id).
+		Scan(subDest(&sub)...)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (r *Repository) Delete(sub *Subscription) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`DELETE FROM event_subscriptions WHERE sub_id = ?`, sub.ID)
+	b.Query(`DELETE FROM event_subscriptions_by_owner WHERE owner_id = ? AND sub_id = ?`, sub.OwnerID, sub.ID)
+	for _, id := range sub.RoomIDs {
+		b.Query(`DELETE FROM event_subscriptions_by_room WHERE room_id = ? AND sub_id = ?`, id, sub.ID)
+	}
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) ListByOwner(ownerID gocql.UUID) ([]Subscription, error) {
+	return r.listVia(`SELECT sub_id FROM event_subscriptions_by_owner WHERE owner_id = ?`, ownerID)
+}
+
+func (r *Repository) ListByRoom(roomID gocql.UUID) ([]Subscription, error) {
+	return r.listVia(`SELECT sub_id FROM event_subscriptions_by_room WHERE room_id = ?`, roomID)
+}
+
+// listVia loads the subscriptions whose ids the index query returns.
+func (r *Repository) listVia(q string, key gocql.UUID) ([]Subscription, error) {
+	iter := r.Session.Query(q, key).Iter()
+	var ids []gocql.UUID
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	var out []Subscription
+	for _, id := range ids {
+		sub, err := r.Get(id)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *sub)
+	}
+	return out, nil
+}
+
+const deliveryColumns = `sub_id, delivery_id, event_type, payload, status, attempts, response_code,
+                         last_error, created_at, next_attempt_at, delivered_at`
+
+func deliveryDest(d *Delivery, payload *string) []interface{} {
+	return []interface{}{&d.SubID, &d.ID, &d.EventType, payload, &d.Status, &d.Attempts, &d.ResponseCode,
+		&d.LastError, &d.CreatedAt, &d.NextAttemptAt, &d.DeliveredAt}
+}
+
+// Enqueue stores a pending delivery together with its outbox entry.
+func (r *Repository) Enqueue(d *Delivery) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`INSERT INTO event_deliveries (`+deliveryColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.SubID, d.ID, d.EventType, string(d.Payload), d.Status, d.Attempts, d.ResponseCode,
+		d.LastError, d.CreatedAt, d.NextAttemptAt, d.DeliveredAt)
+	b.Query(`INSERT INTO event_outbox (due_hour, due_at, delivery_id, sub_id) VALUES (?, ?, ?, ?)`,
+		dueHour(*d.NextAttemptAt), *d.NextAttemptAt, d.ID, d.SubID)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) GetDelivery(subID, id gocql.UUID) (*Delivery, error) {
+	var d Delivery
+	var payload string
+	err := r.Session.Query(`SELECT `+deliveryColumns+` FROM event_deliveries WHERE sub_id = ? AND delivery_id = ?`,
+		subID, id).Scan(deliveryDest(&d, &payload)...)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	return &d, nil
+}
+
+// ListDeliveries returns a page of the delivery log, newest first, starting
+// below the before cursor when it is set.
+func (r *Repository) ListDeliveries(subID gocql.UUID, limit int, before *gocql.UUID) ([]Delivery, error) {
+	q := r.Session.Query(`SELECT `+deliveryColumns+` FROM event_deliveries WHERE sub_id = ? LIMIT ?`, subID, limit)
+	if before != nil {
+		q = r.Session.Query(`SELECT `+deliveryColumns+` FROM event_deliveries WHERE sub_id = ? AND delivery_id < ? LIMIT ?`,
+			subID, *before, limit)
+	}
+	iter := q.Iter()
+	var out []Delivery
+	var d Delivery
+	var payload string
+	for iter.Scan(deliveryDest(&d, &payload)...) {
+		d.Payload = json.RawMessage(payload)
+		out = append(out, d)
+		d = Delivery{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SaveAttempt records an attempt on d and moves its outbox entry from
+// prevDue: to d.NextAttemptAt while pending, into the dead letters when dead.
+func (r *Repository) SaveAttempt(d *Delivery, prevDue time.Time) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`UPDATE event_deliveries SET status = ?, attempts = ?, response_code = ?, last_error = ?,
+	         next_attempt_at = ?, delivered_at = ? WHERE sub_id = ? AND delivery_id = ?`,
+		d.Status, d.Attempts, d.ResponseCode, d.LastError, d.NextAttemptAt, d.DeliveredAt, d.SubID, d.ID)
+	b.Query(`DELETE FROM event_outbox WHERE due_hour = ? AND due_at = ? AND delivery_id = ?`,
+		dueHour(prevDue), prevDue, d.ID)
+	switch d.Status {
+	case StatusPending:
+		b.Query(`INSERT INTO event_outbox (due_hour, due_at, delivery_id, sub_id) VALUES (?, ?, ?, ?)`,
+			dueHour(*d.NextAttemptAt), *d.NextAttemptAt, d.ID, d.SubID)
+	case StatusDead:
+		b.Query(`INSERT INTO event_dead_letters (sub_id, delivery_id, event_type, last_error, failed_at)
+		         VALUES (?, ?, ?, ?, ?)`,
+			d.SubID, d.ID, d.EventType, d.LastError, time.Now().UTC())
+	}
+	return r.Session.ExecuteBatch(b)
+}
+
+// Requeue makes a delivery pending again, due now, and drops its dead letter.
+func (r *Repository) Requeue(d *Delivery) error {
+	b := r.Session.NewBatch(gocql.LoggedBatch)
+	b.Query(`UPDATE event_deliveries SET status = ?, attempts = ?, next_attempt_at = ?
+	         WHERE sub_id = ? AND delivery_id = ?`,
+		d.Status, d.Attempts, d.NextAttemptAt, d.SubID, d.ID)
+	b.Query(`INSERT INTO event_outbox (due_hour, due_at, delivery_id, sub_id) VALUES (?, ?, ?, ?)`,
+		dueHour(*d.NextAttemptAt), *d.NextAttemptAt, d.ID, d.SubID)
+	b.Query(`DELETE FROM event_dead_letters WHERE sub_id = ? AND delivery_id = ?`, d.SubID, d.ID)
+	return r.Session.ExecuteBatch(b)
+}
+
+func (r *Repository) ListDeadLetters(subID gocql.UUID, limit int) ([]DeadLetter, error) {
+	iter := r.Session.Query(
+		`SELECT sub_id, delivery_id, event_type, last_error, failed_at FROM event_dead_letters WHERE sub_id = ? LIMIT ?`,
+		subID, limit,
+	).Iter()
+	var out []DeadLetter
+	var dl DeadLetter
+	for iter.Scan(&dl.SubID, &dl.DeliveryID, &dl.EventType, &dl.LastError, &dl.FailedAt) {
+		out = append(out, dl)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Due returns the outbox entries of one hour that are due by now.
+func (r *Repository) Due(hour int64, now time.Time) ([]outboxEntry, error) {
+	iter := r.Session.Query(
+		`SELECT due_at, delivery_id, sub_id FROM event_outbox WHERE due_hour = ? AND due_at <= ?`,
+		hour, now,
+	).Iter()
+	var out []outboxEntry
+	var e outboxEntry
+	for iter.Scan(&e.DueAt, &e.DeliveryID, &e.SubID) {
+		out = append(out, e)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Repository) deleteDue(e outboxEntry) error {
+	return r.Session.Query(
+		`DELETE FROM event_outbox WHERE due_hour = ? AND due_at = ? AND delivery_id = ?`,
+		dueHour(e.DueAt), e.DueAt, e.DeliveryID,
+	).Exec()
+}
@@ -0,0 +1,597 @@
+// Package subscription sends chat events to external HTTP endpoints.
+//
+// Every event the chat service publishes is offered to Enqueue, which writes
+// a delivery for each matching subscription into a durable outbox. The
+// leader-only worker drains the outbox, signing each request, retrying with
+// exponential backoff and moving deliveries that keep failing to a dead-letter
+// list. Deliveries are at-least-once; receivers should dedupe on
+// X-Gochat-Delivery.
+package subscription
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gochat/internal/chat"
+	"gochat/internal/utils"
+	"gochat/internal/ws"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	maxPerOwner    = 25
+	maxRooms       = 50
+	maxDescription = 200
+
+	tick         = 2 * time.Second
+	lookback     = 7 * 24 // hours scanned when a process becomes leader
+	workers      = 8      // concurrent deliveries per tick
+	timeout      = 10 * time.Second
+	maxAttempts  = 8
+	firstBackoff = 30 * time.Second
+	maxBackoff   = time.Hour
+
+	// Subscriptions are cached per room so publishing an event does not
+	// read Scylla; changes on other replicas show up within cacheTTL.
+	cacheTTL = 30 * time.Second
+)
+
+var ErrNotFound = errors.New("subscription not found")
+
+type Service struct {
+	Repo *Repository
+	Chat *chat.Service
+	// Client only reaches public addresses; see utils.OutboundClient.
+	Client *http.Client
+
+	mu     sync.Mutex
+	byRoom map[gocql.UUID]cachedSubs
+}
+
+type cachedSubs struct {
+	subs []Subscription
+	at   time.Time
+}
+
+func NewService(repo *Repository, chatSvc *chat.Service) *Service {
+	return &Service{
+		Repo:   repo,
+		Chat:   chatSvc,
+		Client: utils.OutboundClient(timeout),
+		byRoom: map[gocql.UUID]cachedSubs{},
+	}
+}
+
+func (s *Service) Create(ownerID gocql.UUID, req CreateRequest) (*Subscription, error) {
+	existing, err := s.Repo.ListByOwner(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxPerOwner {
+		return nil, fmt.Errorf("at most %d subscriptions", maxPerOwner)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	sub := &Subscription{
+		ID:        gocql.TimeUUID(),
+		OwnerID:   ownerID,
+		Secret:    hex.EncodeToString(buf),
+		Active:    true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.apply(sub, UpdateRequest{URL: &req.URL, Description: &req.Description, Events: &req.Events, Rooms: &req.Rooms}); err != nil {
+		return nil, err
+	}
+	if err := s.Repo.Save(sub, nil); err != nil {
+		return nil, err
+	}
+	s.invalidate(sub.RoomIDs...)
+	return sub, nil
+}
+
+// apply validates and copies the set fields of req onto sub. Every room
+// must be one the owner administers.
+func (s *Service) apply(sub *Subscription, req UpdateRequest) error {
+	if req.URL != nil {
+		u := strings.TrimSpace(*req.URL)
+		if err := utils.ValidateOutboundURL(u); err != nil {
+			return errors.New("invalid url: " + err.Error())
+		}
+		sub.URL = u
+	}
+	if req.Description != nil {
+		d := strings.TrimSpace(*req.Description)
+		if len(d) > maxDescription {
+			return errors.New("description too long")
+		}
+		sub.Description = d
+	}
+	if req.Events != nil {
+		seen := map[string]bool{}
+		var events []string
+		for _, e := range *req.Events {
+			if !knownEvents[e] {
+				return fmt.Errorf("unknown event %q", e)
+			}
+			if !seen[e] {
+				seen[e] = true
+				events = append(events, e)
+			}
+		}
+		if len(events) == 0 {
+			return errors.New("events are required")
+		}
+		sub.Events = events
+	}
+	if req.Rooms != nil {
+		if len(*req.Rooms) == 0 || len(*req.Rooms) > maxRooms {
+			return fmt.Errorf("a subscription needs 1 to %d rooms", maxRooms)
+		}
+		seen := map[gocql.UUID]bool{}
+		var rooms []gocql.UUID
+		for _, ref := range *req.Rooms {
+			id, err := s.Chat.ResolveRoom(ref)
+			if err != nil {
+				return errors.New("room not found")
+			}
+			if err := s.Chat.EnsureRoomAdmin(id, sub.OwnerID); err != nil {
+				return err
+			}
+			if !seen[id] {
+				seen[id] = true
+				rooms = append(rooms, id)
+			}
+		}
+		sub.RoomIDs = rooms
+	}
+	if req.Active != nil {
+		sub.Active = *req.Active
+	}
+	return nil
+}
+
+// load returns the caller's subscription, secret included.
+func (s *Service) load(ownerID, id gocql.UUID) (*Subscription, error) {
+	sub, err := s.Repo.Get(id)
+	if err == gocql.ErrNotFound || (err == nil && sub.OwnerID != ownerID) {
+		return nil, ErrNotFound
+	}
+	return sub, err
+}
+
+func (s *Service) Get(ownerID, id gocql.UUID) (*Subscription, error) {
+	sub, err := s.load(ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+func (s *Service) List(ownerID gocql.UUID) ([]Subscription, error) {
+	subs, err := s.Repo.ListByOwner(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Subscription, len(subs))
+	for i, sub := range subs {
+		sub.Secret = ""
+		out[i] = sub
+	}
+	return out, nil
+}
+
+func (s *Service) Update(ownerID, id gocql.UUID, req UpdateRequest) (*Subscription, error) {
+	sub, err := s.load(ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	prevRooms := sub.RoomIDs
+	if err := s.apply(sub, req); err != nil {
+		return nil, err
+	}
+	sub.UpdatedAt = time.Now().UTC()
+	if err := s.Repo.Save(sub, prevRooms); err != nil {
+		return nil, err
+	}
+	s.invalidate(append(prevRooms, sub.RoomIDs...)...)
+	sub.Secret = ""
+	return sub, nil
+}
+
+// Delete removes the subscription. Queued deliveries are dropped by the
+// worker when it finds the subscription gone.
+func (s *Service) Delete(ownerID, id gocql.UUID) error {
+	sub, err := s.load(ownerID, id)
+	if err != nil {
+		return err
+	}
+	if err := s.Repo.Delete(sub); err != nil {
+		return err
+	}
+	s.invalidate(sub.RoomIDs...)
+	return nil
+}
+
+func (s *Service) Deliveries(ownerID, id gocql.UUID, limit int, before string) ([]Delivery, error) {
+	if _, err := s.Get(ownerID, id); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	var cursor *gocql.UUID
+	if before != "" {
+		c, err := gocql.ParseUUID(before)
+		if err != nil {
+			return nil, errors.New("invalid before cursor")
+		}
+		cursor = &c
+	}
+	list, err := s.Repo.ListDeliveries(id, limit, cursor)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []Delivery{}
+	}
+	return list, nil
+}
+
+func (s *Service) DeadLetters(ownerID, id gocql.UUID) ([]DeadLetter, error) {
+	if _, err := s.Get(ownerID, id); err != nil {
+		return nil, err
+	}
+	list, err := s.Repo.ListDeadLetters(id, 100)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []DeadLetter{}
+	}
+	return list, nil
+}
+
+// Redeliver queues a delivery again with a fresh set of attempts.
+func (s *Service) Redeliver(ownerID, id, deliveryID gocql.UUID) (*Delivery, error) {
+	if _, err := s.Get(ownerID, id); err != nil {
+		return nil, err
+	}
+	d, err := s.Repo.GetDelivery(id, deliveryID)
+	if err == gocql.ErrNotFound {
+		return nil, errors.New("delivery not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.Status == StatusPending {
+		return nil, errors.New("delivery is already pending")
+	}
+	now := time.Now().UTC()
+	d.Status, d.Attempts, d.NextAttemptAt = StatusPending, 0, &now
+	if err := s.Repo.Requeue(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *Service) invalidate(roomIDs ...gocql.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range roomIDs {
+		delete(s.byRoom, id)
+	}
+}
+
+func (s *Service) roomSubs(roomID gocql.UUID) ([]Subscription, error) {
+	s.mu.Lock()
+	c, ok := s.byRoom[roomID]
+	s.mu.Unlock()
+	if ok && time.Since(c.at) < cacheTTL {
+		return c.subs, nil
+	}
+	subs, err := s.Repo.ListByRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.byRoom[roomID] = cachedSubs{subs: subs, at: time.Now()}
+	s.mu.Unlock()
+	return subs, nil
+}
+
+// Enqueue queues ev for every active subscription to its type in its room
+// whose owner still administers the room. It is the chat service's OnEvent
+// hook.
+func (s *Service) Enqueue(ev ws.Event) {
+	if !knownEvents[ev.Type] || ev.Payload["replayed"] == true {
+		return
+	}
+	roomRef, _ := ev.Payload["roomId"].(string)
+	roomID, err := gocql.ParseUUID(roomRef)
+	if err != nil {
+		return
+	}
+	subs, err := s.roomSubs(roomID)
+	if err != nil {
+		log.Printf("subscriptions: room %s: %v", roomID, err)
+		return
+	}
+	for _, sub := range subs {
+		if !sub.Active || !contains(sub.Events, ev.Type) {
+			continue
+		}
+		allowed, err := s.ownerAdmin(&sub, roomID)
+		if err != nil {
+			log.Printf("subscriptions: check owner of %s: %v", sub.ID, err)
+			continue
+		}
+		if !allowed {
+			s.dropRoom(sub.ID, roomID)
+			continue
+		}
+		id := gocql.TimeUUID()
+		now := id.Time().UTC()
+		body, err := json.Marshal(map[string]any{
+			"id":        id.String(),
+			"type":      ev.Type,
+			"createdAt": now.Format(time.RFC3339Nano),
+			"data":      ev.Payload,
+		})
+		if err != nil {
+			log.Printf("subscriptions: encode %s: %v", ev.Type, err)
+			return
+		}
+		d := &Delivery{
+			ID:            id,
+			SubID:         sub.ID,
+			EventType:     ev.Type,
+			Payload:       body,
+			Status:        StatusPending,
+			CreatedAt:     now,
+			NextAttemptAt: &now,
+		}
+		if err := s.Repo.Enqueue(d); err != nil {
+			log.Printf("subscriptions: enqueue for %s: %v", sub.ID, err)
+		}
+	}
+}
+
+func contains(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// RunWorker drains the outbox until ctx is done, doing work only while
+// isLeader reports true.
+func (s *Service) RunWorker(ctx context.Context, isLeader func() bool) {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	var from int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !isLeader() {
+			from = 0
+			continue
+		}
+		now := time.Now().UTC()
+		if from == 0 {
+			from = dueHour(now) - lookback
+		}
+		if s.sendDue(ctx, from, now) {
+			from = dueHour(now) - 1
+		}
+	}
+}
+
+func (s *Service) sendDue(ctx context.Context, from int64, now time.Time) bool {
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for h := from; h <= dueHour(now); h++ {
+		entries, err := s.Repo.Due(h, now)
+		if err != nil {
+			log.Printf("subscriptions: hour %d: %v", h, err)
+			return false
+		}
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return false
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(e outboxEntry) {
+				defer func() { <-sem; wg.Done() }()
+				s.send(ctx, e)
+			}(e)
+		}
+	}
+	return true
+}
+
+func (s *Service) send(ctx context.Context, e outboxEntry) {
+	d, err := s.Repo.GetDelivery(e.SubID, e.DeliveryID)
+	if err == gocql.ErrNotFound {
+		_ = s.Repo.deleteDue(e)
+		return
+	}
+	if err != nil {
+		log.Printf("subscriptions: load delivery %s: %v", e.DeliveryID, err)
+		return
+	}
+	// Redelivered or finished since this entry was queued.
+	if d.Status != StatusPending || d.NextAttemptAt == nil || !d.NextAttemptAt.Equal(e.DueAt) {
+		_ = s.Repo.deleteDue(e)
+		return
+	}
+	sub, err := s.Repo.Get(e.SubID)
+	if err == gocql.ErrNotFound {
+		_ = s.Repo.deleteDue(e)
+		return
+	}
+	if err != nil {
+		log.Printf("subscriptions: load %s: %v", e.SubID, err)
+		return
+	}
+	// The owner may have lost the room since the event was queued.
+	if roomID, ok := deliveryRoom(d); ok {
+		allowed, err := s.ownerAdmin(sub, roomID)
+		if err != nil {
+			log.Printf("subscriptions: check owner of %s: %v", sub.ID, err)
+			return
+		}
+		if !allowed {
+			s.dropRoom(sub.ID, roomID)
+			d.Status, d.LastError, d.NextAttemptAt = StatusDead, "owner is no longer a room admin", nil
+			if err := s.Repo.SaveAttempt(d, e.DueAt); err != nil {
+				log.Printf("subscriptions: save delivery %s: %v", d.ID, err)
+			}
+			return
+		}
+	}
+
+	code, err := s.post(ctx, sub, d)
+	now := time.Now().UTC()
+	d.Attempts++
+	d.ResponseCode = code
+	switch {
+	case err == nil:
+		d.Status, d.LastError, d.NextAttemptAt, d.DeliveredAt = StatusDelivered, "", nil, &now
+	case d.Attempts >= maxAttempts:
+		d.Status, d.LastError, d.NextAttemptAt = StatusDead, err.Error(), nil
+	default:
+		next := now.Add(backoff(d.Attempts))
+		d.LastError, d.NextAttemptAt = err.Error(), &next
+	}
+	if err := s.Repo.SaveAttempt(d, e.DueAt); err != nil {
+		log.Printf("subscriptions: save delivery %s: %v", d.ID, err)
+	}
+}
+
+// ownerAdmin reports whether sub's owner still administers roomID. An
+// error means it could not be checked.
+func (s *Service) ownerAdmin(sub *Subscription, roomID gocql.UUID) (bool, error) {
+	err := s.Chat.EnsureRoomAdmin(roomID, sub.OwnerID)
+	switch {
+	case err == nil:
+		return true, nil
+	case err == gocql.ErrNotFound || strings.HasPrefix(err.Error(), "forbidden"):
+		return false, nil
+	}
+	return false, err
+}
+
+// dropRoom removes roomID from the subscription after its owner lost admin
+// rights there, deactivating it when that was its last room.
+func (s *Service) dropRoom(subID, roomID gocql.UUID) {
+	sub, err := s.Repo.Get(subID)
+	if err != nil {
+		if err != gocql.ErrNotFound {
+			log.Printf("subscriptions: load %s: %v", subID, err)
+		}
+		return
+	}
+	prevRooms := sub.RoomIDs
+	var rooms []gocql.UUID
+	for _, id := range prevRooms {
+		if id != roomID {
+			rooms = append(rooms, id)
+		}
+	}
+	if len(rooms) == len(prevRooms) {
+		return
+	}
+	sub.RoomIDs = rooms
+	if len(rooms) == 0 {
+		sub.Active = false
+	}
+	sub.UpdatedAt = time.Now().UTC()
+	if err := s.Repo.Save(sub, prevRooms); err != nil {
+		log.Printf("subscriptions: drop room %s from %s: %v", roomID, sub.ID, err)
+		return
+	}
+	s.invalidate(roomID)
+	log.Printf("⚠️ subscriptions: owner %s of %s no longer administers room %s; room dropped", sub.OwnerID, sub.ID, roomID)
+}
+
+// deliveryRoom is the room of the event d carries.
+func deliveryRoom(d *Delivery) (gocql.UUID, bool) {
+	var body struct {
+		Data struct {
+			RoomID string `json:"roomId"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(d.Payload, &body); err != nil {
+		return gocql.UUID{}, false
+	}
+	id, err := gocql.ParseUUID(body.Data.RoomID)
+	return id, err == nil
+}
+
+// backoff is the wait after the given number of failed attempts:
+// 30s, 1m, 2m, ... capped at an hour.
+func backoff(attempts int) time.Duration {
+	d := firstBackoff << (attempts - 1)
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+// post sends one delivery, signed like slash command callbacks: HMAC-SHA256
+// with the subscription secret over "timestamp.body".
+func (s *Service) post(ctx context.Context, sub *Subscription, d *Delivery) (int, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(sub.Secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(d.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gochat-Event", d.EventType)
+	req.Header.Set("X-Gochat-Delivery", d.ID.String())
+	req.Header.Set("X-Gochat-Timestamp", ts)
+	req.Header.Set("X-Gochat-Signature", "v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode/100 != 2 {
+		return res.StatusCode, fmt.Errorf("endpoint returned %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
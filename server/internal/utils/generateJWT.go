@@ -7,27 +7,29 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var JwtKey = []byte("SECRET_KEY")
-
-func GenerateJWT(userID string, expiry time.Duration) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(expiry).Unix(),
-		"iat":     time.Now().Unix(),
+// GenerateJWT issues an access token for userID carrying the extra claims,
+// such as sid, the session the token dies with.
+func GenerateJWT(userID string, expiry time.Duration, extra jwt.MapClaims) (string, error) {
+	if Keys == nil {
+		return "", errors.New("jwt keys not loaded")
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(JwtKey)
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	claims["user_id"] = userID
+	claims["exp"] = now.Add(expiry).Unix()
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	return Keys.sign(claims)
 }
 
 func ValidateJWT(tokenStr string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-
-		if t.Method != jwt.SigningMethodHS256 {
-			return nil, errors.New("unexpected signing method")
-		}
-		return JwtKey, nil
-	})
+	if Keys == nil {
+		return nil, errors.New("jwt keys not loaded")
+	}
+	token, err := jwt.Parse(tokenStr, Keys.keyFunc, Keys.parserOptions()...)
 	if err != nil {
 		return nil, err
 	}
@@ -2,7 +2,11 @@ package utils
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 )
 
 func WriteJSON(w http.ResponseWriter, status int, v any) {
@@ -10,3 +14,31 @@ func WriteJSON(w http.ResponseWriter, status int, v any) {
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(v)
 }
+
+// ClientIP is the address a request came from. With TRUSTED_PROXIES=n, the
+// number of proxies in front of the server, it is the address the outermost
+// of them saw: the nth hop from the right of X-Forwarded-For followed by the
+// peer. Entries further left are whatever the client sent and are ignored.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	trusted, _ := strconv.Atoi(os.Getenv("TRUSTED_PROXIES"))
+	if trusted <= 0 {
+		return host
+	}
+	var hops []string
+	for _, fwd := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(fwd, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	hops = append(hops, host)
+	if trusted >= len(hops) {
+		return hops[0] // reached without passing every proxy
+	}
+	return hops[len(hops)-1-trusted]
+}
@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing keys are configured with:
+//
+//	JWT_KEYS_DIR    directory of keys named <kid>.pem (RSA or Ed25519, private
+//	                or public) or <kid>.key (an HS256 secret)
+//	JWT_SECRET      an HS256 secret, used with kid JWT_SECRET_KID ("hs256")
+//	JWT_ACTIVE_KID  the key new tokens are signed with; optional when only
+//	                one key can sign
+//	JWT_ISSUER      iss claim issued and required (default "gochat")
+//	JWT_AUDIENCE    aud claim issued and required (default "gochat")
+//
+// Every loaded key verifies, so a key can be rotated by adding the new one,
+// switching JWT_ACTIVE_KID, and removing the old one once its tokens expired.
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// SigningKey is one key of the set. Sign is nil for verify-only keys.
+type SigningKey struct {
+	ID     string
+	Alg    string
+	Sign   any
+	Verify any
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Alg)
+}
+
+type KeySet struct {
+	Active   *SigningKey
+	Keys     map[string]*SigningKey
+	Issuer   string
+	Audience string
+}
+
+// Keys is the key set GenerateJWT and ValidateJWT use. main loads it at
+// startup with LoadKeySet.
+var Keys *KeySet
+
+// LoadKeySet reads the key set from the environment. Without any key it
+// fails, except with ENV=dev where it makes a throwaway key.
+func LoadKeySet() (*KeySet, error) {
+	ks := &KeySet{
+		Keys:     map[string]*SigningKey{},
+		Issuer:   GetEnv("JWT_ISSUER", "gochat"),
+		Audience: GetEnv("JWT_AUDIENCE", "gochat"),
+	}
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		if err := ks.loadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if len(secret) < 32 {
+			return nil, errors.New("JWT_SECRET must be at least 32 bytes")
+		}
+		kid := GetEnv("JWT_SECRET_KID", "hs256")
+		ks.Keys[kid] = &SigningKey{ID: kid, Alg: AlgHS256, Sign: []byte(secret), Verify: []byte(secret)}
+	}
+	if len(ks.Keys) == 0 {
+		if os.Getenv("ENV") != "dev" {
+			return nil, errors.New("no JWT signing keys configured; set JWT_KEYS_DIR or JWT_SECRET")
+		}
+		k, err := ephemeralKey()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("⚠️  no JWT keys configured, signing with throwaway key %s; tokens die with this process", k.ID)
+		ks.Keys[k.ID] = k
+	}
+
+	if kid := os.Getenv("JWT_ACTIVE_KID"); kid != "" {
+		k, ok := ks.Keys[kid]
+		if !ok || k.Sign == nil {
+			return nil, fmt.Errorf("JWT_ACTIVE_KID %q is not a signing key", kid)
+		}
+		ks.Active = k
+		return ks, nil
+	}
+	for _, k := range ks.Keys {
+		if k.Sign == nil {
+			continue
+		}
+		if ks.Active != nil {
+			return nil, errors.New("several JWT signing keys loaded; set JWT_ACTIVE_KID")
+		}
+		ks.Active = k
+	}
+	if ks.Active == nil {
+		return nil, errors.New("no JWT key can sign; add a private key or secret")
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) loadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(e.Name())
+		kid := strings.TrimSuffix(e.Name(), ext)
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		var k *SigningKey
+		switch ext {
+		case ".pem":
+			k, err = parsePEMKey(kid, data)
+		case ".key":
+			secret := []byte(strings.TrimSpace(string(data)))
+			if len(secret) < 32 {
+				err = errors.New("HS256 secret must be at least 32 bytes")
+			}
+			k = &SigningKey{ID: kid, Alg: AlgHS256, Sign: secret, Verify: secret}
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("jwt key %s: %w", e.Name(), err)
+		}
+		ks.Keys[kid] = k
+	}
+	return nil
+}
+
+func parsePEMKey(kid string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{ID: kid, Alg: AlgRS256, Sign: priv, Verify: &priv.PublicKey}, nil
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch p := priv.(type) {
+		case *rsa.PrivateKey:
+			return &SigningKey{ID: kid, Alg: AlgRS256, Sign: p, Verify: &p.PublicKey}, nil
+		case ed25519.PrivateKey:
+			return &SigningKey{ID: kid, Alg: AlgEdDSA, Sign: p, Verify: p.Public()}, nil
+		}
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch p := pub.(type) {
+		case *rsa.PublicKey:
+			return &SigningKey{ID: kid, Alg: AlgRS256, Verify: p}, nil
+		case ed25519.PublicKey:
+			return &SigningKey{ID: kid, Alg: AlgEdDSA, Verify: p}, nil
+		}
+	}
+	return nil, errors.New("unsupported key type; use RSA or Ed25519")
+}
+
+func ephemeralKey() (*SigningKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: "dev-" + hex.EncodeToString(id), Alg: AlgEdDSA, Sign: priv, Verify: pub}, nil
+}
+
+// sign signs claims with the active key, stamping kid, iss and aud.
+func (ks *KeySet) sign(claims jwt.MapClaims) (string, error) {
+	claims["iss"] = ks.Issuer
+	claims["aud"] = ks.Audience
+	t := jwt.NewWithClaims(ks.Active.method(), claims)
+	t.Header["kid"] = ks.Active.ID
+	return t.SignedString(ks.Active.Sign)
+}
+
+// keyFunc picks the verification key named by the token's kid and insists
+// on that key's algorithm.
+func (ks *KeySet) keyFunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	k, ok := ks.Keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	if t.Method.Alg() != k.Alg {
+		return nil, errors.New("unexpected signing method")
+	}
+	return k.Verify, nil
+}
+
+func (ks *KeySet) parserOptions() []jwt.ParserOption {
+	return []jwt.ParserOption{
+		jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgEdDSA}),
+		jwt.WithIssuer(ks.Issuer),
+		jwt.WithAudience(ks.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+}
+
+// JWKS is the public half of the key set as a JSON Web Key Set. HS256
+// secrets are never published.
+func (ks *KeySet) JWKS() map[string]any {
+	kids := make([]string, 0, len(ks.Keys))
+	for kid := range ks.Keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	keys := []map[string]string{}
+	for _, kid := range kids {
+		k := ks.Keys[kid]
+		jwk := map[string]string{"kid": k.ID, "alg": k.Alg, "use": "sig"}
+		switch pub := k.Verify.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = b64(pub.N.Bytes())
+			jwk["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = b64(pub)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]any{"keys": keys}
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
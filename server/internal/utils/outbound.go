@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Requests to URLs users register (slash-command callbacks, event
+// subscriptions) go through OutboundClient. It refuses to connect to
+// loopback, private, link-local and other non-public addresses, checked on
+// the address actually dialled so a name that resolves, or later
+// re-resolves, to an internal host is caught. It does not follow redirects
+// and ignores proxy settings, either of which would route around the check.
+// With ENV=dev both http URLs and internal addresses are allowed, for
+// callbacks running on the developer's machine.
+
+var (
+	ErrOutboundURL     = errors.New("url must be https with a public host")
+	ErrOutboundAddress = errors.New("address is not public")
+)
+
+// Ranges net/netip has no predicate for.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 reaches IPv4 ranges too
+}
+
+func outboundDev() bool {
+	return os.Getenv("ENV") == "dev"
+}
+
+// PublicAddr reports whether addr is a public unicast address.
+func PublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateOutboundURL checks a URL a user registers for callbacks: https
+// with a host that is not a non-public address literal.
+func ValidateOutboundURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil {
+		return ErrOutboundURL
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && outboundDev():
+	default:
+		return ErrOutboundURL
+	}
+	if outboundDev() {
+		return nil
+	}
+	if u.Hostname() == "localhost" {
+		return ErrOutboundURL
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !PublicAddr(addr) {
+		return ErrOutboundURL
+	}
+	return nil
+}
+
+// dialControl refuses connections to non-public addresses.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	if outboundDev() {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil || !PublicAddr(ap.Addr()) {
+		return ErrOutboundAddress
+	}
+	return nil
+}
+
+// OutboundClient returns a client for requests to user-supplied URLs.
+func OutboundClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
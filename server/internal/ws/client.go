@@ -17,8 +17,16 @@ const (
 )
 
 type Client struct {
-	ID            string
-	UserID        string
+	ID     string
+	UserID string
+	// ReadOnly clients receive events but may not run commands such as
+	// message.send; set for API tokens without write access.
+	ReadOnly bool
+	// Scopes are the API token scopes the connection was opened with, nil
+	// for a user session.
+	Scopes []string
+	// SessionID is the login session the connection was opened with.
+	SessionID     string
 	conn          *websocket.Conn
 	send          chan []byte
 	subscriptions map[string]struct{}
@@ -73,7 +81,11 @@ func (c *Client) ReadPump() {
 			ev.From = c.UserID
 		}
 
-		c.hub.inbound <- ev
+		if fn, ok := c.hub.command(ev.Type); ok {
+			c.hub.runCommand(c, ev, fn)
+			continue
+		}
+		c.hub.inbound <- inboundEvent{client: c, ev: ev}
 	}
 }
 
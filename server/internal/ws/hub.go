@@ -3,26 +3,33 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"sync"
 	"time"
 
-	"github.com/gocql/gocql"
+	"github.com/gorilla/websocket"
 )
 
-type PersistMessageFunc func(
-	roomID, userID gocql.UUID,
-	text string,
-	createdAt time.Time,
-	parentID *gocql.UUID,
-) (gocql.UUID, error)
+// CommandFunc handles an event a client sent, such as message.send. A
+// returned error is reported back to that client as an "error" event.
+// Commands run on the sending client's read goroutine, never on the hub
+// loop, so a slow one only holds up that connection.
+type CommandFunc func(ctx context.Context, c *Client, ev Event) error
 
-type UserLookupFunc func(ctx context.Context, userID gocql.UUID) (username string, err error)
+// emitTimeout bounds how long EmitSystem and SendToUser wait for room in
+// the hub's queue before giving up on an event.
+const emitTimeout = 2 * time.Second
+
+type inboundEvent struct {
+	client *Client
+	ev     Event
+}
 
 type Hub struct {
 	register   chan *Client
 	unregister chan *Client
-	inbound    chan Event
+	inbound    chan inboundEvent
 	system     chan Event
 
 	clients     map[*Client]struct{}
@@ -34,31 +41,38 @@ type Hub struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	CanJoin      func(roomID string, userID string) bool
+	// ResolveRoom maps a room reference (UUID or slug) to the room UUID string
+	// used as the channel id. References are used as-is when nil.
+	ResolveRoom func(ref string) (string, bool)
 
-	persistMessage PersistMessageFunc
-	userLookup     UserLookupFunc
-	Presence       interface {
+	commands map[string]CommandFunc
+	Presence interface {
 		Touch(ctx context.Context, roomID, userID string) error
 	}
 }
 
-func NewHub(persist PersistMessageFunc, lookup UserLookupFunc) *Hub {
+func NewHub() *Hub {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Hub{
-		register:       make(chan *Client),
-		unregister:     make(chan *Client),
-		inbound:        make(chan Event, 1024),
-		system:         make(chan Event, 256),
-		clients:        make(map[*Client]struct{}),
-		userConns:      make(map[string]map[*Client]struct{}),
-		channelSubs:    make(map[string]map[*Client]struct{}),
-		ctx:            ctx,
-		cancel:         cancel,
-		persistMessage: persist,
-		userLookup:     lookup,
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		inbound:     make(chan inboundEvent, 1024),
+		system:      make(chan Event, 256),
+		clients:     make(map[*Client]struct{}),
+		userConns:   make(map[string]map[*Client]struct{}),
+		channelSubs: make(map[string]map[*Client]struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+		commands:    make(map[string]CommandFunc),
 	}
 }
 
+// HandleCommand registers fn for client events of type typ. It must be called
+// before Run.
+func (h *Hub) HandleCommand(typ string, fn CommandFunc) {
+	h.commands[typ] = fn
+}
+
 func (h *Hub) RegisterClient(c *Client)   { h.register <- c }
 func (h *Hub) UnregisterClient(c *Client) { h.unregister <- c }
 
@@ -100,8 +114,8 @@ func (h *Hub) Run() {
 		case c := <-h.unregister:
 			h.removeClient(c)
 
-		case ev := <-h.inbound:
-			h.routeEvent(ev)
+		case in := <-h.inbound:
+			h.dispatch(in)
 
 		case ev := <-h.system:
 			h.routeEvent(ev)
@@ -173,6 +187,45 @@ func getString(m map[string]any, key string) (string, bool) {
 	return "", false
 }
 
+// dispatch routes a client event that is not a command.
+func (h *Hub) dispatch(in inboundEvent) {
+	h.routeEvent(in.ev)
+}
+
+// command returns the registered command for events of type typ.
+func (h *Hub) command(typ string) (CommandFunc, bool) {
+	fn, ok := h.commands[typ]
+	return fn, ok
+}
+
+// runCommand runs fn for a client event and reports a failure back to the
+// client. It is called from the client's read goroutine.
+func (h *Hub) runCommand(c *Client, ev Event, fn CommandFunc) {
+	if c.ReadOnly {
+		fn = func(context.Context, *Client, Event) error { return errors.New("forbidden: read-only token") }
+	}
+	if err := fn(h.ctx, c, ev); err != nil {
+		log.Printf("%s error for %s: %v", ev.Type, c.UserID, err)
+		payload := map[string]any{
+			"reason":  "command_failed",
+			"command": ev.Type,
+			"message": err.Error(),
+		}
+		if tempID, ok := getString(ev.Payload, "tempId"); ok {
+			payload["tempId"] = tempID
+		}
+		h.SafeSend(c, NewServerEvent("error", "server", c.UserID, payload))
+		return
+	}
+	if h.Presence != nil {
+		if roomID, ok := getString(ev.Payload, "roomId"); ok {
+			if id, ok := h.resolveRoom(roomID); ok {
+				_ = h.Presence.Touch(h.ctx, id, c.UserID)
+			}
+		}
+	}
+}
+
 func (h *Hub) routeEvent(ev Event) {
 
 	if ev.ServerTs == 0 {
@@ -218,6 +271,9 @@ func (h *Hub) routeEvent(ev Event) {
 		return
 
 	case "channel.subscribe":
+		if ref, ok := h.resolveRoom(ev.To); ok {
+			ev.To = ref
+		}
 		h.mu.RLock()
 		var cli *Client
 		if set, ok := h.userConns[ev.From]; ok {
@@ -255,6 +311,9 @@ func (h *Hub) routeEvent(ev Event) {
 		return
 
 	case "channel.unsubscribe":
+		if ref, ok := h.resolveRoom(ev.To); ok {
+			ev.To = ref
+		}
 		h.mu.RLock()
 		var cli *Client
 		if set, ok := h.userConns[ev.From]; ok {
@@ -276,83 +335,19 @@ func (h *Hub) routeEvent(ev Event) {
 		}
 		return
 
-	case "message.send":
-
-		tempID, _ := ev.Payload["tempId"].(string)
-		roomIDStr, _ := ev.Payload["roomId"].(string)
-		content, _ := ev.Payload["content"].(string)
-		pParentStr, _ := ev.Payload["parentId"].(string)
-		var parentUUID *gocql.UUID
-		if pParentStr != "" {
-			if parsed, err := gocql.ParseUUID(pParentStr); err == nil {
-				parentUUID = &parsed
-			}
-		}
-
-		if ev.From == "" || roomIDStr == "" || content == "" {
-			return
-		}
-
-		rid, err1 := gocql.ParseUUID(roomIDStr)
-		uid, err2 := gocql.ParseUUID(ev.From)
-		if err1 != nil || err2 != nil {
-			return
-		}
-
-		var dbMsgID gocql.UUID
-		if h.persistMessage != nil {
-			id, err := h.persistMessage(rid, uid, content, time.Now().UTC(), parentUUID)
-			if err != nil {
-				log.Printf("persistMessage error: %v", err)
-				if c := h.findClientByUser(ev.From); c != nil {
-					h.SafeSend(c, NewServerEvent("error", "server", ev.From, map[string]any{
-						"reason": "persist_failed",
-					}))
-				}
-				return
-			}
-			dbMsgID = id
-		} else {
-			dbMsgID = gocql.TimeUUID()
-		}
-
-		username := ""
-		if h.userLookup != nil {
-			if u, err := h.userLookup(h.ctx, uid); err == nil {
-				username = u
-			} else {
-				log.Printf("userLookup error for %s: %v", uid.String(), err)
-			}
-		}
-
-		createdAt := time.Now().UTC().Format(time.RFC3339Nano)
-
-		payload := map[string]any{
-			"id":        dbMsgID.String(),
-			"tempId":    tempID,
-			"roomId":    roomIDStr,
-			"author":    map[string]any{"id": ev.From, "username": username},
-			"content":   content,
-			"createdAt": createdAt,
-		}
-		if parentUUID != nil {
-			payload["parentId"] = parentUUID.String() // 👈 include if present
-		}
-
-		out := NewServerEvent("message.created", "server", roomIDStr, payload)
-
-		h.broadcastToChannel(roomIDStr, out, "")
-		if h.Presence != nil {
-			_ = h.Presence.Touch(h.ctx, roomIDStr, ev.From)
-		}
-		return
-
 	default:
 
 		h.broadcast(ev)
 	}
 }
 
+func (h *Hub) resolveRoom(ref string) (string, bool) {
+	if ref == "" || h.ResolveRoom == nil {
+		return ref, ref != ""
+	}
+	return h.ResolveRoom(ref)
+}
+
 func (h *Hub) broadcastAll(ev Event) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
@@ -425,6 +420,30 @@ func (h *Hub) Unsubscribe(c *Client, channelID string) {
 	delete(c.subscriptions, channelID)
 }
 
+// CloseSessions disconnects the user's connections opened with one of
+// sessionIDs, or all of them when sessionIDs is empty.
+func (h *Hub) CloseSessions(userID string, sessionIDs []string) {
+	ids := make(map[string]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		ids[id] = true
+	}
+	h.mu.RLock()
+	var victims []*Client
+	for c := range h.userConns[userID] {
+		if len(ids) == 0 || ids[c.SessionID] {
+			victims = append(victims, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+	for _, c := range victims {
+		// ReadPump notices the closed connection and unregisters the client.
+		_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		_ = c.conn.Close()
+	}
+}
+
 func (h *Hub) drainAndClose() {
 	h.mu.Lock()
 	clients := make([]*Client, 0, len(h.clients))
@@ -450,10 +469,43 @@ func (h *Hub) findClientByUser(userID string) *Client {
 	return nil
 }
 
+// EmitSystem queues ev for the hub loop to route. When the queue is full it
+// waits up to emitTimeout rather than dropping the event, so it must not be
+// called from the hub loop itself.
 func (h *Hub) EmitSystem(ev Event) {
+	if !h.enqueue(ev) {
+		log.Printf("⚠️  hub queue full; dropped %s event for %s", ev.Type, ev.To)
+	}
+}
+
+func (h *Hub) enqueue(ev Event) bool {
 	select {
 	case h.system <- ev:
+		return true
 	default:
+	}
+	t := time.NewTimer(emitTimeout)
+	defer t.Stop()
+	select {
+	case h.system <- ev:
+		return true
+	case <-h.ctx.Done():
+	case <-t.C:
+	}
+	return false
+}
 
+// SendToUser delivers ev to every connection of userID through the hub loop
+// and reports whether it was queued; false means the user is offline here or
+// the hub stayed saturated for emitTimeout, and the caller should fall back
+// to storing it.
+func (h *Hub) SendToUser(userID string, ev Event) bool {
+	h.mu.RLock()
+	_, online := h.userConns[userID]
+	h.mu.RUnlock()
+	if !online {
+		return false
 	}
+	ev.To = userID
+	return h.enqueue(ev)
 }